@@ -8,10 +8,15 @@ file, You can obtain one at https://mozilla.org/MPL/2.0/.
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/Molorius/ulp-c/pkg/asm"
+	"github.com/Molorius/ulp-c/pkg/emu"
 	"github.com/spf13/cobra"
 )
 
@@ -20,86 +25,340 @@ const flagOutName = "out"
 const flagSize = "size"
 const flagOutputAssembly = "output_assembly"
 const flagReduce = "reduce"
+const flagStackReport = "stack-report"
+const flagCycles = "cycles"
+const flagCyclesPath = "cycles-path"
+const flagAccurate = "accurate"
+const flagFormat = "format"
+const flagName = "name"
+const flagPackage = "package"
+const flagSymbols = "symbols"
+const flagLoadAddress = "load-address"
+const flagShared = "shared"
+const flagSharedOut = "shared-out"
+const flagSharedLayout = "shared-layout"
+const flagLayout = "layout"
 
 // asmCmd represents the asm command
 var asmCmd = &cobra.Command{
-	Use:   "asm file",
+	Use:   "asm file...",
 	Short: "Run the assembler",
 	Long: `Compile ULP assembly to an executable binary. 
-Currently this only supports one assembly file.
+Multiple files are assembled into a single program,
+each starts in the .text section.
 
 Example:
 ulp-c asm your_code.S
-This will generate a file out.bin that can be executed by ulp_load_binary().`,
+This will generate a file out.bin that can be executed by ulp_load_binary().
+
+ulp-c asm your_code.S --format c-array -o ulp_bin.c
+This will generate C source with the binary as an array.
+Use "-o -" to write to stdout.
+
+ulp-c asm sensing.S --shared shared.S --shared-out shared.bin
+This will place the .data and .bss of shared.S at the start of RTC memory,
+with the program after it. Build every program with the same --shared
+files and they can be swapped while keeping the shared data.
+
+ulp-c asm sensing.S --shared shared.S --shared-layout shared.json
+ulp-c asm low_battery.S --shared shared.json
+This saves the layout of the shared data, then builds another program
+against it. A saved layout can also be passed with the shared files,
+which are refused if they no longer match it.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) == 0 {
 			cmd.Help()
 			os.Exit(0)
 		}
-		if len(args) != 1 {
-			fmt.Printf("1 assembly file expected but %d found\r\n", len(args))
-			os.Exit(1)
-		}
 
-		// read the assembly
-		filename := args[0]
-		contentBytes, err := os.ReadFile(filename)
+		formatName, _ := cmd.Flags().GetString(flagFormat)
+		format, err := asm.ParseFormat(formatName)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		content := string(contentBytes)
+		outputName, _ := cmd.Flags().GetString(flagOutName)
+		// keep stdout clean when the output is written there
+		info := io.Writer(os.Stdout)
+		if outputName == "-" {
+			info = os.Stderr
+		}
 
 		var bin []byte
-		assembler := asm.Assembler{}
+		var compiler *asm.Compiler
 		reservedBytes, _ := cmd.Flags().GetInt(flagReservedBytes)
 		reduce, _ := cmd.Flags().GetBool(flagReduce)
+		loadAddress, _ := cmd.Flags().GetInt(flagLoadAddress)
+
+		// optionally read the placement of sections
+		var layout *asm.Layout
+		layoutName, _ := cmd.Flags().GetString(flagLayout)
+		if layoutName != "" {
+			content, err := os.ReadFile(layoutName)
+			if err == nil {
+				layout, err = asm.ParseLayout(string(content), layoutName)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+
+		// optionally build the data shared with other programs
+		sharedNames, _ := cmd.Flags().GetStringSlice(flagShared)
+		shared, err := readShared(sharedNames, reservedBytes)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		sharedOut, _ := cmd.Flags().GetString(flagSharedOut)
+		sharedLayout, _ := cmd.Flags().GetString(flagSharedLayout)
+		if sharedOut != "" || sharedLayout != "" {
+			err = writeShared(shared, sharedOut, sharedLayout)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+
+		accurate, _ := cmd.Flags().GetBool(flagAccurate)
+		timing := emu.TimingEstimate
+		if accurate {
+			timing = emu.TimingAccurate
+		}
 
 		outputAssembly, _ := cmd.Flags().GetBool(flagOutputAssembly)
 		if outputAssembly {
+			if accurate {
+				fmt.Fprintf(os.Stderr, "--%s cannot be used with --%s\r\n", flagAccurate, flagOutputAssembly)
+				os.Exit(1)
+			}
+			if shared != nil {
+				fmt.Fprintf(os.Stderr, "--%s cannot be used with --%s\r\n", flagShared, flagOutputAssembly)
+				os.Exit(1)
+			}
+			if layout != nil {
+				fmt.Fprintf(os.Stderr, "--%s cannot be used with --%s\r\n", flagLayout, flagOutputAssembly)
+				os.Exit(1)
+			}
+			if format != asm.FormatBin {
+				fmt.Fprintf(os.Stderr, "--%s cannot be used with --%s\r\n", flagFormat, flagOutputAssembly)
+				os.Exit(1)
+			}
+			if len(args) != 1 {
+				fmt.Fprintf(os.Stderr, "1 assembly file expected but %d found\r\n", len(args))
+				os.Exit(1)
+			}
+			// read the assembly
+			filename := args[0]
+			content, err := os.ReadFile(filename)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
 			// compile to assembly (binary with labels)
-			bin, err = assembler.BuildAssembly(content, filename, reservedBytes, reduce)
+			assembler := asm.Assembler{LoadAddress: loadAddress}
+			bin, err = assembler.BuildAssembly(string(content), filename, reservedBytes, reduce)
 			if err != nil {
-				fmt.Println(err)
+				fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
 			}
+			compiler = &assembler.Compiler
 		} else {
 			// compile to a binary
-			bin, err = assembler.BuildFile(content, filename, reservedBytes, reduce)
+			sources := make([]asm.Source, len(args))
+			for i, filename := range args {
+				sources[i] = asm.Source{Name: filename}
+			}
+			opts := asm.Options{
+				ReservedBytes: reservedBytes,
+				LoadAddress:   loadAddress,
+				Reduce:        reduce,
+				Shared:        shared,
+				Layout:        layout,
+				Timing:        timing,
+			}
+			res, err := asm.Build(context.Background(), sources, opts)
 			if err != nil {
-				fmt.Println(err)
+				fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
 			}
+			bin = res.Binary
+			compiler = res.Compiler
 		}
 
-		// write it to a file
-		outputName, _ := cmd.Flags().GetString(flagOutName)
-		f, err := os.Create(outputName)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+		// optionally check the stack depth
+		stackReport, _ := cmd.Flags().GetBool(flagStackReport)
+		if stackReport {
+			report := compiler.StackReport()
+			fmt.Fprintln(info, report)
+			if report.Overflows() {
+				os.Exit(1)
+			}
+		}
+
+		// optionally estimate the cycles
+		cycles, _ := cmd.Flags().GetBool(flagCycles)
+		if cycles {
+			fmt.Fprintln(info, compiler.CycleReport())
 		}
-		defer f.Close()
-		_, err = f.Write(bin)
+		cyclesPath, _ := cmd.Flags().GetString(flagCyclesPath)
+		if cyclesPath != "" {
+			from, to, ok := strings.Cut(cyclesPath, ",")
+			if !ok {
+				fmt.Fprintf(os.Stderr, "expected \"from,to\" labels for --%s but got \"%s\"\r\n", flagCyclesPath, cyclesPath)
+				os.Exit(1)
+			}
+			r, err := compiler.PathCycles(strings.TrimSpace(from), strings.TrimSpace(to))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			fmt.Fprintf(info, "%s to %s: %s\n", from, to, r)
+		}
+
+		// write it out
+		name, _ := cmd.Flags().GetString(flagName)
+		pkg, _ := cmd.Flags().GetString(flagPackage)
+		err = writeOutput(outputName, format, bin, name, pkg)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 
+		// optionally write the symbol table
+		symbolsName, _ := cmd.Flags().GetString(flagSymbols)
+		if symbolsName != "" {
+			table, err := compiler.SymbolTable(bin).JSON()
+			if err == nil {
+				err = os.WriteFile(symbolsName, table, 0644)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+
 		// optionally print section size
 		printSize, _ := cmd.Flags().GetBool(flagSize)
 		if printSize {
-			fmt.Println(assembler.Compiler.FormatSections())
+			fmt.Fprintln(info, compiler.FormatSections())
 		}
 	},
 }
 
+// readShared builds the shared data from assembly files and reads saved
+// layouts from json files. Every saved layout must match the shared data.
+func readShared(names []string, reservedBytes int) (*asm.SharedLayout, error) {
+	sources := make([]asm.Source, 0)
+	saved := make([]*asm.SharedLayout, 0)
+	for _, filename := range names {
+		if filepath.Ext(filename) != ".json" {
+			sources = append(sources, asm.Source{Name: filename})
+			continue
+		}
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		l, err := asm.ParseSharedLayout(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		saved = append(saved, l)
+	}
+	var shared *asm.SharedLayout
+	if len(sources) != 0 {
+		opts := asm.Options{ReservedBytes: reservedBytes}
+		l, err := asm.BuildShared(context.Background(), sources, opts)
+		if err != nil {
+			return nil, err
+		}
+		shared = l
+	} else if len(saved) != 0 {
+		shared = saved[0]
+	}
+	for _, l := range saved {
+		if err := shared.Match(l); err != nil {
+			return nil, err
+		}
+	}
+	return shared, nil
+}
+
+// writeShared writes the initial content and the layout of the shared data.
+func writeShared(shared *asm.SharedLayout, imageName string, layoutName string) error {
+	if shared == nil {
+		return fmt.Errorf("--%s and --%s need --%s", flagSharedOut, flagSharedLayout, flagShared)
+	}
+	if imageName != "" {
+		if shared.Image == nil {
+			return fmt.Errorf("--%s needs the shared assembly files, a saved layout has no content", flagSharedOut)
+		}
+		err := os.WriteFile(imageName, shared.Image, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	if layoutName != "" {
+		b, err := shared.JSON()
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(layoutName, append(b, '\n'), 0644)
+	}
+	return nil
+}
+
+// writeOutput writes the binary in the requested format to a file,
+// or to stdout if the name is "-".
+func writeOutput(outputName string, format asm.Format, bin []byte, name string, pkg string) error {
+	if format == asm.FormatSections {
+		// written as separate files, such as out.text.bin and out.data.bin
+		if outputName == "-" {
+			return fmt.Errorf("cannot write --%s %s to stdout", flagFormat, format)
+		}
+		text, data, err := asm.SplitSections(bin)
+		if err != nil {
+			return err
+		}
+		base := strings.TrimSuffix(outputName, filepath.Ext(outputName))
+		err = os.WriteFile(base+".text.bin", text, 0644)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(base+".data.bin", data, 0644)
+	}
+	out, err := asm.Encode(bin, format, name, pkg)
+	if err != nil {
+		return err
+	}
+	if outputName == "-" {
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+	return os.WriteFile(outputName, out, 0644)
+}
+
 func init() {
 	rootCmd.AddCommand(asmCmd)
 
 	asmCmd.Flags().IntP(flagReservedBytes, "r", 8176, "number of bytes reserved for the ULP")
-	asmCmd.Flags().StringP(flagOutName, "o", "out.bin", "name of the output file")
+	asmCmd.Flags().StringP(flagOutName, "o", "out.bin", "name of the output file, \"-\" for stdout")
 	asmCmd.Flags().BoolP(flagSize, "s", false, "print the size of all sections")
 	asmCmd.Flags().Bool(flagOutputAssembly, false, "compile to ulp assembly rather than a binary")
 	asmCmd.Flags().Bool(flagReduce, false, "reduce similar statements to jumps, unsafe")
+	asmCmd.Flags().Bool(flagStackReport, false, "print the worst case stack depth, fail if it overflows")
+	asmCmd.Flags().Bool(flagCycles, false, "print the best and worst case cycles of each function")
+	asmCmd.Flags().StringP(flagFormat, "f", "bin", "output format: bin, ihex, c-array, go, or sections")
+	asmCmd.Flags().String(flagName, "", "variable name for the c-array and go formats")
+	asmCmd.Flags().String(flagPackage, "main", "package name for the go format")
+	asmCmd.Flags().String(flagCyclesPath, "", "print the best and worst case cycles between two labels, such as \"start,end\"")
+	asmCmd.Flags().Bool(flagAccurate, false, "use the cycles of the technical reference manual for --cycles and .timing")
+	asmCmd.Flags().Int(flagLoadAddress, 0, "word address the program is loaded at by ulp_load_binary()")
+	asmCmd.Flags().StringSlice(flagShared, nil, "files with .data and .bss shared with other programs, placed before the program")
+	asmCmd.Flags().String(flagSharedOut, "", "write the initial content of the shared data to a file")
+	asmCmd.Flags().String(flagSharedLayout, "", "write the layout of the shared data to a json file for --shared")
+	asmCmd.Flags().String(flagLayout, "", "file describing the order, alignment and address of sections")
+	asmCmd.Flags().String(flagSymbols, "", "write the labels, sections and header to a json file")
 }
@@ -0,0 +1,135 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Molorius/ulp-c/pkg/asm"
+	"github.com/Molorius/ulp-c/pkg/debug"
+	"github.com/Molorius/ulp-c/pkg/emu"
+	"github.com/spf13/cobra"
+)
+
+const flagTrace = "trace"
+const flagVcd = "vcd"
+
+// debugCmd represents the debug command
+var debugCmd = &cobra.Command{
+	Use:   "debug file",
+	Short: "Debug a ULP binary in the emulator",
+	Long: `Run a ULP binary in the emulator with an interactive debugger.
+Set breakpoints and watchpoints, step through the program and read
+or write memory. Symbols written by "ulp-c asm --symbols" let
+locations be given by label. Type "help" for the commands.
+Each executed instruction can be written to a JSON lines trace and
+a VCD file for waveform viewers when the debugger exits.
+
+Example:
+ulp-c asm main.S --symbols out.json
+ulp-c debug out.bin --symbols out.json --vcd out.vcd`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Help()
+			os.Exit(0)
+		}
+		if len(args) != 1 {
+			fmt.Fprintf(os.Stderr, "1 binary expected but %d found\r\n", len(args))
+			os.Exit(1)
+		}
+		d, err := loadDebugger(cmd, args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		traceName, _ := cmd.Flags().GetString(flagTrace)
+		vcdName, _ := cmd.Flags().GetString(flagVcd)
+		if traceName != "" || vcdName != "" {
+			d.Emu.Trace = emu.NewTrace()
+			d.Emu.Trace.Disassemble = func(addr int, instr uint32) string {
+				decoded, _ := asm.Decode(instr)
+				return decoded.Disassemble(addr)
+			}
+		}
+		err = debug.NewConsole(d, os.Stdin, os.Stdout).Run()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		err = writeTrace(d.Emu, traceName, vcdName)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	},
+}
+
+// loadDebugger loads a binary and its optional symbols into a new emulator.
+func loadDebugger(cmd *cobra.Command, filename string) (*debug.Debugger, error) {
+	bin, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	reservedBytes, _ := cmd.Flags().GetInt(flagReservedBytes)
+	loadAddress, _ := cmd.Flags().GetInt(flagLoadAddress)
+	u, err := emu.NewUlpEmu(reservedBytes)
+	if err != nil {
+		return nil, err
+	}
+	err = u.LoadBinaryAt(bin, loadAddress)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	symbols := []asm.Symbol(nil)
+	symbolsName, _ := cmd.Flags().GetString(flagSymbols)
+	if symbolsName != "" {
+		data, err := os.ReadFile(symbolsName)
+		if err != nil {
+			return nil, err
+		}
+		table, err := asm.ParseSymbolTable(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", symbolsName, err)
+		}
+		symbols = table.Symbols
+	}
+	return debug.New(u, symbols), nil
+}
+
+// writeTrace writes the trace of the emulator as JSON lines and VCD,
+// skipping empty names.
+func writeTrace(u *emu.UlpEmu, traceName string, vcdName string) error {
+	write := func(name string, f func(w io.Writer) error) error {
+		if name == "" {
+			return nil
+		}
+		file, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return f(file)
+	}
+	err := write(traceName, u.Trace.WriteJSON)
+	if err != nil {
+		return err
+	}
+	return write(vcdName, u.WriteVCD)
+}
+
+func init() {
+	rootCmd.AddCommand(debugCmd)
+
+	debugCmd.Flags().IntP(flagReservedBytes, "r", 8176, "number of bytes reserved for the ULP")
+	debugCmd.Flags().Int(flagLoadAddress, 0, "word address the program is loaded at by ulp_load_binary()")
+	debugCmd.Flags().String(flagSymbols, "", "the json symbol table written by \"ulp-c asm --symbols\"")
+	debugCmd.Flags().String(flagTrace, "", "write each executed instruction to a JSON lines file")
+	debugCmd.Flags().String(flagVcd, "", "write the pc, registers and RTC GPIO pins to a VCD file")
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// unifiedDiff returns the difference between two texts as a unified diff
+// with 3 lines of context, or an empty string if they are the same.
+func unifiedDiff(name string, a string, b string) string {
+	if a == b {
+		return ""
+	}
+	x := strings.SplitAfter(a, "\n")
+	y := strings.SplitAfter(b, "\n")
+	if x[len(x)-1] == "" {
+		x = x[:len(x)-1]
+	}
+	if y[len(y)-1] == "" {
+		y = y[:len(y)-1]
+	}
+
+	// longest common subsequence, lcs[i][j] is for x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	// each line of the edit script
+	type edit struct {
+		op   byte // ' ', '-', or '+'
+		line string
+		i, j int // line numbers before this edit
+	}
+	edits := make([]edit, 0)
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			edits = append(edits, edit{' ', x[i], i, j})
+			i++
+			j++
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', x[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', y[j], i, j})
+			j++
+		}
+	}
+
+	// group the edits into hunks with context
+	const context = 3
+	s := fmt.Sprintf("--- a/%s\n+++ b/%s\n", name, name)
+	for k := 0; k < len(edits); {
+		if edits[k].op == ' ' {
+			k++
+			continue
+		}
+		start := max(k-context, 0)
+		end := k
+		for end < len(edits) {
+			if edits[end].op != ' ' {
+				end++
+				continue
+			}
+			// stop when the unchanged run is too long to join the next change
+			run := end
+			for run < len(edits) && edits[run].op == ' ' {
+				run++
+			}
+			if run == len(edits) || run-end > 2*context {
+				end = min(end+context, len(edits))
+				break
+			}
+			end = run
+		}
+		oldLen, newLen := 0, 0
+		body := ""
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				oldLen++
+			}
+			if e.op != '-' {
+				newLen++
+			}
+			line := e.line
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n\\ No newline at end of file\n"
+			}
+			body += string(e.op) + line
+		}
+		s += fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", edits[start].i+1, oldLen, edits[start].j+1, newLen)
+		s += body
+		k = end
+	}
+	return s
+}
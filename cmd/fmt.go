@@ -0,0 +1,104 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Molorius/ulp-c/pkg/asm"
+	"github.com/spf13/cobra"
+)
+
+const flagList = "list"
+const flagDiff = "diff"
+const flagWrite = "write"
+
+// fmtCmd represents the fmt command
+var fmtCmd = &cobra.Command{
+	Use:   "fmt [file...]",
+	Short: "Format ULP assembly",
+	Long: `Format ULP assembly into a canonical style. Labels start the line,
+other statements are indented with a tab, operands within a block of
+instructions are aligned, and comments are kept.
+With no files it formats stdin to stdout.
+
+With --list or --diff nothing is written, and the exit status is 1
+if any file is not formatted. This can be used as a pre-commit check:
+ulp-c fmt -l *.S`,
+	Run: func(cmd *cobra.Command, args []string) {
+		list, _ := cmd.Flags().GetBool(flagList)
+		diff, _ := cmd.Flags().GetBool(flagDiff)
+		write, _ := cmd.Flags().GetBool(flagWrite)
+
+		if len(args) == 0 {
+			src, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			out, err := asm.FormatSource(src, "<stdin>")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			os.Stdout.Write(out)
+			return
+		}
+
+		unformatted := false
+		failed := false
+		for _, filename := range args {
+			src, err := os.ReadFile(filename)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				failed = true
+				continue
+			}
+			out, err := asm.FormatSource(src, filename)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				failed = true
+				continue
+			}
+			same := bytes.Equal(src, out)
+			if !same {
+				unformatted = true
+			}
+			if list && !same {
+				fmt.Println(filename)
+			}
+			if diff && !same {
+				fmt.Print(unifiedDiff(filename, string(src), string(out)))
+			}
+			if write && !same {
+				err = os.WriteFile(filename, out, 0644)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					failed = true
+				}
+			}
+			if !list && !diff && !write {
+				os.Stdout.Write(out)
+			}
+		}
+		if failed || ((list || diff) && !write && unformatted) {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(fmtCmd)
+
+	fmtCmd.Flags().BoolP(flagList, "l", false, "list files that are not formatted")
+	fmtCmd.Flags().BoolP(flagDiff, "d", false, "print the changes formatting would make")
+	fmtCmd.Flags().BoolP(flagWrite, "w", false, "write the formatted source back to each file")
+}
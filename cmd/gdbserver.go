@@ -0,0 +1,80 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/Molorius/ulp-c/pkg/debug"
+	"github.com/spf13/cobra"
+)
+
+const flagPort = "port"
+
+// gdbserverCmd represents the gdbserver command
+var gdbserverCmd = &cobra.Command{
+	Use:   "gdbserver file",
+	Short: "Debug a ULP binary in the emulator with gdb",
+	Long: `Run a ULP binary in the emulator and wait for gdb to connect
+over the GDB Remote Serial Protocol on localhost. Supports reading and
+writing registers and memory, breakpoints, write watchpoints, single
+step and continue. Exits when gdb detaches or kills the program.
+
+gdb has no ULP architecture, use a gdb built for all targets such as
+gdb-multiarch without loading a file. See the GDB section of the emu
+README if it rejects the target description.
+
+Example:
+ulp-c gdbserver --port 3333 out.bin
+gdb-multiarch -ex "target remote localhost:3333"`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Help()
+			os.Exit(0)
+		}
+		if len(args) != 1 {
+			fmt.Fprintf(os.Stderr, "1 binary expected but %d found\r\n", len(args))
+			os.Exit(1)
+		}
+		d, err := loadDebugger(cmd, args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		port, _ := cmd.Flags().GetInt(flagPort)
+		listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer listener.Close()
+		fmt.Fprintf(os.Stderr, "listening on %s\n", listener.Addr())
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		server := debug.NewGdbServer(d, conn) // closes conn when done
+		server.Log = os.Stderr
+		err = server.Serve()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(gdbserverCmd)
+
+	gdbserverCmd.Flags().IntP(flagPort, "p", 3333, "TCP port to listen on")
+	gdbserverCmd.Flags().IntP(flagReservedBytes, "r", 8176, "number of bytes reserved for the ULP")
+	gdbserverCmd.Flags().Int(flagLoadAddress, 0, "word address the program is loaded at by ulp_load_binary()")
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Molorius/ulp-c/pkg/asm"
+	"github.com/Molorius/ulp-c/pkg/emu"
+	"github.com/spf13/cobra"
+)
+
+const flagDisassemble = "disassemble"
+
+// inspectCmd represents the inspect command
+var inspectCmd = &cobra.Command{
+	Use:   "inspect file",
+	Short: "Validate and summarize a ULP binary",
+	Long: `Validate the header of a ULP binary and print a summary of its sections.
+Fails if the header does not match the file or does not fit in the reserved memory.
+
+Example:
+ulp-c inspect out.bin --disassemble`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Help()
+			os.Exit(0)
+		}
+		if len(args) != 1 {
+			fmt.Fprintf(os.Stderr, "1 binary expected but %d found\r\n", len(args))
+			os.Exit(1)
+		}
+
+		filename := args[0]
+		bin, err := os.ReadFile(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		h, err := emu.ParseHeader(bin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\r\n", filename, err)
+			os.Exit(1)
+		}
+		reservedBytes, _ := cmd.Flags().GetInt(flagReservedBytes)
+		loadAddress, _ := cmd.Flags().GetInt(flagLoadAddress)
+		base := loadAddress * 4
+
+		fmt.Printf("file        %s, %d bytes\n", filename, len(bin))
+		fmt.Printf("text offset %d\n", h.TextOffset)
+		fmt.Printf(".text       %d bytes at 0x%04x\n", h.TextSize, base)
+		fmt.Printf(".data       %d bytes at 0x%04x\n", h.DataSize, base+h.TextSize)
+		fmt.Printf(".bss        %d bytes at 0x%04x\n", h.BssSize, base+h.TextSize+h.DataSize)
+		fmt.Printf("total %d of %d reserved bytes\n", base+h.TextSize+h.DataSize+h.BssSize, reservedBytes)
+
+		validateErr := h.Validate(len(bin), reservedBytes-base)
+
+		// optionally disassemble whatever text is present
+		disassemble, _ := cmd.Flags().GetBool(flagDisassemble)
+		if disassemble {
+			start := min(h.TextOffset, len(bin))
+			end := min(h.TextOffset+h.TextSize, len(bin))
+			fmt.Println()
+			fmt.Print(asm.DisassembleListing(bin[start:end], loadAddress))
+		}
+
+		if validateErr != nil {
+			fmt.Fprintf(os.Stderr, "%s is invalid:\r\n%s\r\n", filename, validateErr)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+
+	inspectCmd.Flags().IntP(flagReservedBytes, "r", 8176, "number of bytes reserved for the ULP")
+	inspectCmd.Flags().Int(flagLoadAddress, 0, "word address the program is loaded at by ulp_load_binary()")
+	inspectCmd.Flags().BoolP(flagDisassemble, "d", false, "print the disassembly of the .text section")
+}
@@ -0,0 +1,43 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Molorius/ulp-c/pkg/lsp"
+	"github.com/spf13/cobra"
+)
+
+// lspCmd represents the lsp command
+var lspCmd = &cobra.Command{
+	Use:   "lsp",
+	Short: "Run a language server for ULP assembly",
+	Long: `Run a language server for ULP assembly over stdin and stdout.
+Supports diagnostics, go to definition and references of labels,
+hover with the address and encoding of instructions, completion
+and signature help.
+
+Example editor command:
+ulp-c lsp`,
+	Run: func(cmd *cobra.Command, args []string) {
+		server := lsp.NewServer(os.Stdin, os.Stdout)
+		server.Reserved, _ = cmd.Flags().GetInt(flagReservedBytes)
+		err := server.Serve()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(lspCmd)
+	lspCmd.Flags().IntP(flagReservedBytes, "r", 8176, "number of bytes reserved for the ULP")
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/Molorius/ulp-c/pkg/asm"
+	"github.com/Molorius/ulp-c/pkg/emu"
+	"github.com/spf13/cobra"
+)
+
+const flagJson = "json"
+const flagCompare = "compare"
+
+// sizeCmd represents the size command
+var sizeCmd = &cobra.Command{
+	Use:   "size file",
+	Short: "Print the size of each function and data object",
+	Long: `Print the size of each function and data object, largest first.
+The file can be ULP assembly or a built binary. A binary has no labels
+so only the size of each section is printed, and its .bss cannot be
+separated from the stack.
+
+Example:
+ulp-c size your_code.S --json size.json
+ulp-c size your_code.S --compare size.json
+This saves a report then shows the growth since that report.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Help()
+			os.Exit(0)
+		}
+		if len(args) != 1 {
+			fmt.Fprintf(os.Stderr, "1 file expected but %d found\r\n", len(args))
+			os.Exit(1)
+		}
+
+		filename := args[0]
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		reservedBytes, _ := cmd.Flags().GetInt(flagReservedBytes)
+		reduce, _ := cmd.Flags().GetBool(flagReduce)
+
+		var report asm.SizeReport
+		if emu.IsBinary(content) {
+			report, err = asm.BinarySizeReport(content, reservedBytes)
+		} else {
+			assembler := asm.Assembler{}
+			_, err = assembler.BuildFile(string(content), filename, reservedBytes, reduce)
+			report = assembler.Compiler.SizeReport(reservedBytes)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		// optionally compare against a previous report
+		var prev *asm.SizeReport
+		compare, _ := cmd.Flags().GetString(flagCompare)
+		if compare != "" {
+			b, err := os.ReadFile(compare)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			prev = &asm.SizeReport{}
+			err = json.Unmarshal(b, prev)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "could not read %s: %s\r\n", compare, err)
+				os.Exit(1)
+			}
+		}
+		fmt.Println(report.Compare(prev))
+
+		// optionally save the report
+		jsonName, _ := cmd.Flags().GetString(flagJson)
+		if jsonName != "" {
+			b, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			err = os.WriteFile(jsonName, append(b, '\n'), 0644)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(sizeCmd)
+
+	sizeCmd.Flags().IntP(flagReservedBytes, "r", 8176, "number of bytes reserved for the ULP")
+	sizeCmd.Flags().Bool(flagReduce, false, "reduce similar statements to jumps, unsafe")
+	sizeCmd.Flags().String(flagJson, "", "save the report as json to this file")
+	sizeCmd.Flags().String(flagCompare, "", "show the growth since a previous json report")
+}
@@ -7,49 +7,42 @@ file, You can obtain one at https://mozilla.org/MPL/2.0/.
 */
 package asm
 
-import (
-	"errors"
-	"fmt"
-)
+import "context"
 
 type Assembler struct {
-	Compiler Compiler
+	Compiler    Compiler
+	LoadAddress int // word address the program is loaded at, see ulp_load_binary()
 }
 
 func (asm *Assembler) BuildFile(content string, name string, reservedBytes int, reduce bool) ([]byte, error) {
-	s := scanner{}
-	tokens, err := s.scanFile(content, name)
-	if err != nil {
-		return nil, errors.Join(fmt.Errorf("error while scanning"), err)
-	}
-	p := parser{}
-	stmnts, err := p.parseTokens(tokens)
-	if err != nil {
-		return nil, errors.Join(fmt.Errorf("error while parsing"), err)
-	}
-	asm.Compiler = Compiler{}
-	bin, err := asm.Compiler.CompileToBin(stmnts, reservedBytes, reduce)
+	res, err := asm.build(content, name, Options{ReservedBytes: reservedBytes, Reduce: reduce})
 	if err != nil {
 		return nil, err
 	}
-	return bin, nil
+	return res.Binary, nil
 }
 
 func (asm *Assembler) BuildAssembly(content string, name string, reservedBytes int, reduce bool) ([]byte, error) {
-	s := scanner{}
-	tokens, err := s.scanFile(content, name)
-	if err != nil {
-		return nil, errors.Join(fmt.Errorf("error while scanning"), err)
-	}
-	p := parser{}
-	stmnts, err := p.parseTokens(tokens)
+	res, err := asm.build(content, name, Options{ReservedBytes: reservedBytes, Reduce: reduce, assembly: true})
 	if err != nil {
-		return nil, errors.Join(fmt.Errorf("error while parsing"), err)
+		return nil, err
 	}
-	asm.Compiler = Compiler{}
-	bin, err := asm.Compiler.CompileToAsm(stmnts, reservedBytes, reduce)
+	return res.Output, nil
+}
+
+// build builds a single file with Build() into asm.Compiler.
+func (asm *Assembler) build(content string, name string, opts Options) (*Result, error) {
+	opts.LoadAddress = asm.LoadAddress
+	res := &Result{}
+	err := build(context.Background(), []Source{{Name: name, Content: []byte(content)}}, opts, res, &asm.Compiler)
+	return res, err
+}
+
+// parseFile scans and parses a single assembly file.
+func parseFile(content string, name string) ([]Stmnt, error) {
+	f, err := Parse(content, name)
 	if err != nil {
 		return nil, err
 	}
-	return bin, nil
+	return f.Stmnts, nil
 }
@@ -0,0 +1,98 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// File is a parsed assembly file.
+type File struct {
+	Name     string
+	Stmnts   []Stmnt
+	Comments []Comment // every comment in source order
+}
+
+// Parse scans and parses a single assembly file. If there is an error
+// then the returned file holds every statement that could be parsed.
+func Parse(src string, name string) (*File, error) {
+	f := &File{Name: name}
+	s := scanner{}
+	tokens, err := s.scanFile(src, name)
+	f.Comments = s.comments
+	if err != nil {
+		return f, errors.Join(fmt.Errorf("error while scanning"), err)
+	}
+	p := parser{}
+	f.Stmnts, err = p.parseTokens(tokens)
+	if err != nil {
+		return f, errors.Join(fmt.Errorf("error while parsing"), err)
+	}
+	return f, nil
+}
+
+// A Visitor's Visit method is called for each node found by Walk.
+// If the returned visitor is not nil then Walk visits each child
+// of the node with it, followed by a call of Visit(nil).
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses a node and its children in depth first order.
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+	switch n := node.(type) {
+	case StmntInt:
+		for _, a := range n.Args {
+			Walk(v, a)
+		}
+	case StmntBound:
+		Walk(v, n.Bound)
+	case StmntTiming:
+		Walk(v, n.Min)
+		Walk(v, n.Max)
+	case StmntInstr:
+		for _, a := range n.Args {
+			Walk(v, a)
+		}
+	case ArgExpr:
+		Walk(v, n.Expr)
+	case ExprBinary:
+		Walk(v, n.Left)
+		Walk(v, n.Right)
+	case ExprUnary:
+		Walk(v, n.Expression)
+	}
+	v.Visit(nil)
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses a node and its children in depth first order,
+// calling f for each. If f returns false then the children are skipped.
+// After the children are visited f is called with nil.
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
+
+// WalkFile walks every statement of a file in order.
+func WalkFile(v Visitor, f *File) {
+	for _, s := range f.Stmnts {
+		Walk(v, s)
+	}
+}
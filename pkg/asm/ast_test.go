@@ -0,0 +1,147 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	src := "entry:\n  move r0, a + 1 // set r0\n\t.int 2\n"
+	f, err := Parse(src, "test.S")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Stmnts) != 3 {
+		t.Fatalf("expected 3 statements got %d", len(f.Stmnts))
+	}
+	positions := []FileRef{
+		{"test.S", 1, 1},
+		{"test.S", 2, 3},
+		{"test.S", 3, 2},
+	}
+	for i, s := range f.Stmnts {
+		if s.Pos() != positions[i] {
+			t.Errorf("statement %d expected position %s got %s", i, positions[i], s.Pos())
+		}
+	}
+	if len(f.Comments) != 1 || f.Comments[0].Text != "// set r0" || f.Comments[0].Ref.Line != 2 {
+		t.Errorf("unexpected comments %+v", f.Comments)
+	}
+
+	_, err = Parse("move r0\n", "test.S")
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestInspect(t *testing.T) {
+	f, err := Parse("move r0, a + b\njump a\n.int c\n", "test.S")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idents := make([]string, 0)
+	regs := 0
+	for _, s := range f.Stmnts {
+		Inspect(s, func(n Node) bool {
+			switch n := n.(type) {
+			case ExprLiteral:
+				idents = append(idents, n.Operator.Lexeme)
+			case ArgReg:
+				regs++
+			}
+			return true
+		})
+	}
+	expect := []string{"a", "b", "a", "c"}
+	if len(idents) != len(expect) {
+		t.Fatalf("expected %v got %v", expect, idents)
+	}
+	for i := range expect {
+		if idents[i] != expect[i] {
+			t.Errorf("expected %v got %v", expect, idents)
+		}
+	}
+	if regs != 1 {
+		t.Errorf("expected 1 register got %d", regs)
+	}
+}
+
+func TestPrint(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		expect string
+	}{
+		{
+			name:   "layout",
+			src:    "  .boot\nentry: move r0,1\n\n\n   halt",
+			expect: "\t.boot\nentry:\n\tmove r0, 1\n\n\thalt\n",
+		},
+		{
+			name:   "comments",
+			src:    "// top\nadd r0, r0, 1 # trailing\n  /* a\n  b */\nhalt\n",
+			expect: "// top\n\tadd r0, r0, 1 # trailing\n\t/* a\n  b */\n\thalt\n",
+		},
+		{
+			name:   "expressions",
+			src:    "move r0, (a+b)*-(c) >> (1<<2)\nmove r0, a-(b-c)\nmove r0, (a-b)-c\n.int 0x10, 0b11\n",
+			expect: "\tmove r0, (a + b) * -c >> (1 << 2)\n\tmove r0, a - (b - c)\n\tmove r0, a - b - c\n\t.int 0x10, 0b11\n",
+		},
+		{
+			name:   "alignment",
+			src:    "a:\nstage_rst // x\nmove r0, 1 // longer\nhalt\n\njumpr a, 1, lt\nadd r0, r0, 1\n",
+			expect: "a:\n\tstage_rst  // x\n\tmove r0, 1 // longer\n\thalt\n\n\tjumpr a, 1, lt\n\tadd   r0, r0, 1\n",
+		},
+		{
+			name:   "directives",
+			src:    ".global x\n.bound 2\njump x, eq\n.timing 1,(2)\n.endtiming\n",
+			expect: "\t.global x\n\t.bound 2\n\tjump x, eq\n\t.timing 1, 2\n\t.endtiming\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := Parse(tt.src, "test.S")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := f.String()
+			if got != tt.expect {
+				t.Errorf("expected\n%q got\n%q", tt.expect, got)
+			}
+			// printing is stable
+			again, err := Parse(got, "test.S")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again.String() != got {
+				t.Errorf("printing again changed the source:\n%q", again.String())
+			}
+		})
+	}
+}
+
+func TestPrintSameBinary(t *testing.T) {
+	f, err := Parse(TEST_PRELUDE, "prelude.S")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := Assembler{}
+	expect, err := a.BuildFile(TEST_PRELUDE, "prelude.S", 8176, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := a.BuildFile(f.String(), "prelude.S", 8176, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expect, got) {
+		t.Errorf("the printed source built a different binary")
+	}
+}
@@ -0,0 +1,368 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Molorius/ulp-c/pkg/asm/token"
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+// TargetESP32 is the ESP32 ULP coprocessor, the only supported target.
+const TargetESP32 = "esp32"
+
+// DefaultReservedBytes is the default memory reserved for the ULP.
+const DefaultReservedBytes = 8176
+
+// Source is a single assembly file.
+type Source struct {
+	Name    string // the file name, used in diagnostics
+	Content []byte // if nil then it is loaded with Options.Resolver
+}
+
+// Resolver loads the content of a source by name.
+type Resolver func(name string) ([]byte, error)
+
+// Options controls how the sources are built.
+type Options struct {
+	Target        string         // the target, TargetESP32 if empty
+	ReservedBytes int            // memory reserved for the ULP, DefaultReservedBytes if 0
+	LoadAddress   int            // word address the program is loaded at, see ulp_load_binary()
+	Shared        *SharedLayout  // data shared with other programs, see BuildShared()
+	Layout        *Layout        // the placement of sections, DefaultLayout() if nil
+	Reduce        bool           // reduce similar statements to jumps, unsafe
+	Resolver      Resolver       // loads sources without content, os.ReadFile if nil
+	Defines       map[string]int // constants that can be used like labels
+	Timing        emu.Timing     // the cycle model of timing analysis, emu.TimingEstimate if zero
+	Format        Format         // format of Result.Output, FormatBin if empty
+	Name          string         // variable name for FormatCArray and FormatGo
+	Package       string         // package name for FormatGo
+
+	assembly bool // Result.Output is the program as assembly, see Assembler.BuildAssembly()
+}
+
+// Symbol is a label in the built program.
+type Symbol struct {
+	Name    string `json:"name"`
+	Address int    `json:"address"` // word address, or the value of a define
+	Section string `json:"section"` // the section name, empty for defines and generated labels
+	Global  bool   `json:"global"`
+	Binding string `json:"binding"`        // "default", "weak" or "local"
+	File    string `json:"file,omitempty"` // the file defining a local label
+	Size    int    `json:"size"`           // size in bytes until the next label, see SymbolTable
+}
+
+// SectionInfo is the placement of a section in memory.
+type SectionInfo struct {
+	Name    string `json:"name"`
+	Address int    `json:"address"` // byte address
+	Size    int    `json:"size"`    // size in bytes
+	Bin     []byte `json:"-"`
+}
+
+// Severity is how serious a diagnostic is.
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return "unknown"
+	}
+}
+
+// Diagnostic is a single problem found while building.
+type Diagnostic struct {
+	Ref      FileRef // where the problem is, empty if unknown
+	Severity Severity
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	if d.Ref.Filename == "" {
+		return fmt.Sprintf("%s: %s", d.Severity, d.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", d.Ref, d.Severity, d.Message)
+}
+
+// Result is everything produced by a build.
+type Result struct {
+	Binary      []byte        // the binary loaded by ulp_load_binary()
+	Output      []byte        // the binary in Options.Format, nil for FormatSections
+	Symbols     []Symbol      // sorted by address
+	Sections    []SectionInfo // in memory order
+	Listing     string        // the disassembly with labels
+	Diagnostics []Diagnostic
+	Compiler    *Compiler // for further analysis such as StackReport()
+}
+
+// Build assembles the sources into a single program. Each source starts in
+// the .text section. On failure the error is returned along with a Result
+// holding the diagnostics.
+func Build(ctx context.Context, sources []Source, opts Options) (*Result, error) {
+	res := &Result{}
+	err := build(ctx, sources, opts, res, &Compiler{})
+	if err != nil {
+		res.Diagnostics = append(res.Diagnostics, Diagnostics(err)...)
+	}
+	return res, err
+}
+
+// build compiles the sources into c, which is reset first.
+func build(ctx context.Context, sources []Source, opts Options, res *Result, c *Compiler) error {
+	if opts.Target != "" && opts.Target != TargetESP32 {
+		return fmt.Errorf("unknown target \"%s\", expected \"%s\"", opts.Target, TargetESP32)
+	}
+	if opts.ReservedBytes == 0 {
+		opts.ReservedBytes = DefaultReservedBytes
+	}
+	if opts.Resolver == nil {
+		opts.Resolver = os.ReadFile
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("no sources to build")
+	}
+
+	// parse every source
+	program := make([]Stmnt, 0)
+	errs := error(nil)
+	for _, src := range sources {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		content := src.Content
+		if content == nil {
+			var err error
+			content, err = opts.Resolver(src.Name)
+			if err != nil {
+				errs = errors.Join(errs, err)
+				continue
+			}
+		}
+		stmnts, err := parseFile(string(content), src.Name)
+		if err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+		// every file starts in .text
+		text := Token{TokenType: token.Text, Lexeme: ".text", Ref: FileRef{Filename: src.Name, Line: 1, Index: 1}}
+		program = append(program, StmntDirective{text})
+		program = append(program, stmnts...)
+	}
+	if errs != nil {
+		return errs
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// compile
+	*c = Compiler{Defines: opts.Defines, LoadAddress: opts.LoadAddress, Shared: opts.Shared, Layout: opts.Layout, Timing: opts.Timing}
+	res.Compiler = c
+	bin, err := c.CompileToBin(program, opts.ReservedBytes, opts.Reduce)
+	if err != nil {
+		return err
+	}
+	res.Binary = bin
+	if opts.assembly {
+		res.Output = c.assembly()
+	} else if opts.Format != FormatSections {
+		res.Output, err = Encode(bin, opts.Format, opts.Name, opts.Package)
+		if err != nil {
+			return err
+		}
+	}
+	res.Symbols = c.Symbols()
+	res.Sections = c.SectionInfo()
+	res.Listing = c.Listing()
+	return nil
+}
+
+type namedSection struct {
+	name    string
+	section *Section
+}
+
+// namedSections returns every section in memory order with its name.
+func (c *Compiler) namedSections() []namedSection {
+	list := make([]namedSection, 0, len(c.sections)+2)
+	for _, p := range c.sections {
+		list = append(list, namedSection{p.Name, p.section})
+	}
+	list = append(list, namedSection{".stack", &c.Stack})
+	if c.Shared != nil {
+		list = append([]namedSection{{".shared", &c.SharedData}}, list...)
+	}
+	return list
+}
+
+// sectionName returns the name of a section, empty if it is not one.
+func (c *Compiler) sectionName(s *Section) string {
+	for _, n := range c.namedSections() {
+		if n.section == s {
+			return n.name
+		}
+	}
+	return ""
+}
+
+// SectionInfo returns the placement of every section.
+// Must be called after compiling.
+func (c *Compiler) SectionInfo() []SectionInfo {
+	list := c.namedSections()
+	out := make([]SectionInfo, len(list))
+	for i, n := range list {
+		out[i] = SectionInfo{
+			Name:    n.name,
+			Address: n.section.Offset,
+			Size:    n.section.Size,
+			Bin:     n.section.Bin,
+		}
+	}
+	return out
+}
+
+// Symbols returns every label sorted by address then name.
+// Must be called after compiling.
+func (c *Compiler) Symbols() []Symbol {
+	sizes := c.labelSizes()
+	symbols := make([]Symbol, 0, len(c.Labels))
+	for _, l := range c.Labels {
+		if l.Name == "." {
+			continue
+		}
+		s := Symbol{
+			Name:    sourceName(l.Name),
+			Address: l.Value / 4,
+			Section: c.sectionName(l.section),
+			Global:  l.Global,
+			Binding: l.Binding.String(),
+			Size:    sizes[l.Name],
+		}
+		if l.Binding == BindingLocal {
+			s.File = l.Ref.Filename
+		}
+		symbols = append(symbols, s)
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		if symbols[i].Address != symbols[j].Address {
+			return symbols[i].Address < symbols[j].Address
+		}
+		return symbols[i].Name < symbols[j].Name
+	})
+	return symbols
+}
+
+// Listing returns the disassembly of the program with the labels from the source.
+// Data is shown as .int directives. Must be called after compiling.
+func (c *Compiler) Listing() string {
+	labels := make(map[int][]string)
+	for _, l := range c.Labels {
+		if l.section == nil {
+			continue // generated labels and defines
+		}
+		labels[l.Value/4] = append(labels[l.Value/4], sourceName(l.Name))
+	}
+	for _, names := range labels {
+		sort.Strings(names)
+	}
+
+	s := ""
+	for _, n := range c.namedSections() {
+		seg, ok := c.segmentOf(n.section)
+		if n.section.Size == 0 || !ok {
+			continue // the stack and shared data
+		}
+		info := SectionInfo{Name: n.name, Address: n.section.Offset, Size: n.section.Size, Bin: n.section.Bin}
+		s += info.Name + "\n"
+		bin := info.Bin
+		if len(bin) < info.Size {
+			// .bss has no content
+			bin = make([]byte, info.Size)
+		}
+		code := seg == SegmentText
+		for i := 0; i+4 <= len(bin); i += 4 {
+			addr := (info.Address + i) / 4
+			for _, name := range labels[addr] {
+				s += name + ":\n"
+			}
+			word := binary.LittleEndian.Uint32(bin[i : i+4])
+			if code {
+				d, _ := Decode(word)
+				s += fmt.Sprintf("%04x: %08x  %s\n", addr, word, d.Disassemble(addr))
+			} else {
+				s += fmt.Sprintf("%04x: %08x  .int 0x%08X\n", addr, word, word)
+			}
+		}
+	}
+	return s
+}
+
+// Diagnostics splits an error returned while building into
+// individual diagnostics, with the position of each when known.
+func Diagnostics(err error) []Diagnostic {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		out := make([]Diagnostic, 0)
+		for _, e := range joined.Unwrap() {
+			out = append(out, Diagnostics(e)...)
+		}
+		return out
+	}
+	msg := err.Error()
+	if msg == "" {
+		return nil
+	}
+	d := Diagnostic{
+		Severity: SeverityError,
+		Message:  msg,
+	}
+	if t, ok := errorToken(err); ok {
+		d.Ref = t.Ref
+		d.Message = strings.TrimPrefix(msg, t.Ref.String()+": ")
+	}
+	return []Diagnostic{d}
+}
+
+// errorToken returns the token that caused an error, if known.
+func errorToken(err error) (Token, bool) {
+	switch e := err.(type) {
+	case ExpectedTokenError:
+		return e.got, true
+	case GenericTokenError:
+		return e.token, true
+	case UnknownTokenError:
+		return e.token, true
+	case UnknownIdentifierError:
+		return e.token, true
+	case UnfinishedError:
+		return e.token, true
+	case InstrArgTypeError:
+		return e.Stmnt.Instruction, true
+	case InstrArgCountError:
+		return e.token, true
+	}
+	return Token{}, false
+}
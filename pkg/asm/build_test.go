@@ -0,0 +1,179 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+func TestBuild(t *testing.T) {
+	files := map[string]string{
+		"lib.S": `
+		.data
+	value: .int 0
+		`,
+	}
+	resolver := func(name string) ([]byte, error) {
+		content, ok := files[name]
+		if !ok {
+			return nil, fmt.Errorf("no file %s", name)
+		}
+		return []byte(content), nil
+	}
+	sources := []Source{
+		{Name: "main.S", Content: []byte(`
+			.boot
+		entry:
+			move r0, COUNT
+			halt
+		`)},
+		{Name: "lib.S"},
+		{Name: "func.S", Content: []byte(`
+		func:
+			jump r2
+		`)},
+	}
+	opts := Options{
+		Resolver: resolver,
+		Defines:  map[string]int{"COUNT": 5},
+		Format:   FormatIHex,
+	}
+	res, err := Build(context.Background(), sources, opts)
+	if err != nil {
+		t.Fatalf("Failed to build: %s", err)
+	}
+
+	expect := []Symbol{
+		{Name: "__boot_start", Address: 0, Binding: "default"},
+		{Name: "entry", Address: 0, Section: ".boot", Binding: "default", Size: 8},
+		{Name: "COUNT", Address: 5, Binding: "default"},
+	}
+	for _, e := range expect {
+		found := false
+		for _, s := range res.Symbols {
+			if s == e {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected symbol %+v in %+v", e, res.Symbols)
+		}
+	}
+	for _, s := range res.Symbols {
+		if s.Name == "func" && s.Section != ".text" {
+			t.Errorf("expected func in .text but is in %s", s.Section)
+		}
+		if s.Name == "value" && s.Section != ".data" {
+			t.Errorf("expected value in .data but is in %s", s.Section)
+		}
+	}
+	if !bytes.HasPrefix(res.Output, []byte(":10000000756C7000")) {
+		t.Errorf("expected Intel HEX output got %s", res.Output)
+	}
+	if len(res.Sections) != 6 || res.Sections[1].Name != ".text" || res.Sections[1].Size != 4 {
+		t.Errorf("unexpected sections %+v", res.Sections)
+	}
+	for _, s := range []string{"entry:\n0000: 72800050  move r0, 5", "func:", ".data\nvalue:"} {
+		if !strings.Contains(res.Listing, s) {
+			t.Errorf("expected \"%s\" in listing:\n%s", s, res.Listing)
+		}
+	}
+}
+
+func TestBuildDiagnostics(t *testing.T) {
+	sources := []Source{
+		{Name: "a.S", Content: []byte("move r0, 1\nmove r0\n")},
+	}
+	res, err := Build(context.Background(), sources, Options{})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	found := false
+	for _, d := range res.Diagnostics {
+		if d.Ref.Filename == "a.S" && d.Ref.Line == 2 && d.Severity == SeverityError {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected a diagnostic on a.S line 2 got %v", res.Diagnostics)
+	}
+
+	_, err = Build(context.Background(), sources, Options{Target: "esp32s3"})
+	if err == nil {
+		t.Errorf("expected an error from an unknown target")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Build(ctx, sources, Options{})
+	if err != context.Canceled {
+		t.Errorf("expected %v got %v", context.Canceled, err)
+	}
+	_, err = Build(context.Background(), []Source{{Name: "a.S", Content: []byte("a:\n")}}, Options{Defines: map[string]int{"a": 1}})
+	if err == nil {
+		t.Errorf("expected an error when a define is already a label")
+	}
+}
+
+func TestBuildLoadAddress(t *testing.T) {
+	src := `
+		.boot
+	entry:
+		move r0, value
+		ld r1, r0, 0
+		add r1, r1, 1
+		st r1, r0, 1
+		jump next
+	next:
+		wake
+		.data
+	value: .int 41
+	result: .int 0
+	`
+	const load = 64
+	const reserved = 1024
+	opts := Options{LoadAddress: load, ReservedBytes: reserved}
+	res, err := Build(context.Background(), []Source{{Name: "test.S", Content: []byte(src)}}, opts)
+	if err != nil {
+		t.Fatalf("Failed to build: %s", err)
+	}
+	for _, s := range res.Symbols {
+		if s.Name == "entry" && s.Address != load {
+			t.Errorf("expected entry at %d got %d", load, s.Address)
+		}
+		if s.Name == "__stack_end" && s.Address != reserved/4 {
+			t.Errorf("expected the stack to end at %d got %d", reserved/4, s.Address)
+		}
+	}
+
+	u, err := emu.NewUlpEmu(reserved)
+	if err != nil {
+		t.Fatalf("Failed to create emulator: %s", err)
+	}
+	err = u.LoadBinaryAt(res.Binary, load)
+	if err != nil {
+		t.Fatalf("Failed to load: %s", err)
+	}
+	for i := 0; i < 6; i++ {
+		err = u.Tick()
+		if err != nil {
+			t.Fatalf("Failed to run: %s", err)
+		}
+	}
+	if !u.Wake || u.Memory[load+7]&0xFFFF != 42 {
+		t.Errorf("expected to wake with 42 in result, got %v and %d", u.Wake, u.Memory[load+7]&0xFFFF)
+	}
+	if err = u.LoadBinaryAt(res.Binary, load+1); err == nil {
+		t.Errorf("expected the binary to not fit at a higher address")
+	}
+}
@@ -0,0 +1,29 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import "github.com/Molorius/ulp-c/pkg/emu"
+
+// MemoryChecker returns a checker for the emulator from the placement of
+// the program: the text segment is the code, the bss segment and the stack
+// must be written before they are read and r3 must stay between
+// __stack_start and __stack_end. Must be called after compiling.
+func (c *Compiler) MemoryChecker() *emu.Checker {
+	text := c.segments[SegmentText]
+	bss := c.segments[SegmentBss]
+	stack := emu.Region{
+		Start: c.Labels["__stack_start"].Value / 4,
+		End:   c.Labels["__stack_end"].Value / 4,
+	}
+	return emu.NewChecker(
+		emu.Region{Start: text.start / 4, End: text.end / 4},
+		stack,
+		emu.Region{Start: bss.start / 4, End: bss.end / 4},
+		stack,
+	)
+}
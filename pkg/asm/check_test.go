@@ -0,0 +1,179 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+func TestMemoryChecker(t *testing.T) {
+	tests := []struct {
+		name   string
+		asm    string
+		expect []emu.ViolationKind
+		msg    string // of the first violation
+	}{
+		{
+			name: "clean",
+			asm: `
+			move r3, __stack_end
+			move r1, value
+			ld r0, r1, 0
+			st r0, r1, 1
+			ld r0, r1, 1
+			sub r3, r3, 1
+			st r0, r3, 0
+			ld r0, r3, 0
+			add r3, r3, 1
+			halt
+			.data
+		value: .int 5
+			.bss
+		copy: .int 0
+			`,
+		},
+		{
+			name: "uninitialized bss",
+			asm: `
+			move r1, value
+			ld r0, r1, 0
+			halt
+			.bss
+		value: .int 0
+			`,
+			expect: []emu.ViolationKind{emu.ViolationUninitialized},
+			msg:    "0x0001: load of uninitialized word 0x0003",
+		},
+		{
+			name: "uninitialized stack",
+			asm: `
+			move r3, __stack_end
+			ld r0, r3, -1
+			halt
+			`,
+			expect: []emu.ViolationKind{emu.ViolationUninitialized},
+		},
+		{
+			name: "self modifying",
+			asm: `
+		target:
+			move r1, target
+			st r0, r1, 0
+			halt
+			`,
+			expect: []emu.ViolationKind{emu.ViolationTextWrite},
+			msg:    "0x0001: store into .text at 0x0000",
+		},
+		{
+			name: "stack overflow",
+			asm: `
+			move r3, __stack_start
+			sub r3, r3, 1
+			halt
+			`,
+			expect: []emu.ViolationKind{emu.ViolationStack},
+			msg:    "0x0001: r3 0x0002 is below __stack_start 0x0003",
+		},
+		{
+			name: "stack underflow",
+			asm: `
+			move r3, __stack_end
+			add r3, r3, 1
+			halt
+			`,
+			expect: []emu.ViolationKind{emu.ViolationStack},
+		},
+		{
+			name: "jump into data",
+			asm: `
+			jump value
+			.data
+		value: .int 0xB0000000 // halt
+			`,
+			expect: []emu.ViolationKind{emu.ViolationJump},
+			msg:    "0x0000: jump to 0x0001 outside of .text",
+		},
+		{
+			name: "fall into data",
+			asm: `
+			move r0, 0
+			.data
+			.int 0xB0000000 // halt
+			`,
+			expect: []emu.ViolationKind{emu.ViolationJump},
+			msg:    "0x0000: execution reached 0x0001 outside of .text",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Build(context.Background(), []Source{{Name: "test.S", Content: []byte(tt.asm)}}, Options{ReservedBytes: 1024})
+			if err != nil {
+				t.Fatalf("Failed to build: %s", err)
+			}
+			u, _ := emu.NewUlpEmu(1024)
+			err = u.LoadBinary(res.Binary)
+			if err != nil {
+				t.Fatalf("Failed to load: %s", err)
+			}
+			u.Checker = res.Compiler.MemoryChecker()
+			err = u.RunUntilHalt(1000)
+			if err != nil {
+				t.Fatalf("Failed to run: %s", err)
+			}
+			got := u.Checker.Violations
+			if len(got) != len(tt.expect) {
+				t.Fatalf("Expected %d violations got %v", len(tt.expect), got)
+			}
+			for i, v := range got {
+				if v.Kind != tt.expect[i] {
+					t.Errorf("Expected %s got %s", tt.expect[i], v.Kind)
+				}
+			}
+			if tt.msg != "" && got[0].Error() != tt.msg {
+				t.Errorf("Expected \"%s\" got \"%s\"", tt.msg, got[0].Error())
+			}
+		})
+	}
+}
+
+func TestMemoryCheckerStrict(t *testing.T) {
+	src := "move r1, value\nld r0, r1, 0\nhalt\n.bss\nvalue: .int 0\n"
+	res, err := Build(context.Background(), []Source{{Name: "test.S", Content: []byte(src)}}, Options{ReservedBytes: 1024})
+	if err != nil {
+		t.Fatalf("Failed to build: %s", err)
+	}
+	u, _ := emu.NewUlpEmu(1024)
+	err = u.LoadBinary(res.Binary)
+	if err != nil {
+		t.Fatalf("Failed to load: %s", err)
+	}
+	u.Checker = res.Compiler.MemoryChecker()
+	u.Checker.Strict = true
+	// the host writes the variable before running
+	err = u.Write(u.Checker.Uninitialized[0].Start, []byte{1, 0, 0, 0})
+	if err != nil {
+		t.Fatalf("Failed to write: %s", err)
+	}
+	err = u.RunUntilHalt(1000)
+	if err != nil {
+		t.Fatalf("Expected a write by the host to initialize, got %s", err)
+	}
+
+	u.LoadBinary(res.Binary)
+	u.Checker = res.Compiler.MemoryChecker()
+	u.Checker.Strict = true
+	err = u.RunUntilHalt(1000)
+	v := emu.Violation{}
+	if !errors.As(err, &v) || v.Kind != emu.ViolationUninitialized || u.IP != 1 {
+		t.Errorf("Expected to stop at the load, got %v at 0x%x", err, u.IP)
+	}
+}
@@ -15,12 +15,15 @@ import (
 	"strings"
 
 	"github.com/Molorius/ulp-c/pkg/asm/token"
+	"github.com/Molorius/ulp-c/pkg/emu"
 )
 
 type Label struct {
 	Name    string
 	Value   int
 	Global  bool
+	Binding Binding
+	Ref     FileRef // where the label is defined, empty if generated
 	section *Section
 }
 
@@ -125,6 +128,9 @@ type Compiler struct {
 	program        []Stmnt
 	position       int // position within the program
 	Labels         map[string]*Label
+	LoadAddress    int            // word address the program is loaded at, see ulp_load_binary()
+	Shared         *SharedLayout  // data shared with other programs, the program is placed after it
+	SharedData     Section        // the shared data, not part of the binary
 	preLabels      map[string]int // these contain offsets relative to the section
 	Boot           Section
 	BootData       Section
@@ -132,7 +138,56 @@ type Compiler struct {
 	Data           Section
 	Bss            Section
 	Stack          Section // data not placed here
+	Layout         *Layout // the placement of sections, DefaultLayout() if nil
 	CurrentSection *Section
+	Defines        map[string]int     // constants that can be used like labels
+	Timing         emu.Timing         // the cycle model of --cycles and .timing regions
+	bounds         map[int]*loopBound // word address to the .bound of that instruction
+	timings        []timingRegion
+	placed         map[FileRef]placedStmnt // where each statement was placed
+	bindings       map[string]Binding      // the binding of each label that is not BindingDefault
+	externs        map[string]Token        // the first .extern of each label
+	weakUndefined  map[string]Token        // labels declared .weak that are never defined
+	layout         *Layout                 // the layout in use
+	sections       []placedSection         // every section of the layout in memory order
+	segments       [3]segmentRange         // the placement of each Segment
+}
+
+// placedSection is a section of the layout with the Section holding it.
+type placedSection struct {
+	LayoutSection
+	section *Section
+}
+
+// segmentRange is the byte addresses of a segment, including any
+// padding between its sections.
+type segmentRange struct {
+	start int
+	end   int
+}
+
+// placedStmnt is the address and encoding of a compiled statement.
+type placedStmnt struct {
+	addr  int // byte address
+	bin   []byte
+	instr bool // if it is an instruction rather than data
+}
+
+// loopBound is a .bound directive attached to the instruction after it.
+type loopBound struct {
+	Start int // word address of the instruction
+	End   int // word address after the instruction
+	N     int // maximum number of backwards jumps before falling through
+}
+
+// timingRegion is the code between a .timing directive and its .endtiming.
+type timingRegion struct {
+	Directive Token
+	Section   *Section
+	Start     int // word address of the first instruction
+	End       int // word address after the last instruction
+	Min       int // minimum cycles
+	Max       int // maximum cycles
 }
 
 func (c *Compiler) compile(program []Stmnt, reservedBytes int, reduce bool) error {
@@ -145,14 +200,23 @@ func (c *Compiler) compile(program []Stmnt, reservedBytes int, reduce bool) erro
 	c.Data = Section{}
 	c.Bss = Section{}
 	c.Stack = Section{}
+	c.SharedData = Section{}
 
+	err := c.setupLayout()
+	if err != nil {
+		return err
+	}
+	err = c.link()
+	if err != nil {
+		return err
+	}
 	if reduce {
 		err := c.reduceCommon(0)
 		if err != nil {
 			return err
 		}
 	}
-	err := c.genPreLabels()
+	err = c.genPreLabels()
 	if err != nil {
 		return err
 	}
@@ -160,6 +224,18 @@ func (c *Compiler) compile(program []Stmnt, reservedBytes int, reduce bool) erro
 	if err != nil {
 		return err
 	}
+	err = c.genShared()
+	if err != nil {
+		return err
+	}
+	err = c.genDefines()
+	if err != nil {
+		return err
+	}
+	err = c.genExterns()
+	if err != nil {
+		return err
+	}
 	err = c.genGlobals()
 	if err != nil {
 		return err
@@ -169,6 +245,10 @@ func (c *Compiler) compile(program []Stmnt, reservedBytes int, reduce bool) erro
 		return err
 	}
 	err = c.validateSections()
+	if err != nil {
+		return err
+	}
+	err = c.checkTimings()
 	return err
 }
 
@@ -187,6 +267,11 @@ func (c *Compiler) CompileToAsm(program []Stmnt, reservedBytes int, reduce bool)
 	if err != nil {
 		return nil, err
 	}
+	return c.assembly(), nil
+}
+
+// assembly rebuilds the compiled program as assembly of bytes and labels.
+func (c *Compiler) assembly() []byte {
 	addresses := make(map[int][]*Label)
 	for _, label := range c.Labels {
 		_, ok := addresses[label.Value]
@@ -196,27 +281,14 @@ func (c *Compiler) CompileToAsm(program []Stmnt, reservedBytes int, reduce bool)
 		addresses[label.Value] = append(addresses[label.Value], label)
 	}
 	s := ".text\n"
-	start := 0
-	b := make([]byte, 0)
-	b = append(b, c.Boot.Bin...)
-	b = append(b, c.Text.Bin...)
-	s = c.buildAsm(start, s, b, addresses)
-
-	start += len(b)
+	s = c.buildAsm(c.segments[SegmentText].start, s, c.segmentBin(SegmentText), addresses)
 	s += ".data\n"
-	b = make([]byte, 0)
-	b = append(b, c.BootData.Bin...)
-	b = append(b, c.Data.Bin...)
-	s = c.buildAsm(start, s, b, addresses)
-
-	start += len(b)
+	s = c.buildAsm(c.segments[SegmentData].start, s, c.segmentBin(SegmentData), addresses)
 	s += ".bss\n"
-	b = make([]byte, 0)
-	b = append(b, c.Bss.Bin...)
-	s = c.buildAsm(start, s, b, addresses)
+	s = c.buildAsm(c.segments[SegmentBss].start, s, c.segmentBin(SegmentBss), addresses)
 	s += fmt.Sprintf(".skip %d", c.Stack.Size)
 
-	return []byte(s), nil
+	return []byte(s)
 }
 
 func (c *Compiler) buildAsm(start int, s string, bin []byte, addr map[int][]*Label) string {
@@ -229,6 +301,7 @@ func (c *Compiler) buildAsm(start int, s string, bin []byte, addr map[int][]*Lab
 					continue
 				}
 				fixed := strings.ReplaceAll(l.Name, ".", "_DOT_")
+				fixed = strings.ReplaceAll(fixed, "@", "_AT_") // local labels
 				if l.Global {
 					s += fmt.Sprintf(".global %s\n", fixed)
 				}
@@ -243,23 +316,28 @@ func (c *Compiler) buildAsm(start int, s string, bin []byte, addr map[int][]*Lab
 func (c *Compiler) genPreLabels() error {
 	c.position = 0
 	c.CurrentSection = &c.Text
+	errs := error(nil)
 	for _, stmnt := range c.program {
 		c.CurrentSection.Size += stmnt.Size()
 		switch s := stmnt.(type) {
 		case StmntDirective:
 			c.setSection(s.Directive.TokenType)
+		case StmntSection:
+			errs = errors.Join(errs, c.useSection(s))
 		case StmntLabel:
 			offset := c.CurrentSection.Size
 			name := s.Label.Lexeme
 			c.preLabels[name] = offset
 			l := Label{
 				Name:    name,
+				Binding: c.bindings[name],
+				Ref:     s.Label.Ref,
 				section: c.CurrentSection,
 			}
 			c.Labels[name] = &l
 		}
 	}
-	return nil
+	return errs
 }
 
 func (c *Compiler) FormatSections() string {
@@ -268,19 +346,38 @@ func (c *Compiler) FormatSections() string {
 		stackStr = fmt.Sprintf(" .stack=%d", c.Stack.Size)
 	}
 	total := c.Boot.Size + c.BootData.Size + c.Text.Size + c.Data.Size + c.Bss.Size + c.Stack.Size
-	return fmt.Sprintf(".boot=%d .boot.data=%d .text=%d .data=%d .bss=%d%s total=%d",
-		c.Boot.Size, c.BootData.Size, c.Text.Size, c.Data.Size, c.Bss.Size, stackStr, total)
+	extra := ""
+	for _, p := range c.sections {
+		if !p.isBuiltin() {
+			extra += fmt.Sprintf(" %s=%d", p.Name, p.section.Size)
+			total += p.section.Size
+		}
+	}
+	return fmt.Sprintf(".boot=%d .boot.data=%d .text=%d .data=%d .bss=%d%s%s total=%d",
+		c.Boot.Size, c.BootData.Size, c.Text.Size, c.Data.Size, c.Bss.Size, extra, stackStr, total)
 }
 
 func (c *Compiler) genLabels(reservedBytes int) error {
 	// resolve section offsets
-	c.Boot.Offset = 0
-	c.Text.Offset = c.Boot.Offset + c.Boot.Size
-	c.BootData.Offset = c.Text.Offset + c.Text.Size
-	c.Data.Offset = c.BootData.Offset + c.BootData.Size
-	c.Bss.Offset = c.Data.Offset + c.Data.Size
+	if c.LoadAddress < 0 {
+		return fmt.Errorf("load address %d cannot be negative", c.LoadAddress)
+	}
+	if c.Shared != nil {
+		c.SharedData.Offset = c.Shared.Address * 4
+		c.SharedData.Size = c.Shared.Size
+		if c.LoadAddress == 0 {
+			c.LoadAddress = c.Shared.End()
+		}
+		if c.LoadAddress < c.Shared.End() {
+			return fmt.Errorf("load address %d must be after the shared data ending at word %d", c.LoadAddress, c.Shared.End())
+		}
+	}
+	err := c.placeSections()
+	if err != nil {
+		return err
+	}
 	// data is never placed in stack, calculate remaining memory
-	c.Stack.Offset = c.Bss.Offset + c.Bss.Size
+	c.Stack.Offset = c.segments[SegmentBss].end
 	stackSize := reservedBytes - c.Stack.Offset
 	if stackSize < 0 {
 		return fmt.Errorf("overflowing the %d reserved bytes: %s", reservedBytes, c.FormatSections())
@@ -293,62 +390,37 @@ func (c *Compiler) genLabels(reservedBytes int) error {
 	}
 
 	// generate section labels
-	c.Labels["__boot_start"] = &Label{
-		Name:  "__boot_start",
-		Value: c.Boot.Offset,
-	}
-	c.Labels["__boot_end"] = &Label{
-		Name:  "__boot_end",
-		Value: c.Boot.Offset + c.Boot.Size,
-	}
-	c.Labels["__text_start"] = &Label{
-		Name:  "__text_start",
-		Value: c.Text.Offset,
-	}
-	c.Labels["__text_end"] = &Label{
-		Name:  "__text_end",
-		Value: c.Text.Offset + c.Text.Size,
-	}
-	c.Labels["__boot_data_start"] = &Label{
-		Name:  "__boot_data_start",
-		Value: c.BootData.Offset,
-	}
-	c.Labels["__boot_data_end"] = &Label{
-		Name:  "__boot_data_end",
-		Value: c.BootData.Offset + c.BootData.Size,
-	}
-	c.Labels["__data_start"] = &Label{
-		Name:  "__data_start",
-		Value: c.Data.Offset,
-	}
-	c.Labels["__data_end"] = &Label{
-		Name:  "__data_end",
-		Value: c.Data.Offset + c.Data.Size,
-	}
-	c.Labels["__bss_start"] = &Label{
-		Name:  "__bss_start",
-		Value: c.Bss.Offset,
-	}
-	c.Labels["__bss_end"] = &Label{
-		Name:  "__bss_end",
-		Value: c.Bss.Offset + c.Bss.Size,
-	}
-	c.Labels["__stack_start"] = &Label{
-		Name:  "__stack_start",
-		Value: c.Stack.Offset,
-	}
-	c.Labels["__stack_end"] = &Label{
-		Name:  "__stack_end",
-		Value: c.Stack.Offset + c.Stack.Size,
+	for _, p := range c.sections {
+		c.genSectionLabels(p.Name, p.section)
 	}
+	c.genSectionLabels(".stack", &c.Stack)
 
 	return nil
 }
 
+// genDefines adds each define as a label that is not in any section.
+func (c *Compiler) genDefines() error {
+	errs := error(nil)
+	for name, value := range c.Defines {
+		if _, ok := c.Labels[name]; ok {
+			errs = errors.Join(errs, fmt.Errorf("define \"%s\" is already a label", name))
+			continue
+		}
+		c.Labels[name] = &Label{
+			Name:  name,
+			Value: value * 4, // labels are in bytes
+		}
+	}
+	return errs
+}
+
 func (c *Compiler) genGlobals() error {
 	for _, stmnt := range c.program {
 		switch s := stmnt.(type) {
 		case StmntGlobal:
+			if s.Directive.TokenType != token.Global {
+				continue // handled while linking
+			}
 			name := s.Label.Lexeme
 			label, ok := c.Labels[name]
 			if !ok {
@@ -454,16 +526,22 @@ func (c *Compiler) reduceCommon(depth int) error {
 
 func (c *Compiler) compileAll() error {
 	// create binaries for each section
-	c.Boot.Bin = make([]byte, 0)
-	c.Text.Bin = make([]byte, 0)
-	c.Data.Bin = make([]byte, 0)
-	c.Bss.Bin = make([]byte, 0)
+	for _, p := range c.sections {
+		p.section.Bin = make([]byte, 0)
+	}
 	c.CurrentSection = &c.Text
+	c.bounds = make(map[int]*loopBound)
+	c.timings = make([]timingRegion, 0)
+	c.placed = make(map[FileRef]placedStmnt)
 
+	var bound *StmntBound
+	var timing *timingRegion
 	for _, stmnt := range c.program {
 		switch s := stmnt.(type) {
 		case StmntDirective:
 			c.setSection(s.Directive.TokenType)
+		case StmntSection:
+			c.useSection(s) // unknown sections are found by genPreLabels
 		}
 		hereVal := c.CurrentSection.Offset + len(c.CurrentSection.Bin)
 		here := Label{
@@ -476,38 +554,171 @@ func (c *Compiler) compileAll() error {
 			return err
 		}
 		c.CurrentSection.Bin = append(c.CurrentSection.Bin, bin...)
+		_, instr := stmnt.(StmntInstr)
+		c.placed[stmnt.Pos()] = placedStmnt{hereVal, bin, instr}
+
+		// attach any .bound to the next instruction
+		switch s := stmnt.(type) {
+		case StmntBound:
+			if bound != nil {
+				return GenericTokenError{bound.Directive, "expected an instruction after .bound"}
+			}
+			bound = &s
+		case StmntInstr:
+			if bound != nil {
+				err = c.addBound(*bound, hereVal/4, len(bin)/4)
+				if err != nil {
+					return err
+				}
+				bound = nil
+			}
+		case StmntLabel:
+		default:
+			if bound != nil {
+				return GenericTokenError{bound.Directive, "expected an instruction after .bound"}
+			}
+		}
+
+		// track .timing regions
+		switch s := stmnt.(type) {
+		case StmntTiming:
+			if timing != nil {
+				return GenericTokenError{s.Directive, "cannot nest .timing, previous .timing is not closed"}
+			}
+			timing, err = c.startTiming(s, hereVal/4)
+			if err != nil {
+				return err
+			}
+		case StmntDirective:
+			if s.Directive.TokenType == token.EndTiming {
+				if timing == nil {
+					return GenericTokenError{s.Directive, ".endtiming without a .timing"}
+				}
+				timing.End = hereVal / 4
+				c.timings = append(c.timings, *timing)
+				timing = nil
+			} else if timing != nil {
+				return GenericTokenError{s.Directive, "cannot change section inside a .timing region"}
+			}
+		case StmntSection:
+			if timing != nil {
+				return GenericTokenError{s.Directive, "cannot change section inside a .timing region"}
+			}
+		}
+	}
+	if bound != nil {
+		return GenericTokenError{bound.Directive, "expected an instruction after .bound"}
+	}
+	if timing != nil {
+		return GenericTokenError{timing.Directive, "expected an .endtiming"}
 	}
 
 	return nil
 }
 
-func (c *Compiler) validateSections() error {
-	errs := error(nil)
-	err := c.Boot.Validate(".boot")
+func (c *Compiler) addBound(s StmntBound, addr int, size int) error {
+	n, err := s.Bound.Expr.Evaluate(c.Labels)
 	if err != nil {
-		errs = errors.Join(errs, err)
+		return err
 	}
-	err = c.Text.Validate(".text")
-	if err != nil {
-		errs = errors.Join(errs, err)
+	if n < 0 {
+		return GenericTokenError{s.Directive, fmt.Sprintf("bound of %d cannot be negative", n)}
 	}
-	err = c.BootData.Validate(".boot.data")
-	if err != nil {
-		errs = errors.Join(errs, err)
+	b := &loopBound{
+		Start: addr,
+		End:   addr + size,
+		N:     n,
 	}
-	err = c.Data.Validate(".data")
+	for i := b.Start; i < b.End; i++ {
+		c.bounds[i] = b
+	}
+	return nil
+}
+
+// StatementAt returns the byte address and encoding of the statement
+// that starts at `ref`. Must be called after compiling.
+func (c *Compiler) StatementAt(ref FileRef) (int, []byte, bool) {
+	p, ok := c.placed[ref]
+	return p.addr, p.bin, ok
+}
+
+// SourceMap returns the statement of each word of code by word address,
+// an instruction that assembles to several words maps each of them.
+// Must be called after compiling.
+func (c *Compiler) SourceMap() map[int]FileRef {
+	m := make(map[int]FileRef)
+	for ref, p := range c.placed {
+		if !p.instr {
+			continue
+		}
+		for i := 0; i < len(p.bin)/4; i++ {
+			m[p.addr/4+i] = ref
+		}
+	}
+	return m
+}
+
+func (c *Compiler) startTiming(s StmntTiming, addr int) (*timingRegion, error) {
+	if seg, _ := c.segmentOf(c.CurrentSection); seg != SegmentText {
+		return nil, GenericTokenError{s.Directive, ".timing must be in .boot or .text, or another section in the text segment"}
+	}
+	min, err := s.Min.Expr.Evaluate(c.Labels)
 	if err != nil {
-		errs = errors.Join(errs, err)
+		return nil, err
 	}
-	err = c.Bss.Validate(".bss")
+	max, err := s.Max.Expr.Evaluate(c.Labels)
 	if err != nil {
-		errs = errors.Join(errs, err)
+		return nil, err
+	}
+	if min < 0 || max < min {
+		return nil, GenericTokenError{s.Directive, fmt.Sprintf("invalid cycle range %d to %d", min, max)}
 	}
+	return &timingRegion{
+		Directive: s.Directive,
+		Section:   c.CurrentSection,
+		Start:     addr,
+		Min:       min,
+		Max:       max,
+	}, nil
+}
 
-	for _, b := range c.Bss.Bin {
-		if b != 0 {
-			errs = errors.Join(errs, fmt.Errorf(".bss section contains non-zero data"))
-			break
+// checkTimings verifies every path through each .timing region
+// takes the expected number of cycles.
+func (c *Compiler) checkTimings() error {
+	if len(c.timings) == 0 {
+		return nil
+	}
+	errs := error(nil)
+	a := c.timingAnalyzer()
+	for _, t := range c.timings {
+		r, err := a.path(t.Start, t.End)
+		if err != nil {
+			errs = errors.Join(errs, GenericTokenError{t.Directive, fmt.Sprintf("could not check timing: %s", err)})
+			continue
+		}
+		if r.Best < uint64(t.Min) || r.Worst > uint64(t.Max) {
+			msg := fmt.Sprintf("takes %s but expected %d to %d cycles", r, t.Min, t.Max)
+			errs = errors.Join(errs, GenericTokenError{t.Directive, msg})
+		}
+	}
+	return errs
+}
+
+func (c *Compiler) validateSections() error {
+	errs := error(nil)
+	for _, p := range c.sections {
+		err := p.section.Validate(p.Name)
+		if err != nil {
+			errs = errors.Join(errs, err)
+		}
+		if p.Segment != SegmentBss {
+			continue
+		}
+		for _, b := range p.section.Bin {
+			if b != 0 {
+				errs = errors.Join(errs, fmt.Errorf("%s section contains non-zero data", p.Name))
+				break
+			}
 		}
 	}
 	return errs
@@ -534,11 +745,11 @@ func (c *Compiler) buildBinary() ([]byte, error) {
 	// build header
 	magic := 0x00706c75
 	// the ".text" section starts at 12 within the binary,
-	// the section will be loaded at 0 within ram though
+	// the section will be loaded at LoadAddress within ram though
 	textAddr := 12
-	textSize := c.Boot.Size + c.Text.Size
-	dataSize := c.BootData.Size + c.Data.Size
-	bssSize := c.Bss.Size + c.Stack.Size
+	textSize := c.segmentSize(SegmentText)
+	dataSize := c.segmentSize(SegmentData)
+	bssSize := c.segmentSize(SegmentBss) + c.Stack.Size
 	b = append(b, byteInt(magic)...)
 	b = append(b, byteShort(textAddr)...)
 	b = append(b, byteShort(textSize)...)
@@ -546,10 +757,8 @@ func (c *Compiler) buildBinary() ([]byte, error) {
 	b = append(b, byteShort(bssSize)...)
 
 	// append the rest
-	b = append(b, c.Boot.Bin...)
-	b = append(b, c.Text.Bin...)
-	b = append(b, c.BootData.Bin...)
-	b = append(b, c.Data.Bin...)
+	b = append(b, c.segmentBin(SegmentText)...)
+	b = append(b, c.segmentBin(SegmentData)...)
 	// b = append(b, c.Bss.Bin...)
 	// b = append(b, c.Stack.Bin...) // data not actually placed here
 
@@ -0,0 +1,339 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+// LineCoverage is the coverage of the instruction on a source line.
+type LineCoverage struct {
+	Hits     uint64 // executions of its first word
+	Branch   bool   // if it is a conditional jump
+	Taken    uint64 // jumps to the target
+	NotTaken uint64 // falls through
+}
+
+// lineKey is a source line.
+type lineKey struct {
+	file string
+	line int
+}
+
+// labelKey is a label by name and the line of its first instruction,
+// so that labels with the same name in different files are kept apart.
+type labelKey struct {
+	name  string
+	first lineKey
+}
+
+// LabelCoverage is the total coverage of the instructions of a label,
+// including labels that are part of it such as "func.loop".
+type LabelCoverage struct {
+	Name         string
+	File         string
+	Line         int    // the line of the first instruction
+	Instructions int    // lines with instructions
+	Covered      int    // lines executed at least once
+	Hits         uint64 // executions of the first instruction
+}
+
+// Coverage maps emulator runs back to source lines. Runs of different
+// programs are merged by file name and line, so any program built from
+// the same sources can be added.
+type Coverage struct {
+	Lines   map[string]map[int]*LineCoverage // by file name then line
+	sources map[string][]string              // the lines of each source, for reports
+	labels  map[labelKey]map[lineKey]bool    // the lines of each label
+}
+
+// NewCoverage creates empty coverage.
+func NewCoverage() *Coverage {
+	return &Coverage{
+		Lines:   make(map[string]map[int]*LineCoverage),
+		sources: make(map[string][]string),
+		labels:  make(map[labelKey]map[lineKey]bool),
+	}
+}
+
+func (c *Coverage) line(file string, line int) *LineCoverage {
+	lines, ok := c.Lines[file]
+	if !ok {
+		lines = make(map[int]*LineCoverage)
+		c.Lines[file] = lines
+	}
+	l, ok := lines[line]
+	if !ok {
+		l = &LineCoverage{}
+		lines[line] = l
+	}
+	return l
+}
+
+// Add maps a run of the program built by `comp` to its source lines.
+// Every instruction of the program is added, including those not run.
+func (c *Coverage) Add(comp *Compiler, run *emu.Coverage) {
+	refs := comp.SourceMap()
+	for ref, p := range comp.placed {
+		if !p.instr || len(p.bin) < 4 || ref.Filename == "" {
+			continue // not an instruction, or generated such as the jumps of reduction
+		}
+		addr := p.addr / 4
+		l := c.line(ref.Filename, ref.Line)
+		l.Hits += run.Hits[addr]
+		// the conditional jump of a statement, such as the jump of jumpr with ge
+		for i := 0; i < len(p.bin)/4; i++ {
+			d, err := Decode(binary.LittleEndian.Uint32(p.bin[i*4:]))
+			if err != nil || !d.Conditional() {
+				continue
+			}
+			l.Branch = true
+			if b, ok := run.Branches[addr+i]; ok {
+				l.Taken += b.Taken
+				l.NotTaken += b.NotTaken
+			}
+		}
+	}
+	for _, s := range comp.Symbols() {
+		if s.Section == "" {
+			continue // defines and generated labels
+		}
+		var lines map[lineKey]bool
+		for addr := s.Address; addr < s.Address+s.Size/4; addr++ {
+			ref, ok := refs[addr]
+			if !ok || ref.Filename == "" {
+				continue
+			}
+			line := lineKey{ref.Filename, ref.Line}
+			if lines == nil {
+				key := labelKey{s.Name, line}
+				lines, ok = c.labels[key]
+				if !ok {
+					lines = make(map[lineKey]bool)
+					c.labels[key] = lines
+				}
+			}
+			lines[line] = true
+		}
+	}
+}
+
+// AddSource keeps the content of a source for the HTML report.
+func (c *Coverage) AddSource(name string, content []byte) {
+	c.sources[name] = strings.Split(string(content), "\n")
+}
+
+// Merge adds the coverage of other runs.
+func (c *Coverage) Merge(other *Coverage) {
+	for file, lines := range other.Lines {
+		for n, o := range lines {
+			l := c.line(file, n)
+			l.Hits += o.Hits
+			l.Branch = l.Branch || o.Branch
+			l.Taken += o.Taken
+			l.NotTaken += o.NotTaken
+		}
+	}
+	for name, content := range other.sources {
+		c.sources[name] = content
+	}
+	for key, lines := range other.labels {
+		if _, ok := c.labels[key]; !ok {
+			c.labels[key] = make(map[lineKey]bool)
+		}
+		for k := range lines {
+			c.labels[key][k] = true
+		}
+	}
+}
+
+// Labels returns the coverage of every label with instructions, by name
+// then location. Labels with the same name in different files, such as
+// local labels, are reported separately.
+func (c *Coverage) Labels() []LabelCoverage {
+	out := make([]LabelCoverage, 0, len(c.labels))
+	for key, lines := range c.labels {
+		lc := LabelCoverage{Name: key.name, File: key.first.file, Line: key.first.line, Instructions: len(lines)}
+		lc.Hits = c.line(lc.File, lc.Line).Hits
+		for k := range lines {
+			if c.line(k.file, k.line).Hits > 0 {
+				lc.Covered++
+			}
+		}
+		out = append(out, lc)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		if out[i].File != out[j].File {
+			return out[i].File < out[j].File
+		}
+		return out[i].Line < out[j].Line
+	})
+	return out
+}
+
+// files returns the file names in order.
+func (c *Coverage) files() []string {
+	files := make([]string, 0, len(c.Lines))
+	for f := range c.Lines {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// sortedLines returns the line numbers of a file in order.
+func (c *Coverage) sortedLines(file string) []int {
+	lines := make([]int, 0, len(c.Lines[file]))
+	for n := range c.Lines[file] {
+		lines = append(lines, n)
+	}
+	sort.Ints(lines)
+	return lines
+}
+
+// WriteLcov writes the coverage as an lcov tracefile, which can be merged
+// with other tracefiles and turned into reports by lcov and genhtml.
+func (c *Coverage) WriteLcov(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	labels := c.Labels()
+	for _, file := range c.files() {
+		fmt.Fprintln(out, "TN:")
+		fmt.Fprintf(out, "SF:%s\n", file)
+		found, hit := 0, 0
+		for _, l := range labels {
+			if l.File == file {
+				fmt.Fprintf(out, "FN:%d,%s\n", l.Line, l.Name)
+			}
+		}
+		for _, l := range labels {
+			if l.File == file {
+				fmt.Fprintf(out, "FNDA:%d,%s\n", l.Hits, l.Name)
+				found++
+				if l.Hits > 0 {
+					hit++
+				}
+			}
+		}
+		fmt.Fprintf(out, "FNF:%d\nFNH:%d\n", found, hit)
+		found, hit = 0, 0
+		for _, n := range c.sortedLines(file) {
+			l := c.Lines[file][n]
+			if !l.Branch {
+				continue
+			}
+			taken, notTaken := "-", "-"
+			if l.Hits > 0 {
+				taken, notTaken = fmt.Sprint(l.Taken), fmt.Sprint(l.NotTaken)
+			}
+			fmt.Fprintf(out, "BRDA:%d,0,0,%s\nBRDA:%d,0,1,%s\n", n, taken, n, notTaken)
+			found += 2
+			if l.Taken > 0 {
+				hit++
+			}
+			if l.NotTaken > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(out, "BRF:%d\nBRH:%d\n", found, hit)
+		found, hit = 0, 0
+		for _, n := range c.sortedLines(file) {
+			l := c.Lines[file][n]
+			fmt.Fprintf(out, "DA:%d,%d\n", n, l.Hits)
+			found++
+			if l.Hits > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(out, "LF:%d\nLH:%d\n", found, hit)
+		fmt.Fprintln(out, "end_of_record")
+	}
+	return out.Flush()
+}
+
+// WriteHTML writes a single page report with the totals of each label
+// and each source with its executed, partly executed and missed lines.
+// Sources without content from AddSource() only list their lines.
+func (c *Coverage) WriteHTML(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprint(out, `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>ULP coverage</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td, th { padding: 0 8px; text-align: left; }
+pre { margin: 0; }
+.hit { background: #cfc; }
+.partial { background: #ffc; }
+.miss { background: #fcc; }
+.num { color: #666; text-align: right; }
+</style></head><body>
+<h1>ULP coverage</h1>
+<table>
+<tr><th>label</th><th>location</th><th>lines</th><th>covered</th><th>calls</th></tr>
+`)
+	for _, l := range c.Labels() {
+		class := "hit"
+		if l.Covered == 0 {
+			class = "miss"
+		} else if l.Covered < l.Instructions {
+			class = "partial"
+		}
+		fmt.Fprintf(out, "<tr class=\"%s\"><td>%s</td><td>%s:%d</td><td>%d/%d</td><td>%d%%</td><td>%d</td></tr>\n",
+			class, html.EscapeString(l.Name), html.EscapeString(l.File), l.Line,
+			l.Covered, l.Instructions, l.Covered*100/l.Instructions, l.Hits)
+	}
+	fmt.Fprintln(out, "</table>")
+	for _, file := range c.files() {
+		fmt.Fprintf(out, "<h2>%s</h2>\n<table>\n", html.EscapeString(file))
+		lines := c.Lines[file]
+		source, ok := c.sources[file]
+		numbers := c.sortedLines(file)
+		if ok {
+			numbers = make([]int, len(source))
+			for i := range source {
+				numbers[i] = i + 1
+			}
+		}
+		for _, n := range numbers {
+			text := ""
+			if ok {
+				text = source[n-1]
+			}
+			class, hits, branch := "", "", ""
+			if l, found := lines[n]; found {
+				class = "hit"
+				hits = fmt.Sprint(l.Hits)
+				if l.Hits == 0 {
+					class = "miss"
+				}
+				if l.Branch {
+					branch = fmt.Sprintf("taken %d, not taken %d", l.Taken, l.NotTaken)
+					if l.Hits > 0 && (l.Taken == 0 || l.NotTaken == 0) {
+						class = "partial"
+					}
+				}
+			}
+			fmt.Fprintf(out, "<tr class=\"%s\"><td class=\"num\">%d</td><td class=\"num\">%s</td><td><pre>%s</pre></td><td>%s</td></tr>\n",
+				class, n, hits, html.EscapeString(text), branch)
+		}
+		fmt.Fprintln(out, "</table>")
+	}
+	fmt.Fprintln(out, "</body></html>")
+	return out.Flush()
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+// lib is shared by the programs, each calls clamp with a different value.
+const lib = `	.global clamp
+clamp:
+	jumpr clamp.high, 10, ge
+	jump r2
+clamp.high:
+	move r0, 10
+	jump r2
+	.global unused
+unused:
+	halt
+`
+
+// runCoverage builds a program calling clamp with `value` and adds its coverage.
+func runCoverage(t *testing.T, c *Coverage, name string, value string) {
+	t.Helper()
+	main := "\tmove r0, " + value + "\n\tcall clamp\n\thalt\n"
+	sources := []Source{{Name: name, Content: []byte(main)}, {Name: "lib.S", Content: []byte(lib)}}
+	res, err := Build(context.Background(), sources, Options{ReservedBytes: 1024})
+	if err != nil {
+		t.Fatalf("Failed to build: %s", err)
+	}
+	u, _ := emu.NewUlpEmu(1024)
+	err = u.LoadBinary(res.Binary)
+	if err != nil {
+		t.Fatalf("Failed to load: %s", err)
+	}
+	u.Coverage = emu.NewCoverage()
+	err = u.RunUntilHalt(1000)
+	if err != nil {
+		t.Fatalf("Failed to run: %s", err)
+	}
+	c.Add(res.Compiler, u.Coverage)
+	c.AddSource(name, []byte(main))
+	c.AddSource("lib.S", []byte(lib))
+}
+
+func TestCoverage(t *testing.T) {
+	low := NewCoverage()
+	runCoverage(t, low, "low.S", "3")
+	high := NewCoverage()
+	runCoverage(t, high, "high.S", "12")
+	high.Merge(low)
+
+	tests := []struct {
+		file     string
+		line     int
+		hits     uint64
+		branch   bool
+		taken    uint64
+		notTaken uint64
+	}{
+		{"lib.S", 3, 2, true, 1, 1}, // jumpr
+		{"lib.S", 4, 1, false, 0, 0},
+		{"lib.S", 6, 1, false, 0, 0},
+		{"lib.S", 10, 0, false, 0, 0}, // unused
+		{"low.S", 1, 1, false, 0, 0},
+		{"high.S", 2, 1, false, 0, 0}, // call
+	}
+	for _, tt := range tests {
+		l, ok := high.Lines[tt.file][tt.line]
+		if !ok {
+			t.Errorf("%s:%d not found", tt.file, tt.line)
+			continue
+		}
+		got := LineCoverage{tt.hits, tt.branch, tt.taken, tt.notTaken}
+		if *l != got {
+			t.Errorf("%s:%d expected %+v got %+v", tt.file, tt.line, got, *l)
+		}
+	}
+	if _, ok := high.Lines["lib.S"][2]; ok {
+		t.Errorf("Labels should not be lines with instructions")
+	}
+
+	labels := make(map[string]LabelCoverage)
+	for _, l := range high.Labels() {
+		labels[l.Name] = l
+	}
+	expect := []LabelCoverage{
+		{Name: "clamp", File: "lib.S", Line: 3, Instructions: 4, Covered: 4, Hits: 2},
+		{Name: "clamp.high", File: "lib.S", Line: 6, Instructions: 2, Covered: 2, Hits: 1},
+		{Name: "unused", File: "lib.S", Line: 10, Instructions: 1, Covered: 0, Hits: 0},
+	}
+	for _, e := range expect {
+		if labels[e.Name] != e {
+			t.Errorf("Expected %+v got %+v", e, labels[e.Name])
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	err := high.WriteLcov(buf)
+	if err != nil {
+		t.Fatalf("Failed to write lcov: %s", err)
+	}
+	lcov := buf.String()
+	for _, e := range []string{
+		"TN:\nSF:lib.S\nFN:3,clamp\nFN:6,clamp.high\nFN:10,unused\n",
+		"FNDA:2,clamp\nFNDA:1,clamp.high\nFNDA:0,unused\nFNF:3\nFNH:2\n",
+		"BRDA:3,0,0,1\nBRDA:3,0,1,1\nBRF:2\nBRH:2\n",
+		"DA:3,2\nDA:4,1\nDA:6,1\nDA:7,1\nDA:10,0\nLF:5\nLH:4\nend_of_record\n",
+		"SF:high.S\n",
+		"SF:low.S\n",
+	} {
+		if !strings.Contains(lcov, e) {
+			t.Errorf("Expected lcov to contain %q, got:\n%s", e, lcov)
+		}
+	}
+
+	buf.Reset()
+	err = high.WriteHTML(buf)
+	if err != nil {
+		t.Fatalf("Failed to write html: %s", err)
+	}
+	page := buf.String()
+	for _, e := range []string{
+		"<tr class=\"hit\"><td>clamp</td><td>lib.S:3</td><td>4/4</td><td>100%</td><td>2</td></tr>",
+		"<tr class=\"miss\"><td>unused</td><td>lib.S:10</td><td>0/1</td><td>0%</td><td>0</td></tr>",
+		"<tr class=\"hit\"><td class=\"num\">3</td><td class=\"num\">2</td><td><pre>\tjumpr clamp.high, 10, ge</pre></td><td>taken 1, not taken 1</td></tr>",
+		"<tr class=\"\"><td class=\"num\">2</td><td class=\"num\"></td><td><pre>clamp:</pre></td><td></td></tr>",
+	} {
+		if !strings.Contains(page, e) {
+			t.Errorf("Expected html to contain %q, got:\n%s", e, page)
+		}
+	}
+
+	// a single run does not cover both branches
+	buf.Reset()
+	low.WriteHTML(buf)
+	if !strings.Contains(buf.String(), "<tr class=\"partial\"><td class=\"num\">3</td>") {
+		t.Errorf("Expected the jumpr to be partly covered, got:\n%s", buf.String())
+	}
+}
+
+func TestCoverageSameName(t *testing.T) {
+	sources := []Source{
+		{Name: "a.S", Content: []byte("\t.local helper\n\tjump helper\nhelper:\n\thalt\n")},
+		{Name: "b.S", Content: []byte("helper:\n\thalt\n")},
+	}
+	res, err := Build(context.Background(), sources, Options{ReservedBytes: 1024})
+	if err != nil {
+		t.Fatalf("Failed to build: %s", err)
+	}
+	u, _ := emu.NewUlpEmu(1024)
+	err = u.LoadBinary(res.Binary)
+	if err != nil {
+		t.Fatalf("Failed to load: %s", err)
+	}
+	u.Coverage = emu.NewCoverage()
+	err = u.RunUntilHalt(1000)
+	if err != nil {
+		t.Fatalf("Failed to run: %s", err)
+	}
+	c := NewCoverage()
+	c.Add(res.Compiler, u.Coverage)
+	got := c.Labels()
+	expect := []LabelCoverage{
+		{Name: "helper", File: "a.S", Line: 4, Instructions: 1, Covered: 1, Hits: 1},
+		{Name: "helper", File: "b.S", Line: 2, Instructions: 1, Covered: 0, Hits: 0},
+	}
+	if len(got) != len(expect) {
+		t.Fatalf("Expected %+v got %+v", expect, got)
+	}
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Errorf("Expected %+v got %+v", expect[i], got[i])
+		}
+	}
+}
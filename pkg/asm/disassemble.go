@@ -0,0 +1,275 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/Molorius/ulp-c/pkg/asm/token"
+)
+
+// Decoded is a single machine instruction split into its fields.
+// Only the fields used by the instruction are set.
+type Decoded struct {
+	Word      uint32
+	TokenType token.Type // the instruction, token.Unknown if it could not be decoded
+	Rdst      int        // destination register, or the value register of st/ld
+	Rsrc1     int        // first source register, or the address register of st/ld
+	Rsrc2     int        // second source register
+	Imm       int        // immediate value, jump address, or st/ld offset
+	IsReg     bool       // the last argument is a register rather than an immediate
+	Cond      int        // raw condition bits for jump, jumpr, and jumps
+	Step      int        // signed relative step for jumpr and jumps
+	Threshold int        // threshold for jumpr and jumps
+	High      int        // high bit for reg_rd, reg_wr, i2c_rd, and i2c_wr
+	Low       int        // low bit for reg_rd, reg_wr, i2c_rd, and i2c_wr
+	Data      int        // data for reg_wr and i2c_wr
+	Addr      int        // address for reg_rd and reg_wr, sub address for i2c
+	Sel       int        // i2c_sel for i2c, sar_sel for adc
+	Mux       int        // mux for adc
+}
+
+func decodeRead(word uint32, offset int, size int) int {
+	return int(word>>offset) & ((1 << size) - 1)
+}
+
+func signExtend(val int, bits int) int {
+	if val&(1<<(bits-1)) != 0 {
+		return val - (1 << bits)
+	}
+	return val
+}
+
+// Decode splits a machine instruction into its fields.
+func Decode(word uint32) (Decoded, error) {
+	d := Decoded{
+		Word:      word,
+		TokenType: token.Unknown,
+	}
+	op := decodeRead(word, 28, 4)
+	subOp := decodeRead(word, 25, 3)
+	switch op {
+	case 7:
+		aluSel := decodeRead(word, 21, 4)
+		switch subOp {
+		case 0, 1:
+			types := []token.Type{token.Add, token.Sub, token.And, token.Or, token.Move, token.Lsh, token.Rsh}
+			if aluSel >= len(types) {
+				return d, fmt.Errorf("unknown ALU aluSel %d in 0x%08X", aluSel, word)
+			}
+			d.TokenType = types[aluSel]
+			d.Rdst = decodeRead(word, 0, 2)
+			d.Rsrc1 = decodeRead(word, 2, 2)
+			if subOp == 0 {
+				d.IsReg = true
+				d.Rsrc2 = decodeRead(word, 4, 2)
+			} else {
+				d.Imm = decodeRead(word, 4, 16)
+			}
+		case 2:
+			types := []token.Type{token.StageInc, token.StageDec, token.StageRst}
+			if aluSel >= len(types) {
+				return d, fmt.Errorf("unknown stage count aluSel %d in 0x%08X", aluSel, word)
+			}
+			d.TokenType = types[aluSel]
+			d.Imm = decodeRead(word, 4, 8)
+		default:
+			return d, fmt.Errorf("unknown ALU subOp %d in 0x%08X", subOp, word)
+		}
+	case 6, 13:
+		d.TokenType = token.St
+		if op == 13 {
+			d.TokenType = token.Ld
+		}
+		d.Rdst = decodeRead(word, 0, 2)
+		d.Rsrc1 = decodeRead(word, 2, 2)
+		d.Imm = signExtend(decodeRead(word, 10, 11), 11)
+	case 8:
+		switch subOp {
+		case 0:
+			d.TokenType = token.Jump
+			d.Cond = decodeRead(word, 22, 3)
+			d.IsReg = decodeRead(word, 21, 1) == 1
+			if d.IsReg {
+				d.Rdst = decodeRead(word, 0, 2)
+			} else {
+				d.Imm = decodeRead(word, 2, 11)
+			}
+		case 1:
+			d.TokenType = token.Jumpr
+			d.Threshold = decodeRead(word, 0, 16)
+			d.Cond = decodeRead(word, 16, 1)
+			d.Step = decodeStep(decodeRead(word, 17, 8))
+		case 2:
+			d.TokenType = token.Jumps
+			d.Threshold = decodeRead(word, 0, 8)
+			d.Cond = decodeRead(word, 15, 2)
+			d.Step = decodeStep(decodeRead(word, 17, 8))
+		default:
+			return d, fmt.Errorf("unknown jump subOp %d in 0x%08X", subOp, word)
+		}
+	case 11:
+		d.TokenType = token.Halt
+	case 9:
+		if subOp == 0 {
+			d.TokenType = token.Wake
+		} else {
+			d.TokenType = token.Sleep
+			d.Imm = decodeRead(word, 0, 16)
+		}
+	case 4:
+		d.TokenType = token.Wait
+		d.Imm = decodeRead(word, 0, 16)
+	case 5:
+		d.TokenType = token.Adc
+		d.Rdst = decodeRead(word, 0, 2)
+		d.Mux = decodeRead(word, 2, 4)
+		d.Sel = decodeRead(word, 6, 1)
+	case 3:
+		d.TokenType = token.I2cRd
+		if decodeRead(word, 27, 1) == 1 {
+			d.TokenType = token.I2cWr
+		}
+		d.Addr = decodeRead(word, 0, 8)
+		d.Data = decodeRead(word, 8, 8)
+		d.Low = decodeRead(word, 16, 3)
+		d.High = decodeRead(word, 19, 3)
+		d.Sel = decodeRead(word, 22, 4)
+	case 1, 2:
+		d.TokenType = token.RegWr
+		if op == 2 {
+			d.TokenType = token.RegRd
+		}
+		d.Addr = decodeRead(word, 0, 10)
+		d.Data = decodeRead(word, 10, 8)
+		d.Low = decodeRead(word, 18, 5)
+		d.High = decodeRead(word, 23, 5)
+	default:
+		return d, fmt.Errorf("unknown operation %d in 0x%08X", op, word)
+	}
+	return d, nil
+}
+
+func decodeStep(step int) int {
+	if step&(1<<7) != 0 {
+		return -(step & 0x7F)
+	}
+	return step
+}
+
+// Target returns the word address that a jump, jumpr, or jumps
+// instruction at word address `addr` will go to.
+// Returns false if the target is in a register or this is not a jump.
+func (d Decoded) Target(addr int) (int, bool) {
+	switch d.TokenType {
+	case token.Jump:
+		if d.IsReg {
+			return 0, false
+		}
+		return d.Imm, true
+	case token.Jumpr, token.Jumps:
+		return addr + d.Step, true
+	default:
+		return 0, false
+	}
+}
+
+// Conditional returns true if this is a jump that can fall through.
+func (d Decoded) Conditional() bool {
+	switch d.TokenType {
+	case token.Jump:
+		return d.Cond != 0
+	case token.Jumpr, token.Jumps:
+		return true
+	default:
+		return false
+	}
+}
+
+// Disassemble converts the instruction at word address `addr`
+// back to assembly. Relative jumps are shown with their hard address,
+// the same as the assembler expects.
+func (d Decoded) Disassemble(addr int) string {
+	name := d.TokenType.String()
+	reg := func(r int) string {
+		return fmt.Sprintf("r%d", r)
+	}
+	switch d.TokenType {
+	case token.Add, token.Sub, token.And, token.Or, token.Lsh, token.Rsh:
+		last := fmt.Sprintf("%d", d.Imm)
+		if d.IsReg {
+			last = reg(d.Rsrc2)
+		}
+		return fmt.Sprintf("%s %s, %s, %s", name, reg(d.Rdst), reg(d.Rsrc1), last)
+	case token.Move:
+		last := fmt.Sprintf("%d", d.Imm)
+		if d.IsReg {
+			last = reg(d.Rsrc1)
+		}
+		return fmt.Sprintf("%s %s, %s", name, reg(d.Rdst), last)
+	case token.StageInc, token.StageDec, token.Sleep, token.Wait:
+		return fmt.Sprintf("%s %d", name, d.Imm)
+	case token.StageRst, token.Halt, token.Wake:
+		return name
+	case token.St, token.Ld:
+		return fmt.Sprintf("%s %s, %s, %d", name, reg(d.Rdst), reg(d.Rsrc1), d.Imm)
+	case token.Jump:
+		s := fmt.Sprintf("%s %d", name, d.Imm)
+		if d.IsReg {
+			s = fmt.Sprintf("%s %s", name, reg(d.Rdst))
+		}
+		switch d.Cond {
+		case 1:
+			s += ", eq"
+		case 2:
+			s += ", ov"
+		}
+		return s
+	case token.Jumpr:
+		cond := "lt"
+		if d.Cond == 1 {
+			cond = "ge"
+		}
+		return fmt.Sprintf("%s %d, %d, %s", name, addr+d.Step, d.Threshold, cond)
+	case token.Jumps:
+		cond := "le"
+		switch d.Cond {
+		case 0:
+			cond = "lt"
+		case 1:
+			cond = "ge"
+		}
+		return fmt.Sprintf("%s %d, %d, %s", name, addr+d.Step, d.Threshold, cond)
+	case token.Adc:
+		return fmt.Sprintf("%s %s, %d, %d", name, reg(d.Rdst), d.Sel, d.Mux)
+	case token.I2cRd:
+		return fmt.Sprintf("%s %d, %d, %d, %d", name, d.Addr, d.High, d.Low, d.Sel)
+	case token.I2cWr:
+		return fmt.Sprintf("%s %d, %d, %d, %d, %d", name, d.Addr, d.Data, d.High, d.Low, d.Sel)
+	case token.RegRd:
+		return fmt.Sprintf("%s %d, %d, %d", name, d.Addr, d.High, d.Low)
+	case token.RegWr:
+		return fmt.Sprintf("%s %d, %d, %d, %d", name, d.Addr, d.High, d.Low, d.Data)
+	default:
+		return fmt.Sprintf(".int 0x%08X", d.Word)
+	}
+}
+
+// DisassembleListing disassembles every word of `code`, one line per
+// instruction, where `start` is the word address of the first word.
+func DisassembleListing(code []byte, start int) string {
+	s := ""
+	for i := 0; i+4 <= len(code); i += 4 {
+		word := binary.LittleEndian.Uint32(code[i : i+4])
+		addr := start + i/4
+		d, _ := Decode(word)
+		s += fmt.Sprintf("%04x: %08x  %s\n", addr, word, d.Disassemble(addr))
+	}
+	return s
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/Molorius/ulp-c/pkg/asm/token"
+)
+
+type flowKind int
+
+const (
+	flowNext         flowKind = iota // continue to the next instruction
+	flowBranch                       // either go to the target or the next instruction
+	flowJump                         // always go to the target
+	flowCall                         // call the target, then continue at the return address
+	flowReturn                       // "jump r2", return to the caller
+	flowHalt                         // end of execution
+	flowIndirect                     // jump to a register that cannot be followed
+	flowIndirectCall                 // call a register that cannot be followed
+)
+
+type flow struct {
+	Kind   flowKind
+	Target int // word address of the target
+	Return int // word address that a call returns to
+}
+
+// flowGraph is the compiled code of a Compiler, used for static analysis.
+type flowGraph struct {
+	c      *Compiler
+	start  int // word address of the first instruction
+	end    int // word address after the last instruction
+	code   []Decoded
+	labels map[int][]string // word address to label names
+}
+
+func (c *Compiler) flowGraph() *flowGraph {
+	g := &flowGraph{
+		c:      c,
+		start:  c.segments[SegmentText].start / 4,
+		labels: make(map[int][]string),
+	}
+	b := c.segmentBin(SegmentText)
+	g.end = g.start + len(b)/4
+	g.code = make([]Decoded, len(b)/4)
+	for i := range g.code {
+		// data in the .text section is allowed, only fail if it is executed
+		g.code[i], _ = Decode(binary.LittleEndian.Uint32(b[i*4:]))
+	}
+	for name, label := range c.Labels {
+		if name == "." || label.section == nil {
+			continue
+		}
+		addr := label.Value / 4
+		g.labels[addr] = append(g.labels[addr], sourceName(name))
+	}
+	if !g.isLabel(g.start) {
+		g.labels[g.start] = []string{"__boot_start"}
+	}
+	for _, names := range g.labels {
+		sort.Strings(names)
+	}
+	return g
+}
+
+// instr returns the instruction at word address `addr`.
+func (g *flowGraph) instr(addr int) (Decoded, error) {
+	if addr < g.start || addr >= g.end {
+		return Decoded{}, fmt.Errorf("%s is outside of the executable sections", g.describe(addr))
+	}
+	d := g.code[addr-g.start]
+	if d.TokenType == token.Unknown {
+		return d, fmt.Errorf("%s is not a valid instruction: 0x%08X", g.describe(addr), d.Word)
+	}
+	return d, nil
+}
+
+// describe converts a word address to a name based on the nearest label.
+func (g *flowGraph) describe(addr int) string {
+	best := -1
+	for a := range g.labels {
+		if a <= addr && a > best && a < g.end {
+			best = a
+		}
+	}
+	if best < 0 {
+		return fmt.Sprintf("address %d", addr)
+	}
+	name := g.labels[best][0]
+	if best == addr {
+		return name
+	}
+	return fmt.Sprintf("%s+%d", name, addr-best)
+}
+
+// isLabel returns true if a label points at the word address.
+func (g *flowGraph) isLabel(addr int) bool {
+	_, ok := g.labels[addr]
+	return ok
+}
+
+// flow finds what happens after the instruction at word address `addr`.
+func (g *flowGraph) flow(addr int) (flow, error) {
+	d, err := g.instr(addr)
+	if err != nil {
+		return flow{}, err
+	}
+	switch d.TokenType {
+	case token.Halt:
+		return flow{Kind: flowHalt}, nil
+	case token.Jump, token.Jumpr, token.Jumps:
+	default:
+		return flow{Kind: flowNext}, nil
+	}
+	target, direct := d.Target(addr)
+	if d.Conditional() {
+		if !direct {
+			return flow{Kind: flowIndirect}, nil
+		}
+		return flow{Kind: flowBranch, Target: target}, nil
+	}
+	ret, isCall := g.returnAddress(addr)
+	if !direct {
+		if d.Rdst == 2 {
+			return flow{Kind: flowReturn}, nil
+		}
+		if isCall {
+			return flow{Kind: flowIndirectCall, Return: ret}, nil
+		}
+		return flow{Kind: flowIndirect}, nil
+	}
+	if isCall {
+		return flow{Kind: flowCall, Target: target, Return: ret}, nil
+	}
+	return flow{Kind: flowJump, Target: target}, nil
+}
+
+// returnAddress checks if the jump at word address `addr` is a call,
+// which is a "move r2, return" followed by the jump. The return address
+// must be the next instruction or a label in the code, otherwise r2 is
+// assumed to hold a value rather than an address, such as a pointer
+// to data.
+func (g *flowGraph) returnAddress(addr int) (int, bool) {
+	if addr-1 < g.start {
+		return 0, false
+	}
+	prev := g.code[addr-1-g.start]
+	if prev.TokenType != token.Move || prev.IsReg || prev.Rdst != 2 {
+		return 0, false
+	}
+	ret := prev.Imm
+	if ret == addr+1 || (g.isLabel(ret) && ret >= g.start && ret < g.end) {
+		return ret, true
+	}
+	return 0, false
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"fmt"
+	"go/format"
+	"strings"
+
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+// Format is an output format for a built binary.
+type Format string
+
+const (
+	FormatBin      Format = "bin"      // the binary with its header, as loaded by ulp_load_binary()
+	FormatIHex     Format = "ihex"     // Intel HEX of the binary
+	FormatCArray   Format = "c-array"  // C source with the binary as an array
+	FormatGo       Format = "go"       // Go source with the binary as a []byte
+	FormatSections Format = "sections" // the .text and .data sections without a header
+)
+
+var formats = []Format{FormatBin, FormatIHex, FormatCArray, FormatGo, FormatSections}
+
+// ParseFormat converts a string to a Format.
+func ParseFormat(s string) (Format, error) {
+	for _, f := range formats {
+		if string(f) == s {
+			return f, nil
+		}
+	}
+	names := make([]string, len(formats))
+	for i, f := range formats {
+		names[i] = string(f)
+	}
+	return "", fmt.Errorf("unknown format \"%s\", expected one of %s", s, strings.Join(names, ", "))
+}
+
+// Encode converts a binary to a format that is a single file. The `name`
+// and `pkg` are used by FormatCArray and FormatGo, see EncodeCArray and EncodeGo.
+// FormatSections is two files, use SplitSections instead.
+func Encode(bin []byte, f Format, name string, pkg string) ([]byte, error) {
+	switch f {
+	case FormatBin, "":
+		return bin, nil
+	case FormatIHex:
+		return EncodeIHex(bin)
+	case FormatCArray:
+		return EncodeCArray(bin, name), nil
+	case FormatGo:
+		return EncodeGo(bin, pkg, name)
+	case FormatSections:
+		return nil, fmt.Errorf("format %s has more than one output, use SplitSections", f)
+	}
+	return nil, fmt.Errorf("unknown format \"%s\"", f)
+}
+
+// EncodeIHex converts a binary to Intel HEX, starting at address 0.
+func EncodeIHex(bin []byte) ([]byte, error) {
+	if len(bin) > 0x10000 {
+		return nil, fmt.Errorf("binary is %d bytes, too large for Intel HEX without extended addresses", len(bin))
+	}
+	s := ""
+	for addr := 0; addr < len(bin); addr += 16 {
+		record := bin[addr:min(addr+16, len(bin))]
+		s += ihexRecord(addr, 0x00, record)
+	}
+	s += ihexRecord(0, 0x01, nil) // end of file
+	return []byte(s), nil
+}
+
+func ihexRecord(addr int, recordType byte, data []byte) string {
+	b := []byte{byte(len(data)), byte(addr >> 8), byte(addr), recordType}
+	b = append(b, data...)
+	sum := byte(0)
+	for _, v := range b {
+		sum += v
+	}
+	b = append(b, -sum)
+	return fmt.Sprintf(":%X\n", b)
+}
+
+// EncodeCArray converts a binary to C source, as the array `name`
+// and its length `name`_len. If `name` is empty then "ulp_bin" is used.
+func EncodeCArray(bin []byte, name string) []byte {
+	if name == "" {
+		name = "ulp_bin"
+	}
+	s := "// Code generated by ulp-c. DO NOT EDIT.\n\n"
+	s += "#include <stddef.h>\n#include <stdint.h>\n\n"
+	s += fmt.Sprintf("const uint8_t %s[] = {\n", name)
+	s += byteLines(bin, "    ")
+	s += "};\n"
+	s += fmt.Sprintf("const size_t %s_len = sizeof(%s);\n", name, name)
+	return []byte(s)
+}
+
+// EncodeGo converts a binary to Go source in package `pkg`,
+// as the variable `name`. If either are empty then "main" and "ulpBin" are used.
+func EncodeGo(bin []byte, pkg string, name string) ([]byte, error) {
+	if pkg == "" {
+		pkg = "main"
+	}
+	if name == "" {
+		name = "ulpBin"
+	}
+	s := "// Code generated by ulp-c. DO NOT EDIT.\n\n"
+	s += fmt.Sprintf("package %s\n\n", pkg)
+	s += fmt.Sprintf("var %s = []byte{\n", name)
+	s += byteLines(bin, "\t")
+	s += "}\n"
+	out, err := format.Source([]byte(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Go package or variable name: %w", err)
+	}
+	return out, nil
+}
+
+// byteLines formats bytes as comma separated hex, 12 per line.
+func byteLines(bin []byte, indent string) string {
+	s := ""
+	for i := 0; i < len(bin); i += 12 {
+		line := make([]string, 0, 12)
+		for _, b := range bin[i:min(i+12, len(bin))] {
+			line = append(line, fmt.Sprintf("0x%02x,", b))
+		}
+		s += indent + strings.Join(line, " ") + "\n"
+	}
+	return s
+}
+
+// SplitSections splits a binary into its .text and .data sections.
+func SplitSections(bin []byte) ([]byte, []byte, error) {
+	h, err := emu.ParseHeader(bin)
+	if err != nil {
+		return nil, nil, err
+	}
+	textEnd := h.TextOffset + h.TextSize
+	dataEnd := textEnd + h.DataSize
+	if dataEnd > len(bin) {
+		return nil, nil, fmt.Errorf("binary is %d bytes but the header expects %d", len(bin), dataEnd)
+	}
+	return bin[h.TextOffset:textEnd], bin[textEnd:dataEnd], nil
+}
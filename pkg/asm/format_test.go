@@ -0,0 +1,87 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	asm := `
+	.text
+	halt
+	.data
+	.int 0x1234
+	`
+	a := Assembler{}
+	bin, err := a.BuildFile(asm, "test.S", 8176, false)
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	t.Run("parse", func(t *testing.T) {
+		f, err := ParseFormat("c-array")
+		if err != nil || f != FormatCArray {
+			t.Errorf("expected %s got %s %v", FormatCArray, f, err)
+		}
+		_, err = ParseFormat("elf")
+		if err == nil {
+			t.Errorf("expected an error from an unknown format")
+		}
+	})
+	t.Run("ihex", func(t *testing.T) {
+		got, err := EncodeIHex(bin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := ":10000000756C70000C0004000400E81F000000B0D4\n" +
+			":0400100034120000A6\n" +
+			":00000001FF\n"
+		if string(got) != expect {
+			t.Errorf("expected\n%s got\n%s", expect, got)
+		}
+	})
+	t.Run("c-array", func(t *testing.T) {
+		got := string(EncodeCArray(bin, "prog"))
+		for _, s := range []string{"const uint8_t prog[] = {", "0x75, 0x6c, 0x70, 0x00,", "const size_t prog_len = sizeof(prog);"} {
+			if !strings.Contains(got, s) {
+				t.Errorf("expected \"%s\" in\n%s", s, got)
+			}
+		}
+	})
+	t.Run("go", func(t *testing.T) {
+		got, err := EncodeGo(bin, "ulp", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []string{"package ulp", "var ulpBin = []byte{", "\t0x75, 0x6c, 0x70, 0x00,"} {
+			if !strings.Contains(string(got), s) {
+				t.Errorf("expected \"%s\" in\n%s", s, got)
+			}
+		}
+		_, err = EncodeGo(bin, "ulp", "bad-name")
+		if err == nil {
+			t.Errorf("expected an error from an invalid name")
+		}
+	})
+	t.Run("sections", func(t *testing.T) {
+		text, data, err := SplitSections(bin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(text, bin[12:16]) || !bytes.Equal(data, bin[16:20]) {
+			t.Errorf("unexpected sections %v %v", text, data)
+		}
+		_, _, err = SplitSections(bin[:14])
+		if err == nil {
+			t.Errorf("expected an error from a truncated binary")
+		}
+	})
+}
@@ -16,7 +16,13 @@ import (
 
 // statements
 
+// Node is any statement, argument, or expression.
+type Node interface {
+	Pos() FileRef // the position of the start of this node
+}
+
 type Stmnt interface {
+	Node
 	Size() int // the size of this statement after compilation, in bytes
 	Compile(map[string]*Label) ([]byte, error)
 	CanReduce() bool     // can this statement be reduced?
@@ -43,8 +49,15 @@ func (s StmntDirective) IsFinalReduce() bool {
 	return false
 }
 
+func (s StmntDirective) Pos() FileRef {
+	return s.Directive.Ref
+}
+
+// StmntGlobal sets the binding of a label with a .global, .local,
+// .weak or .extern directive, see Directive.TokenType.
 type StmntGlobal struct {
-	Label Token
+	Directive Token
+	Label     Token
 }
 
 func (s StmntGlobal) Size() int {
@@ -56,7 +69,7 @@ func (s StmntGlobal) Compile(labels map[string]*Label) ([]byte, error) {
 }
 
 func (s StmntGlobal) String() string {
-	return fmt.Sprintf(".global(%s)", s.Label)
+	return fmt.Sprintf("%s(%s)", s.Directive.TokenType, s.Label)
 }
 
 func (s StmntGlobal) CanReduce() bool {
@@ -67,8 +80,44 @@ func (s StmntGlobal) IsFinalReduce() bool {
 	return false
 }
 
+func (s StmntGlobal) Pos() FileRef {
+	return s.Directive.Ref
+}
+
+// StmntSection switches to a section by name with .section, either one
+// of the sections such as .text or one described by the Layout.
+type StmntSection struct {
+	Directive Token
+	Name      Token
+}
+
+func (s StmntSection) Size() int {
+	return 0
+}
+
+func (s StmntSection) Compile(labels map[string]*Label) ([]byte, error) {
+	return nil, nil
+}
+
+func (s StmntSection) String() string {
+	return fmt.Sprintf("%s(%s)", s.Directive.TokenType, s.Name.Lexeme)
+}
+
+func (s StmntSection) CanReduce() bool {
+	return false
+}
+
+func (s StmntSection) IsFinalReduce() bool {
+	return false
+}
+
+func (s StmntSection) Pos() FileRef {
+	return s.Directive.Ref
+}
+
 type StmntInt struct {
-	Args []ArgExpr
+	Directive Token
+	Args      []ArgExpr
 }
 
 func (s StmntInt) Size() int {
@@ -101,6 +150,73 @@ func (s StmntInt) IsFinalReduce() bool {
 	return false
 }
 
+func (s StmntInt) Pos() FileRef {
+	return s.Directive.Ref
+}
+
+// StmntBound limits how many times the next instruction can jump
+// backwards before falling through, for timing analysis.
+type StmntBound struct {
+	Directive Token
+	Bound     ArgExpr
+}
+
+func (s StmntBound) Size() int {
+	return 0
+}
+
+func (s StmntBound) Compile(labels map[string]*Label) ([]byte, error) {
+	return nil, nil
+}
+
+func (s StmntBound) String() string {
+	return fmt.Sprintf(".bound(%s)", s.Bound.Expr)
+}
+
+func (s StmntBound) CanReduce() bool {
+	return false
+}
+
+func (s StmntBound) IsFinalReduce() bool {
+	return false
+}
+
+func (s StmntBound) Pos() FileRef {
+	return s.Directive.Ref
+}
+
+// StmntTiming starts a region that must take between Min and Max
+// cycles on every path to the next .endtiming.
+type StmntTiming struct {
+	Directive Token
+	Min       ArgExpr
+	Max       ArgExpr
+}
+
+func (s StmntTiming) Size() int {
+	return 0
+}
+
+func (s StmntTiming) Compile(labels map[string]*Label) ([]byte, error) {
+	return nil, nil
+}
+
+func (s StmntTiming) String() string {
+	return fmt.Sprintf(".timing(%s, %s)", s.Min.Expr, s.Max.Expr)
+}
+
+func (s StmntTiming) CanReduce() bool {
+	return false
+}
+
+func (s StmntTiming) IsFinalReduce() bool {
+	return false
+}
+
+func (s StmntTiming) Pos() FileRef {
+	return s.Directive.Ref
+}
+
 type StmntInstr struct {
 	Instruction Token
 	Args        []Arg
@@ -151,6 +267,10 @@ func (s StmntInstr) IsFinalReduce() bool {
 	return false
 }
 
+func (s StmntInstr) Pos() FileRef {
+	return s.Instruction.Ref
+}
+
 func (s StmntInstr) Size() int {
 	switch s.Instruction.TokenType {
 	case token.Jumpr, token.Jumps:
@@ -191,9 +311,14 @@ func (s StmntLabel) IsFinalReduce() bool {
 	return false
 }
 
+func (s StmntLabel) Pos() FileRef {
+	return s.Label.Ref
+}
+
 // expressions
 
 type Expr interface {
+	Node
 	Evaluate(map[string]*Label) (int, error)
 	IsRelative() bool
 }
@@ -243,6 +368,10 @@ func (exp ExprBinary) IsRelative() bool {
 	return exp.Left.IsRelative() || exp.Right.IsRelative()
 }
 
+func (exp ExprBinary) Pos() FileRef {
+	return exp.Left.Pos()
+}
+
 type ExprUnary struct {
 	Expression Expr
 	Operator   Token
@@ -269,6 +398,10 @@ func (exp ExprUnary) IsRelative() bool {
 	return exp.Expression.IsRelative()
 }
 
+func (exp ExprUnary) Pos() FileRef {
+	return exp.Operator.Ref
+}
+
 type ExprLiteral struct {
 	Operator Token
 }
@@ -301,9 +434,14 @@ func (exp ExprLiteral) IsRelative() bool {
 	return exp.Operator.TokenType == token.Here
 }
 
+func (exp ExprLiteral) Pos() FileRef {
+	return exp.Operator.Ref
+}
+
 // arguments
 
 type Arg interface {
+	Node
 	IsReg() bool
 	IsJump() bool
 	IsExpr() bool
@@ -330,6 +468,10 @@ func (a ArgReg) IsRelative() bool {
 	return false
 }
 
+func (a ArgReg) Pos() FileRef {
+	return a.Reg.Ref
+}
+
 func (a ArgReg) ToExpr() ArgExpr {
 	i, _ := a.Evaluate()
 	t := a.Reg
@@ -373,6 +515,10 @@ func (a ArgJump) IsRelative() bool {
 	return false // we can fallthrough and still continue
 }
 
+func (a ArgJump) Pos() FileRef {
+	return a.Arg.Ref
+}
+
 type ArgExpr struct {
 	Expr Expr
 }
@@ -392,3 +538,7 @@ func (a ArgExpr) IsExpr() bool {
 func (a ArgExpr) IsRelative() bool {
 	return a.Expr.IsRelative()
 }
+
+func (a ArgExpr) Pos() FileRef {
+	return a.Expr.Pos()
+}
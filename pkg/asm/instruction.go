@@ -37,6 +37,49 @@ func validateIns(s StmntInstr, v []validateInsHelperStruct) error {
 	return errs
 }
 
+// InstructionParams returns the name of the parameter form of an
+// instruction in the grammar, such as "param0", and the name of each
+// parameter. Returns false if `t` is not an instruction.
+func InstructionParams(t token.Type) (string, []string, bool) {
+	switch t {
+	case token.Add, token.Sub, token.And, token.Or, token.Lsh, token.Rsh:
+		return "param0", []string{"rdst", "rsrc1", "rsrc2 | imm"}, true
+	case token.Move:
+		return "param1", []string{"rdst", "rsrc | imm"}, true
+	case token.St:
+		return "param2", []string{"rsrc", "raddr", "offset"}, true
+	case token.Ld:
+		return "param2", []string{"rdst", "raddr", "offset"}, true
+	case token.Jump:
+		return "param3", []string{"raddr | addr", "eq | ov"}, true
+	case token.Jumpr:
+		return "param4", []string{"addr", "threshold", "lt | le | gt | ge"}, true
+	case token.Jumps:
+		return "param5", []string{"addr", "threshold", "lt | le | gt | ge"}, true
+	case token.StageInc, token.StageDec:
+		return "param6", []string{"value"}, true
+	case token.Sleep:
+		return "param6", []string{"sleep_reg"}, true
+	case token.Wait:
+		return "param6", []string{"cycles"}, true
+	case token.Adc:
+		return "param7", []string{"rdst", "sar_sel", "mux"}, true
+	case token.I2cRd:
+		return "param8", []string{"sub_addr", "high", "low", "slave_sel"}, true
+	case token.RegWr:
+		return "param8", []string{"addr", "high", "low", "data"}, true
+	case token.I2cWr:
+		return "param9", []string{"sub_addr", "value", "high", "low", "slave_sel"}, true
+	case token.RegRd:
+		return "param10", []string{"addr", "high", "low"}, true
+	case token.Call:
+		return "param11", []string{"raddr | addr"}, true
+	case token.StageRst, token.Halt, token.Wake:
+		return "", []string{}, true
+	}
+	return "", nil, false
+}
+
 func (s *StmntInstr) validate() error {
 	switch s.Instruction.TokenType {
 	case token.Add, token.Sub, token.And, token.Or, token.Lsh, token.Rsh:
@@ -0,0 +1,449 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Molorius/ulp-c/pkg/asm/token"
+)
+
+// Segment is the part of the binary header a section is counted in.
+// The segments are loaded in order, so sections must be as well.
+type Segment int
+
+const (
+	SegmentText Segment = iota // code and constants, .header.text
+	SegmentData                // initialized data, .header.data
+	SegmentBss                 // zeroed data, .header.bss
+)
+
+func (s Segment) String() string {
+	switch s {
+	case SegmentText:
+		return "text"
+	case SegmentData:
+		return "data"
+	case SegmentBss:
+		return "bss"
+	default:
+		return "unknown"
+	}
+}
+
+// Region is a named range of RTC slow memory that sections are placed in.
+type Region struct {
+	Name  string
+	Start int // word address
+	Size  int // size in words
+}
+
+// LayoutSection is the placement of a single section.
+type LayoutSection struct {
+	Name    string
+	Segment Segment
+	Fixed   bool    // if the section starts at Address
+	Address int     // word address, only used if Fixed
+	Align   int     // word alignment of the start, 1 if 0
+	Region  string  // the region it must fit in, empty for any
+	Ref     FileRef // where it is described, empty for the default layout
+}
+
+// Layout describes the sections of a program in memory order,
+// followed by the stack.
+type Layout struct {
+	Regions  []Region
+	Sections []LayoutSection
+}
+
+// builtinSections are the sections with their own directive,
+// which every layout must place.
+var builtinSections = []LayoutSection{
+	{Name: ".boot", Segment: SegmentText},
+	{Name: ".text", Segment: SegmentText},
+	{Name: ".boot.data", Segment: SegmentData},
+	{Name: ".data", Segment: SegmentData},
+	{Name: ".bss", Segment: SegmentBss},
+}
+
+// DefaultLayout returns the layout used when none is given.
+func DefaultLayout() *Layout {
+	l := &Layout{
+		Regions:  make([]Region, 0),
+		Sections: make([]LayoutSection, len(builtinSections)),
+	}
+	copy(l.Sections, builtinSections)
+	return l
+}
+
+// ParseLayout parses a layout description, one entry per line:
+//
+//	region name start size
+//	section name text|data|bss [at address] [align n] [in region]
+//
+// Addresses, sizes and alignment are in words. Sections are listed in
+// memory order. Comments start with "#" or "//".
+func ParseLayout(src string, name string) (*Layout, error) {
+	l := &Layout{
+		Regions:  make([]Region, 0),
+		Sections: make([]LayoutSection, 0),
+	}
+	errs := error(nil)
+	for i, line := range strings.Split(src, "\n") {
+		fields := layoutFields(line, FileRef{Filename: name, Line: i + 1})
+		if len(fields) == 0 {
+			continue
+		}
+		var err error
+		switch fields[0].Lexeme {
+		case "region":
+			err = l.parseRegion(fields)
+		case "section":
+			err = l.parseSection(fields)
+		default:
+			err = GenericTokenError{fields[0], "expected \"region\" or \"section\""}
+		}
+		errs = errors.Join(errs, err)
+	}
+	if errs != nil {
+		return nil, errs
+	}
+	err := l.validate()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// layoutFields splits a line into words, ignoring comments.
+func layoutFields(line string, ref FileRef) []Token {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	if i := strings.Index(line, "//"); i >= 0 {
+		line = line[:i]
+	}
+	fields := make([]Token, 0)
+	start := -1
+	for i := 0; i <= len(line); i++ {
+		space := i == len(line) || line[i] == ' ' || line[i] == '\t' || line[i] == '\r'
+		if !space && start < 0 {
+			start = i
+		} else if space && start >= 0 {
+			ref.Index = start + 1
+			fields = append(fields, Token{Lexeme: line[start:i], Ref: ref})
+			start = -1
+		}
+	}
+	return fields
+}
+
+func layoutNumber(t Token) (int, error) {
+	n, err := strconv.ParseInt(t.Lexeme, 0, 64)
+	if err != nil || n < 0 {
+		return 0, GenericTokenError{t, "expected a positive number"}
+	}
+	return int(n), nil
+}
+
+func (l *Layout) parseRegion(fields []Token) error {
+	if len(fields) != 4 {
+		return GenericTokenError{fields[0], "expected \"region name start size\""}
+	}
+	start, err := layoutNumber(fields[2])
+	if err != nil {
+		return err
+	}
+	size, err := layoutNumber(fields[3])
+	if err != nil {
+		return err
+	}
+	for _, r := range l.Regions {
+		if r.Name == fields[1].Lexeme {
+			return GenericTokenError{fields[1], "region is already defined"}
+		}
+	}
+	l.Regions = append(l.Regions, Region{Name: fields[1].Lexeme, Start: start, Size: size})
+	return nil
+}
+
+func (l *Layout) parseSection(fields []Token) error {
+	if len(fields) < 3 {
+		return GenericTokenError{fields[0], "expected \"section name text|data|bss\""}
+	}
+	s := LayoutSection{Name: fields[1].Lexeme, Align: 1, Ref: fields[1].Ref}
+	if !validSectionName(s.Name) {
+		return GenericTokenError{fields[1], "expected a section name"}
+	}
+	switch fields[2].Lexeme {
+	case "text":
+		s.Segment = SegmentText
+	case "data":
+		s.Segment = SegmentData
+	case "bss":
+		s.Segment = SegmentBss
+	default:
+		return GenericTokenError{fields[2], "expected \"text\", \"data\" or \"bss\""}
+	}
+	for i := 3; i < len(fields); i += 2 {
+		option := fields[i]
+		if i+1 >= len(fields) {
+			return GenericTokenError{option, "expected a value"}
+		}
+		value := fields[i+1]
+		var err error
+		switch option.Lexeme {
+		case "at":
+			s.Fixed = true
+			s.Address, err = layoutNumber(value)
+		case "align":
+			s.Align, err = layoutNumber(value)
+			if err == nil && s.Align == 0 {
+				err = GenericTokenError{value, "alignment must be at least 1"}
+			}
+		case "in":
+			s.Region = value.Lexeme
+		default:
+			err = GenericTokenError{option, "expected \"at\", \"align\" or \"in\""}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if sectionLabel(s.Name, "") == sectionLabel(".stack", "") {
+		return GenericTokenError{fields[1], "the stack is always placed after every section"}
+	}
+	for _, other := range l.Sections {
+		if sectionLabel(other.Name, "") == sectionLabel(s.Name, "") {
+			return GenericTokenError{fields[1], fmt.Sprintf("section is already placed at %s", other.Ref)}
+		}
+	}
+	l.Sections = append(l.Sections, s)
+	return nil
+}
+
+// validSectionName returns true for one of the built in sections
+// or a name that can be written after .section.
+func validSectionName(name string) bool {
+	for _, b := range builtinSections {
+		if b.Name == name {
+			return true
+		}
+	}
+	if name == "" || name[0] == '.' || (name[0] >= '0' && name[0] <= '9') || token.ToType(name) != token.Unknown {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		ok := c == '_' || c == '.' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// validate checks that the sections are in segment order, every
+// built in section is placed in its segment, and regions exist.
+func (l *Layout) validate() error {
+	errs := error(nil)
+	for _, b := range builtinSections {
+		s, ok := l.section(b.Name)
+		if !ok {
+			errs = errors.Join(errs, fmt.Errorf("section %s is not placed by the layout", b.Name))
+		} else if s.Segment != b.Segment {
+			errs = errors.Join(errs, fmt.Errorf("%s: section %s must be in the %s segment", s.Ref, b.Name, b.Segment))
+		}
+	}
+	for i, s := range l.Sections {
+		if i > 0 && s.Segment < l.Sections[i-1].Segment {
+			prev := l.Sections[i-1]
+			errs = errors.Join(errs, fmt.Errorf("%s: section %s in the %s segment cannot be after %s in the %s segment", s.Ref, s.Name, s.Segment, prev.Name, prev.Segment))
+		}
+		if _, ok := l.region(s.Region); s.Region != "" && !ok {
+			errs = errors.Join(errs, fmt.Errorf("%s: unknown region \"%s\"", s.Ref, s.Region))
+		}
+	}
+	return errs
+}
+
+func (l *Layout) section(name string) (LayoutSection, bool) {
+	for _, s := range l.Sections {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return LayoutSection{}, false
+}
+
+func (l *Layout) region(name string) (Region, bool) {
+	for _, r := range l.Regions {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Region{}, false
+}
+
+// sectionLabel returns the name of the label at the start or end of
+// a section, such as "__boot_data_start" for ".boot.data".
+func sectionLabel(name string, suffix string) string {
+	name = strings.ReplaceAll(strings.TrimPrefix(name, "."), ".", "_")
+	return fmt.Sprintf("__%s_%s", name, suffix)
+}
+
+// isBuiltin returns true if the section has its own directive.
+func (p placedSection) isBuiltin() bool {
+	for _, b := range builtinSections {
+		if b.Name == p.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// errorf returns an error at the description of the section, if known.
+func (p placedSection) errorf(format string, a ...any) error {
+	msg := fmt.Sprintf(format, a...)
+	if p.Ref.Filename == "" {
+		return errors.New(msg)
+	}
+	return fmt.Errorf("%s: %s", p.Ref, msg)
+}
+
+// setupLayout creates the sections of the layout.
+func (c *Compiler) setupLayout() error {
+	c.layout = c.Layout
+	if c.layout == nil {
+		c.layout = DefaultLayout()
+	}
+	err := c.layout.validate()
+	if err != nil {
+		return err
+	}
+	builtin := map[string]*Section{
+		".boot":      &c.Boot,
+		".text":      &c.Text,
+		".boot.data": &c.BootData,
+		".data":      &c.Data,
+		".bss":       &c.Bss,
+	}
+	c.sections = make([]placedSection, len(c.layout.Sections))
+	for i, s := range c.layout.Sections {
+		section, ok := builtin[s.Name]
+		if !ok {
+			section = &Section{}
+		}
+		c.sections[i] = placedSection{s, section}
+	}
+	return nil
+}
+
+// useSection switches to the section named by a .section directive.
+func (c *Compiler) useSection(s StmntSection) error {
+	if s.Name.TokenType.IsSection() {
+		c.setSection(s.Name.TokenType)
+		return nil
+	}
+	for _, p := range c.sections {
+		if p.Name == s.Name.Lexeme {
+			c.CurrentSection = p.section
+			return nil
+		}
+	}
+	return GenericTokenError{s.Name, "section is not in the layout"}
+}
+
+// placeSections places each section after the previous one, or at its
+// fixed address. Any gap is padding in the segment of the next section.
+func (c *Compiler) placeSections() error {
+	pos := c.LoadAddress * 4
+	seg := Segment(-1)
+	errs := error(nil)
+	for _, p := range c.sections {
+		for seg < p.Segment {
+			seg++
+			c.segments[seg] = segmentRange{pos, pos}
+		}
+		if p.Fixed {
+			if p.Address*4 < pos {
+				errs = errors.Join(errs, p.errorf("section %s at word %d overlaps the program before it, which ends at word %d", p.Name, p.Address, pos/4))
+			} else {
+				pos = p.Address * 4
+			}
+		}
+		if align := max(p.Align, 1) * 4; pos%align != 0 {
+			pos += align - pos%align
+		}
+		p.section.Offset = pos
+		pos += p.section.Size
+		c.segments[seg].end = pos
+	}
+	for seg < SegmentBss {
+		seg++
+		c.segments[seg] = segmentRange{pos, pos}
+	}
+
+	for _, p := range c.sections {
+		if p.Region == "" {
+			continue
+		}
+		r, _ := c.layout.region(p.Region)
+		start := p.section.Offset / 4
+		end := (p.section.Offset + p.section.Size) / 4
+		if start < r.Start || end > r.Start+r.Size {
+			errs = errors.Join(errs, p.errorf("section %s at words %d to %d does not fit in region %s at words %d to %d", p.Name, start, end, r.Name, r.Start, r.Start+r.Size))
+		}
+	}
+	return errs
+}
+
+// genSectionLabels adds the labels at the start and end of a section.
+func (c *Compiler) genSectionLabels(name string, s *Section) {
+	start := sectionLabel(name, "start")
+	end := sectionLabel(name, "end")
+	c.Labels[start] = &Label{
+		Name:  start,
+		Value: s.Offset,
+	}
+	c.Labels[end] = &Label{
+		Name:  end,
+		Value: s.Offset + s.Size,
+	}
+}
+
+// segmentOf returns the segment a section is in.
+func (c *Compiler) segmentOf(s *Section) (Segment, bool) {
+	for _, p := range c.sections {
+		if p.section == s {
+			return p.Segment, true
+		}
+	}
+	return 0, false
+}
+
+// segmentSize returns the size of a segment in bytes, including padding.
+func (c *Compiler) segmentSize(seg Segment) int {
+	r := c.segments[seg]
+	return r.end - r.start
+}
+
+// segmentBin returns the content of a segment, including padding.
+func (c *Compiler) segmentBin(seg Segment) []byte {
+	r := c.segments[seg]
+	b := make([]byte, r.end-r.start)
+	for _, p := range c.sections {
+		if p.Segment == seg {
+			copy(b[p.section.Offset-r.start:], p.section.Bin)
+		}
+	}
+	return b
+}
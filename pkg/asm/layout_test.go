@@ -0,0 +1,175 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+const testLayout = `
+# the program and a mailbox at a known address
+region rtc 0 64
+section .boot text
+section .text text
+section fast text align 4 in rtc
+section .boot.data data
+section .data data
+section mailbox data at 16 in rtc // read by the host
+section .bss bss
+`
+
+func TestLayout(t *testing.T) {
+	layout, err := ParseLayout(testLayout, "test.ld")
+	if err != nil {
+		t.Fatalf("Failed to parse layout: %s", err)
+	}
+	src := `
+		.boot
+		jump main
+		.text
+	main:
+		halt
+		.section fast
+	isr:
+		wake
+		halt
+		.data
+	value: .int 7
+		.section mailbox
+	box: .int 1, 2
+		.bss
+	buf: .int 0
+	`
+	sources := []Source{{Name: "test.S", Content: []byte(src)}}
+	res, err := Build(context.Background(), sources, Options{Layout: layout})
+	if err != nil {
+		t.Fatalf("Failed to build: %s", err)
+	}
+	header, err := emu.ParseHeader(res.Binary)
+	if err != nil {
+		t.Fatalf("Failed to parse header: %s", err)
+	}
+	// padding is part of the segment of the section after it
+	if header.TextSize != 6*4 || header.DataSize != 12*4 {
+		t.Errorf("Expected text size 24 and data size 48, got %+v", header)
+	}
+	addresses := map[string]int{
+		"isr":             4,
+		"value":           6,
+		"box":             16,
+		"buf":             18,
+		"__fast_start":    4,
+		"__fast_end":      6,
+		"__mailbox_end":   18,
+		"__stack_start":   19,
+		"__boot_data_end": 6,
+	}
+	for _, s := range res.Symbols {
+		if want, ok := addresses[s.Name]; ok {
+			if s.Address != want {
+				t.Errorf("Expected %s at %d got %d", s.Name, want, s.Address)
+			}
+			delete(addresses, s.Name)
+		}
+	}
+	for name := range addresses {
+		t.Errorf("Expected symbol %s", name)
+	}
+	box := 12 + 16*4
+	if got := binary.LittleEndian.Uint32(res.Binary[box:]); got != 1 {
+		t.Errorf("Expected the mailbox to hold 1 got %d", got)
+	}
+	if !strings.Contains(res.Compiler.FormatSections(), " fast=8 mailbox=8 ") {
+		t.Errorf("Expected the sizes of every section: %s", res.Compiler.FormatSections())
+	}
+}
+
+func TestLayoutErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		layout string
+		asm    string
+		err    string
+	}{
+		{
+			name:   "unknown entry",
+			layout: "sections fast text",
+			err:    "test.ld:1:1: got \"sections\", expected \"region\" or \"section\"",
+		},
+		{
+			name:   "wrong segment",
+			layout: "section .boot text\nsection .text text\nsection .boot.data data\nsection .data text\nsection .bss bss",
+			err:    "test.ld:4:9: section .data must be in the data segment",
+		},
+		{
+			name:   "missing",
+			layout: "section .boot text\nsection .text text\nsection .boot.data data\nsection .data data",
+			err:    "section .bss is not placed by the layout",
+		},
+		{
+			name:   "order",
+			layout: "section .boot text\nsection .boot.data data\nsection .text text\nsection .data data\nsection .bss bss",
+			err:    "section .text in the text segment cannot be after .boot.data in the data segment",
+		},
+		{
+			name:   "unknown region",
+			layout: "section .boot text in ram\nsection .text text\nsection .boot.data data\nsection .data data\nsection .bss bss",
+			err:    "test.ld:1:9: unknown region \"ram\"",
+		},
+		{
+			name:   "duplicate",
+			layout: "section fast text\nsection fast data",
+			err:    "test.ld:2:9: got \"fast\", section is already placed at test.ld:1:9",
+		},
+		{
+			name:   "stack",
+			layout: "section stack bss",
+			err:    "the stack is always placed after every section",
+		},
+		{
+			name:   "name",
+			layout: "section add text",
+			err:    "expected a section name",
+		},
+		{
+			name:   "unknown section",
+			layout: testLayout,
+			asm:    ".section slow\nhalt",
+			err:    "test.S:1:10: got \"slow\", section is not in the layout",
+		},
+		{
+			name:   "overlap",
+			layout: strings.Replace(testLayout, "at 16", "at 4", 1),
+			asm:    "halt\n.section fast\nhalt\n.section mailbox\n.int 0",
+			err:    "test.ld:9:9: section mailbox at word 4 overlaps the program before it, which ends at word 5",
+		},
+		{
+			name:   "region",
+			layout: strings.Replace(testLayout, "rtc 0 64", "rtc 0 16", 1),
+			asm:    ".section mailbox\n.int 0",
+			err:    "section mailbox at words 16 to 17 does not fit in region rtc at words 0 to 16",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout, err := ParseLayout(tt.layout, "test.ld")
+			if err == nil {
+				sources := []Source{{Name: "test.S", Content: []byte(tt.asm)}}
+				_, err = Build(context.Background(), sources, Options{Layout: layout})
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Expected error containing %q got %v", tt.err, err)
+			}
+		})
+	}
+}
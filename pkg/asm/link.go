@@ -0,0 +1,389 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Molorius/ulp-c/pkg/asm/token"
+)
+
+// Binding is where a label can be referenced from.
+type Binding int
+
+const (
+	BindingDefault Binding = iota // visible from every file
+	BindingWeak                   // visible from every file, replaced by any other definition
+	BindingLocal                  // only visible from the file it is defined in
+)
+
+func (b Binding) String() string {
+	switch b {
+	case BindingDefault:
+		return "default"
+	case BindingWeak:
+		return "weak"
+	case BindingLocal:
+		return "local"
+	default:
+		return "unknown"
+	}
+}
+
+// fileBindings is the binding directives of a single file.
+type fileBindings struct {
+	index  int              // used to rename local labels
+	locals map[string]Token // labels declared .local
+	others map[string]Token // the first other directive of each label
+	weak   map[string]Token // labels declared .weak
+}
+
+// labelDef is the definition of a label in the program.
+type labelDef struct {
+	index int // index of the statement in the program
+	label Token
+	weak  bool
+}
+
+// localName returns the name a .local label is renamed to, which
+// cannot be written in source so it does not clash with other files.
+func localName(name string, file int) string {
+	return fmt.Sprintf("%s@%d", name, file)
+}
+
+// sourceName returns the name of a label as written in source.
+func sourceName(name string) string {
+	n, _, _ := strings.Cut(name, "@")
+	return n
+}
+
+// sourceToken returns a token with the label name as written in source.
+func sourceToken(t Token) Token {
+	t.Lexeme = sourceName(t.Lexeme)
+	return t
+}
+
+// link resolves the binding of each label between files. Labels declared
+// .local are renamed so they cannot clash with other files, weak definitions
+// are removed if there is another definition, and defining a label twice
+// is an error that names both definitions.
+func (c *Compiler) link() error {
+	c.bindings = make(map[string]Binding)
+	c.externs = make(map[string]Token)
+	c.weakUndefined = make(map[string]Token)
+
+	// collect the directives of each file
+	files := make(map[string]*fileBindings)
+	order := make([]*fileBindings, 0) // in source order
+	errs := error(nil)
+	for _, stmnt := range c.program {
+		filename := stmnt.Pos().Filename
+		f, ok := files[filename]
+		if !ok {
+			f = &fileBindings{
+				index:  len(files),
+				locals: make(map[string]Token),
+				others: make(map[string]Token),
+				weak:   make(map[string]Token),
+			}
+			files[filename] = f
+			order = append(order, f)
+		}
+		s, ok := stmnt.(StmntGlobal)
+		if !ok {
+			continue
+		}
+		name := s.Label.Lexeme
+		if s.Directive.TokenType == token.Local {
+			if prev, ok := f.others[name]; ok {
+				errs = errors.Join(errs, GenericTokenError{s.Label, fmt.Sprintf("cannot be .local, declared %s at %s", prev.TokenType, prev.Ref)})
+				continue
+			}
+			f.locals[name] = s.Directive
+			continue
+		}
+		if prev, ok := f.locals[name]; ok {
+			errs = errors.Join(errs, GenericTokenError{s.Label, fmt.Sprintf("cannot be %s, declared .local at %s", s.Directive.TokenType, prev.Ref)})
+			continue
+		}
+		if _, ok := f.others[name]; !ok {
+			f.others[name] = s.Directive
+		}
+		switch s.Directive.TokenType {
+		case token.Weak:
+			f.weak[name] = s.Label
+		case token.Extern:
+			if _, ok := c.externs[name]; !ok {
+				c.externs[name] = s.Label
+			}
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+
+	// rename the local labels of each file
+	for i, stmnt := range c.program {
+		f := files[stmnt.Pos().Filename]
+		if len(f.locals) == 0 {
+			continue
+		}
+		c.program[i] = renameStmnt(stmnt, func(name string) string {
+			if _, ok := f.locals[name]; ok {
+				return localName(name, f.index)
+			}
+			return name
+		})
+	}
+
+	// find the definitions of each label
+	defs := make(map[string][]labelDef)
+	for i, stmnt := range c.program {
+		s, ok := stmnt.(StmntLabel)
+		if !ok {
+			continue
+		}
+		f := files[s.Pos().Filename]
+		name := s.Label.Lexeme
+		_, weak := f.weak[name]
+		defs[name] = append(defs[name], labelDef{index: i, label: s.Label, weak: weak})
+	}
+	for _, f := range order {
+		for _, name := range sortedKeys(f.locals) {
+			directive := f.locals[name]
+			local := localName(name, f.index)
+			if _, ok := defs[local]; !ok {
+				errs = errors.Join(errs, GenericTokenError{directive, fmt.Sprintf("label \"%s\" is not defined in this file", name)})
+			}
+			c.bindings[local] = BindingLocal
+		}
+		for name, label := range f.weak {
+			if _, ok := defs[name]; !ok {
+				if _, ok := c.weakUndefined[name]; !ok {
+					c.weakUndefined[name] = label
+				}
+			}
+		}
+	}
+
+	// remove the overridden weak definitions along with their sub-labels
+	removed := make(map[int]bool)
+	for _, name := range sortedKeys(defs) {
+		list := defs[name]
+		keep := max(keptDef(list), 0)
+		for i, d := range list {
+			if i == keep || !d.weak {
+				continue
+			}
+			filename := d.label.Ref.Filename
+			for child, childList := range defs {
+				if !strings.HasPrefix(child, name+".") {
+					continue
+				}
+				for _, cd := range childList {
+					if cd.label.Ref.Filename == filename {
+						c.removeWeakBody(removed, cd.index, name)
+					}
+				}
+			}
+			c.removeWeakBody(removed, d.index, name)
+		}
+	}
+
+	// keep the first strong definition, otherwise the first weak one
+	for _, name := range sortedKeys(defs) {
+		list := slices.DeleteFunc(defs[name], func(d labelDef) bool {
+			return removed[d.index]
+		})
+		if len(list) == 0 {
+			continue
+		}
+		keep := keptDef(list)
+		if keep < 0 {
+			keep = 0
+			c.bindings[name] = BindingWeak
+		}
+		for i, d := range list {
+			if i == keep || d.weak {
+				continue
+			}
+			msg := fmt.Sprintf("label is already defined at %s", list[keep].label.Ref)
+			errs = errors.Join(errs, GenericTokenError{sourceToken(d.label), msg})
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	remove := make([]int, 0, len(removed))
+	for i := range removed {
+		remove = append(remove, i)
+	}
+	slices.Sort(remove)
+	for i := len(remove) - 1; i >= 0; i-- {
+		c.program = slices.Delete(c.program, remove[i], remove[i]+1)
+	}
+	return nil
+}
+
+// keptDef returns the index of the first strong definition in the list,
+// or -1 if every definition is weak.
+func keptDef(list []labelDef) int {
+	for i, d := range list {
+		if !d.weak {
+			return i
+		}
+	}
+	return -1
+}
+
+// removeWeakBody marks an overridden weak label and every statement after
+// it up to the next label that is not a sub-label of name, section or
+// file. The declarations of other labels are kept.
+func (c *Compiler) removeWeakBody(removed map[int]bool, index int, name string) {
+	removed[index] = true
+	filename := c.program[index].Pos().Filename
+	for i := index + 1; i < len(c.program); i++ {
+		stmnt := c.program[i]
+		if stmnt.Pos().Filename != filename {
+			return
+		}
+		switch s := stmnt.(type) {
+		case StmntLabel:
+			if !strings.HasPrefix(s.Label.Lexeme, name+".") {
+				return
+			}
+		case StmntSection:
+			return
+		case StmntDirective:
+			if s.Directive.TokenType.IsSection() {
+				return
+			}
+		case StmntGlobal:
+			continue
+		}
+		removed[i] = true
+	}
+}
+
+// genExterns adds weak labels that are never defined with a value of 0,
+// then checks that every .extern label is defined. Must be called after
+// every other label is generated.
+func (c *Compiler) genExterns() error {
+	for name, label := range c.weakUndefined {
+		if _, ok := c.Labels[name]; ok {
+			continue
+		}
+		c.Labels[name] = &Label{
+			Name:    name,
+			Binding: BindingWeak,
+			Ref:     label.Ref,
+		}
+	}
+	errs := error(nil)
+	for _, name := range sortedKeys(c.externs) {
+		decl := c.externs[name]
+		if _, ok := c.Labels[name]; ok {
+			continue
+		}
+		use, ok := c.firstUse(name)
+		if ok {
+			msg := fmt.Sprintf("unresolved label, declared .extern at %s", decl.Ref)
+			errs = errors.Join(errs, GenericTokenError{use, msg})
+		} else {
+			errs = errors.Join(errs, GenericTokenError{decl, "declared .extern but never defined"})
+		}
+	}
+	return errs
+}
+
+// firstUse returns the first reference to a label in an expression.
+func (c *Compiler) firstUse(name string) (Token, bool) {
+	use := Token{}
+	found := false
+	for _, stmnt := range c.program {
+		Inspect(stmnt, func(n Node) bool {
+			if e, ok := n.(ExprLiteral); ok && !found && e.Operator.TokenType == token.Identifier && e.Operator.Lexeme == name {
+				use = e.Operator
+				found = true
+			}
+			return !found
+		})
+		if found {
+			break
+		}
+	}
+	return use, found
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// renameStmnt returns a statement with every label name replaced by rename(name).
+func renameStmnt(s Stmnt, rename func(string) string) Stmnt {
+	switch s := s.(type) {
+	case StmntLabel:
+		s.Label.Lexeme = rename(s.Label.Lexeme)
+		return s
+	case StmntGlobal:
+		s.Label.Lexeme = rename(s.Label.Lexeme)
+		return s
+	case StmntInt:
+		args := make([]ArgExpr, len(s.Args))
+		for i, a := range s.Args {
+			args[i] = ArgExpr{renameExpr(a.Expr, rename)}
+		}
+		s.Args = args
+		return s
+	case StmntBound:
+		s.Bound = ArgExpr{renameExpr(s.Bound.Expr, rename)}
+		return s
+	case StmntTiming:
+		s.Min = ArgExpr{renameExpr(s.Min.Expr, rename)}
+		s.Max = ArgExpr{renameExpr(s.Max.Expr, rename)}
+		return s
+	case StmntInstr:
+		args := make([]Arg, len(s.Args))
+		for i, a := range s.Args {
+			if e, ok := a.(ArgExpr); ok {
+				a = ArgExpr{renameExpr(e.Expr, rename)}
+			}
+			args[i] = a
+		}
+		s.Args = args
+		s.Setup()
+		return s
+	}
+	return s
+}
+
+func renameExpr(e Expr, rename func(string) string) Expr {
+	switch e := e.(type) {
+	case ExprBinary:
+		e.Left = renameExpr(e.Left, rename)
+		e.Right = renameExpr(e.Right, rename)
+		return e
+	case ExprUnary:
+		e.Expression = renameExpr(e.Expression, rename)
+		return e
+	case ExprLiteral:
+		if e.Operator.TokenType == token.Identifier {
+			e.Operator.Lexeme = rename(e.Operator.Lexeme)
+		}
+		return e
+	}
+	return e
+}
@@ -0,0 +1,288 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestLink(t *testing.T) {
+	// data returns the words of the .data section
+	data := func(res *Result) []int {
+		out := make([]int, 0)
+		for _, s := range res.Sections {
+			if s.Name != ".data" {
+				continue
+			}
+			for i := 0; i+4 <= len(s.Bin); i += 4 {
+				out = append(out, int(binary.LittleEndian.Uint32(s.Bin[i:])))
+			}
+		}
+		return out
+	}
+	symbol := func(res *Result, name string, file string) (Symbol, bool) {
+		for _, s := range res.Symbols {
+			if s.Name == name && s.File == file {
+				return s, true
+			}
+		}
+		return Symbol{}, false
+	}
+	tests := []struct {
+		name    string
+		a       string
+		b       string
+		errs    []string // expected parts of the error, empty if it builds
+		data    []int
+		symbols []Symbol
+		absent  []string // labels that must not be in the symbols
+		text    int      // size of .text in bytes, unchecked if 0
+	}{
+		{
+			name: "local",
+			a: `
+				.local helper
+			helper:
+				halt
+				.data
+				.int helper
+			`,
+			b: `
+				halt
+			helper:
+				halt
+				.data
+				.int helper
+			`,
+			data: []int{0, 2},
+			symbols: []Symbol{
+				{Name: "helper", Address: 0, Section: ".text", Binding: "local", File: "a.S", Size: 8},
+				{Name: "helper", Address: 2, Section: ".text", Binding: "default", Size: 4},
+			},
+		},
+		{
+			name: "weak overridden",
+			a: `
+				.weak handler
+			handler:
+				move r0, 1
+				halt
+				.data
+				.int handler
+				.text
+			after:
+				halt
+			`,
+			b: `
+			handler:
+				halt
+			`,
+			data: []int{1},
+			symbols: []Symbol{
+				{Name: "after", Address: 0, Section: ".text", Binding: "default", Size: 4},
+				{Name: "handler", Address: 1, Section: ".text", Binding: "default", Size: 4},
+			},
+		},
+		{
+			name: "weak overridden with sub-labels",
+			a: `
+				.weak f
+			f:
+				move r0, 1
+			f.loop:
+				sub r0, r0, 1
+				jumpr f.loop, 0, gt
+				jump r2
+			`,
+			b: `
+			f:
+				move r1, 7
+				jump r2
+			`,
+			text: 8,
+			symbols: []Symbol{
+				{Name: "f", Address: 0, Section: ".text", Binding: "default", Size: 8},
+			},
+			absent: []string{"f.loop"},
+		},
+		{
+			name: "weak sub-labels defined again",
+			a: `
+				.weak f
+			f:
+				halt
+				.data
+			f.count:
+				.int 1
+			`,
+			b: `
+			f:
+				halt
+				.data
+			f.count:
+				.int 2
+			`,
+			data: []int{2},
+			text: 4,
+			symbols: []Symbol{
+				{Name: "f", Address: 0, Section: ".text", Binding: "default", Size: 4},
+				{Name: "f.count", Address: 1, Section: ".data", Binding: "default", Size: 4},
+			},
+		},
+		{
+			name: "weak only",
+			a: `
+				.weak handler
+			handler:
+				halt
+			`,
+			b: `
+				.data
+				.int handler
+			`,
+			data: []int{0},
+			symbols: []Symbol{
+				{Name: "handler", Address: 0, Section: ".text", Binding: "weak", Size: 4},
+			},
+		},
+		{
+			name: "weak undefined",
+			a: `
+				.weak handler
+				.data
+				.int handler
+			`,
+			b:    "halt",
+			data: []int{0},
+		},
+		{
+			name: "extern",
+			a: `
+				.extern value
+				halt
+				.data
+				.int value
+			`,
+			b: `
+				.data
+			value: .int 5
+			`,
+			data: []int{2, 5},
+		},
+		{
+			name: "duplicate",
+			a: `
+			entry:
+				halt
+			`,
+			b: `
+			entry:
+				halt
+			`,
+			errs: []string{"b.S:2:4", "already defined at a.S:2:4"},
+		},
+		{
+			name: "unresolved extern",
+			a: `
+				.extern value
+				halt
+			`,
+			b: `
+				.data
+				.int value
+			`,
+			errs: []string{"b.S:3:10", "unresolved label, declared .extern at a.S:2:13"},
+		},
+		{
+			name: "unused extern",
+			a: `
+				.extern value
+				halt
+			`,
+			b:    "halt",
+			errs: []string{"a.S:2:13", "declared .extern but never defined"},
+		},
+		{
+			name: "local undefined",
+			a: `
+				.local helper
+				halt
+			`,
+			b: `
+			helper:
+				halt
+			`,
+			errs: []string{"a.S:2:5", "label \"helper\" is not defined in this file"},
+		},
+		{
+			name: "local and global",
+			a: `
+				.global helper
+				.local helper
+			helper:
+				halt
+			`,
+			b:    "halt",
+			errs: []string{"a.S:3:12", "cannot be .local, declared .global at a.S:2:5"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources := []Source{
+				{Name: "a.S", Content: []byte(tt.a)},
+				{Name: "b.S", Content: []byte(tt.b)},
+			}
+			res, err := Build(context.Background(), sources, Options{})
+			if len(tt.errs) != 0 {
+				if err == nil {
+					t.Fatalf("Expected an error")
+				}
+				for _, e := range tt.errs {
+					if !strings.Contains(err.Error(), e) {
+						t.Errorf("Expected %q in error: %s", e, err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to build: %s", err)
+			}
+			got := data(res)
+			if len(got) != len(tt.data) {
+				t.Fatalf("Expected data %v, got %v", tt.data, got)
+			}
+			for i := range got {
+				if got[i] != tt.data[i] {
+					t.Errorf("Expected data %v, got %v", tt.data, got)
+					break
+				}
+			}
+			for _, e := range tt.symbols {
+				s, ok := symbol(res, e.Name, e.File)
+				if !ok || s != e {
+					t.Errorf("Expected symbol %+v, got %+v", e, s)
+				}
+			}
+			for _, name := range tt.absent {
+				if s, ok := symbol(res, name, ""); ok {
+					t.Errorf("Expected no symbol %s, got %+v", name, s)
+				}
+			}
+			if tt.text != 0 {
+				for _, s := range res.Sections {
+					if s.Name == ".text" && s.Size != tt.text {
+						t.Errorf("Expected .text of %d bytes, got %d", tt.text, s.Size)
+					}
+				}
+			}
+		})
+	}
+}
@@ -86,14 +86,24 @@ func (p *parser) directive() (Stmnt, error) {
 		return nil, GenericTokenError{t, "compiler bug in parser.directive(), please file a bug report"}
 	}
 	switch t.TokenType {
-	case token.Global:
+	case token.Global, token.Local, token.Weak, token.Extern:
 		if p.match(token.Identifier) {
-			s := StmntGlobal{Label: p.previous()}
+			s := StmntGlobal{Directive: t, Label: p.previous()}
 			return s, nil
 		}
 		return nil, ExpectedTokenError{token.Identifier, p.next()}
 	case token.Int:
 		return p.directiveInt(t)
+	case token.Bound:
+		return p.directiveBound(t)
+	case token.Timing:
+		return p.directiveTiming(t)
+	case token.Section:
+		n := p.next()
+		if n.TokenType != token.Identifier && !n.TokenType.IsSection() {
+			return nil, GenericTokenError{n, "expected a section name"}
+		}
+		return StmntSection{Directive: t, Name: n}, nil
 	default:
 		return StmntDirective{t}, nil
 	}
@@ -116,7 +126,41 @@ func (p *parser) directiveInt(t Token) (Stmnt, error) {
 			return nil, GenericTokenError{t, fmt.Sprintf("expected an expression on argument %d", i)}
 		}
 	}
-	return StmntInt{argsExpr}, nil
+	return StmntInt{Directive: t, Args: argsExpr}, nil
+}
+
+func (p *parser) directiveBound(t Token) (Stmnt, error) {
+	args, err := p.arguments()
+	if err != nil {
+		return nil, errors.Join(GenericTokenError{t, "could not parse arguments for .bound"}, err)
+	}
+	if len(args) != 1 {
+		return nil, GenericTokenError{t, fmt.Sprintf("expected 1 argument but has %d", len(args))}
+	}
+	arg, ok := args[0].(ArgExpr)
+	if !ok {
+		return nil, GenericTokenError{t, "expected an expression"}
+	}
+	return StmntBound{Directive: t, Bound: arg}, nil
+}
+
+func (p *parser) directiveTiming(t Token) (Stmnt, error) {
+	args, err := p.arguments()
+	if err != nil {
+		return nil, errors.Join(GenericTokenError{t, "could not parse arguments for .timing"}, err)
+	}
+	if len(args) != 2 {
+		return nil, GenericTokenError{t, fmt.Sprintf("expected 2 arguments but has %d", len(args))}
+	}
+	argsExpr := make([]ArgExpr, len(args))
+	for i := range args {
+		a, ok := args[i].(ArgExpr)
+		if !ok {
+			return nil, GenericTokenError{t, fmt.Sprintf("expected an expression on argument %d", i)}
+		}
+		argsExpr[i] = a
+	}
+	return StmntTiming{Directive: t, Min: argsExpr[0], Max: argsExpr[1]}, nil
 }
 
 func (p *parser) instruction() (Stmnt, error) {
@@ -0,0 +1,299 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Molorius/ulp-c/pkg/asm/token"
+)
+
+// Fprint writes a file as canonical source. Labels start at the beginning
+// of the line, all other statements are indented with a tab. Within a block
+// of instructions the operands are aligned, as are comments at the end of
+// consecutive lines. Comments are kept and runs of blank lines become a
+// single blank line.
+func Fprint(w io.Writer, f *File) error {
+	_, err := io.WriteString(w, f.String())
+	return err
+}
+
+// FormatSource parses assembly and returns it as canonical source, see Fprint.
+func FormatSource(src []byte, name string) ([]byte, error) {
+	f, err := Parse(string(src), name)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(f.String()), nil
+}
+
+// String returns the file as canonical source, see Fprint.
+func (f *File) String() string {
+	p := printer{}
+	c := 0
+	for _, s := range f.Stmnts {
+		pos := s.Pos()
+		// comments before this statement
+		for c < len(f.Comments) && before(f.Comments[c].Ref, pos) {
+			p.comment(f.Comments[c])
+			c++
+		}
+		p.stmnt(s)
+	}
+	for ; c < len(f.Comments); c++ {
+		p.comment(f.Comments[c])
+	}
+	return p.render()
+}
+
+// printLine is a single line of output.
+type printLine struct {
+	blank    bool   // if a blank line comes first
+	indent   string // the indentation
+	mnemonic string // the instruction name, if an instruction
+	text     string // the instruction operands, otherwise the whole line
+	comment  string // a comment at the end of the line
+}
+
+// code returns the line without its trailing comment.
+func (l printLine) code(width int) string {
+	if l.mnemonic == "" {
+		return l.indent + l.text
+	}
+	if l.text == "" {
+		return l.indent + l.mnemonic
+	}
+	return l.indent + fmt.Sprintf("%-*s %s", width, l.mnemonic, l.text)
+}
+
+type printer struct {
+	lines    []printLine
+	lastLine int // the last source line printed, 0 if nothing printed
+}
+
+// add adds a new line of output from source lines `start` to `start+extra`.
+func (p *printer) add(start int, extra int, l printLine) {
+	l.blank = p.lastLine != 0 && start > p.lastLine+1
+	p.lines = append(p.lines, l)
+	p.lastLine = start + extra
+}
+
+func (p *printer) stmnt(s Stmnt) {
+	l := printLine{indent: "\t"}
+	switch s := s.(type) {
+	case StmntLabel:
+		l.indent = ""
+		l.text = StmntString(s)
+	case StmntInstr:
+		l.mnemonic = s.Instruction.TokenType.String()
+		l.text = argsString(s.Args)
+	default:
+		l.text = strings.TrimPrefix(StmntString(s), "\t")
+	}
+	p.add(s.Pos().Line, 0, l)
+}
+
+func (p *printer) comment(c Comment) {
+	extra := strings.Count(c.Text, "\n")
+	last := len(p.lines) - 1
+	if last >= 0 && c.Ref.Line == p.lastLine && p.lines[last].comment == "" {
+		// a comment at the end of the previous line
+		p.lines[last].comment = c.Text
+		p.lastLine += extra
+		return
+	}
+	indent := "\t"
+	if c.Ref.Index == 1 {
+		indent = ""
+	}
+	p.add(c.Ref.Line, extra, printLine{indent: indent, text: c.Text})
+}
+
+// render aligns the lines and joins them.
+func (p *printer) render() string {
+	// align the operands of each block of instructions
+	widths := make([]int, len(p.lines))
+	for start := 0; start < len(p.lines); {
+		end := start + 1
+		if p.lines[start].mnemonic != "" {
+			for end < len(p.lines) && p.lines[end].mnemonic != "" && !p.lines[end].blank {
+				end++
+			}
+		}
+		width := 0
+		for i := start; i < end; i++ {
+			if p.lines[i].text != "" {
+				width = max(width, len(p.lines[i].mnemonic))
+			}
+		}
+		for i := start; i < end; i++ {
+			widths[i] = width
+		}
+		start = end
+	}
+
+	// align the comments at the end of consecutive lines with the same indentation
+	codes := make([]string, len(p.lines))
+	for i, l := range p.lines {
+		codes[i] = l.code(widths[i])
+	}
+	out := strings.Builder{}
+	for start := 0; start < len(p.lines); {
+		end := start + 1
+		if p.lines[start].comment != "" {
+			for end < len(p.lines) && p.lines[end].comment != "" && !p.lines[end].blank &&
+				p.lines[end].indent == p.lines[start].indent && !strings.Contains(p.lines[end-1].comment, "\n") {
+				end++
+			}
+		}
+		width := 0
+		for i := start; i < end; i++ {
+			width = max(width, len(codes[i]))
+		}
+		for i := start; i < end; i++ {
+			l := p.lines[i]
+			if l.blank {
+				out.WriteString("\n")
+			}
+			if l.comment == "" {
+				out.WriteString(codes[i] + "\n")
+			} else {
+				out.WriteString(fmt.Sprintf("%-*s %s\n", width, codes[i], l.comment))
+			}
+		}
+		start = end
+	}
+	return out.String()
+}
+
+// before returns true if `a` is before `b` in the same file.
+func before(a FileRef, b FileRef) bool {
+	if a.Line != b.Line {
+		return a.Line < b.Line
+	}
+	return a.Index < b.Index
+}
+
+// StmntString returns a statement as canonical source, without a newline.
+func StmntString(s Stmnt) string {
+	switch s := s.(type) {
+	case StmntLabel:
+		return s.Label.Lexeme + ":"
+	case StmntDirective:
+		return "\t" + s.Directive.TokenType.String()
+	case StmntGlobal:
+		return "\t" + s.Directive.TokenType.String() + " " + s.Label.Lexeme
+	case StmntSection:
+		return "\t.section " + s.Name.Lexeme
+	case StmntInt:
+		args := make([]Arg, len(s.Args))
+		for i, a := range s.Args {
+			args[i] = a
+		}
+		return "\t.int " + argsString(args)
+	case StmntBound:
+		return "\t.bound " + ExprString(s.Bound.Expr)
+	case StmntTiming:
+		return fmt.Sprintf("\t.timing %s, %s", ExprString(s.Min.Expr), ExprString(s.Max.Expr))
+	case StmntInstr:
+		name := s.Instruction.TokenType.String()
+		if len(s.Args) == 0 {
+			return "\t" + name
+		}
+		return "\t" + name + " " + argsString(s.Args)
+	}
+	return fmt.Sprintf("\t// unknown statement %T", s)
+}
+
+func argsString(args []Arg) string {
+	strs := make([]string, len(args))
+	for i, a := range args {
+		strs[i] = ArgString(a)
+	}
+	return strings.Join(strs, ", ")
+}
+
+// ArgString returns an argument as canonical source.
+func ArgString(a Arg) string {
+	switch a := a.(type) {
+	case ArgReg:
+		return a.Reg.TokenType.String()
+	case ArgJump:
+		return a.Arg.TokenType.String()
+	case ArgExpr:
+		return ExprString(a.Expr)
+	}
+	return fmt.Sprintf("%v", a)
+}
+
+// precedence of each expression, higher binds tighter
+const (
+	precShift = iota + 1
+	precAdditive
+	precFactor
+	precUnary
+	precPrimary
+)
+
+func exprPrecedence(e Expr) int {
+	switch e := e.(type) {
+	case ExprBinary:
+		switch e.Operator.TokenType {
+		case token.RightRight, token.LeftLeft:
+			return precShift
+		case token.Plus, token.Minus:
+			return precAdditive
+		default:
+			return precFactor
+		}
+	case ExprUnary:
+		return precUnary
+	}
+	return precPrimary
+}
+
+// ExprString returns an expression as canonical source,
+// with parentheses only where needed.
+func ExprString(e Expr) string {
+	return exprString(e, 0)
+}
+
+// exprString prints `e`, adding parentheses if it binds looser than `min`.
+func exprString(e Expr, min int) string {
+	prec := exprPrecedence(e)
+	s := ""
+	switch e := e.(type) {
+	case ExprBinary:
+		// left associative, so the right side must bind tighter
+		left := exprString(e.Left, prec)
+		right := exprString(e.Right, prec+1)
+		s = fmt.Sprintf("%s %s %s", left, e.Operator.TokenType, right)
+	case ExprUnary:
+		s = e.Operator.TokenType.String() + exprString(e.Expression, precUnary)
+	case ExprLiteral:
+		switch e.Operator.TokenType {
+		case token.Number:
+			s = e.Operator.Lexeme
+			if s == "" {
+				s = fmt.Sprint(e.Operator.Number)
+			}
+		case token.Here:
+			s = "."
+		default:
+			s = e.Operator.Lexeme
+		}
+	default:
+		s = fmt.Sprintf("%v", e)
+	}
+	if prec < min {
+		return "(" + s + ")"
+	}
+	return s
+}
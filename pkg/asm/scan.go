@@ -11,6 +11,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/Molorius/ulp-c/pkg/asm/token"
 )
@@ -63,7 +64,14 @@ func (t *Token) Equal(other *Token) bool {
 	}
 }
 
+// Comment is a comment in the source, including its delimiters.
+type Comment struct {
+	Ref  FileRef
+	Text string
+}
+
 type scanner struct {
+	comments     []Comment // every comment found
 	filename     string
 	line         int
 	linePosition int
@@ -77,6 +85,7 @@ func (s *scanner) scanFile(content string, name string) ([]Token, error) {
 	s.linePosition = 1
 	s.position = 0
 	s.content = content
+	s.comments = make([]Comment, 0)
 	errs := error(nil)
 
 	tokens := make([]Token, 0)
@@ -152,11 +161,15 @@ func (s *scanner) nextLexeme() (string, FileRef) {
 		if c == '/' {
 			c, _ := s.peak()
 			if c == '/' {
+				start := s.position - 1
 				s.skipLine()
+				s.addComment(f, start)
 				return s.nextLexeme()
 			}
 			if c == '*' {
+				start := s.position - 1
 				s.skipComment()
+				s.addComment(f, start)
 				return s.nextLexeme()
 			}
 		}
@@ -176,7 +189,9 @@ func (s *scanner) nextLexeme() (string, FileRef) {
 		}
 		// check if we have a "#" comment
 		if c == '#' {
+			start := s.position - 1
 			s.skipLine()
+			s.addComment(f, start)
 			return s.nextLexeme()
 		}
 		return string(c), f
@@ -191,6 +206,12 @@ func (s *scanner) nextLexeme() (string, FileRef) {
 	}
 }
 
+// addComment records the comment from `start` to the current position.
+func (s *scanner) addComment(ref FileRef, start int) {
+	text := strings.TrimRight(s.content[start:s.position], " \t\r")
+	s.comments = append(s.comments, Comment{Ref: ref, Text: text})
+}
+
 func (s *scanner) skipLine() {
 	for {
 		c, eof := s.peak()
@@ -0,0 +1,125 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/Molorius/ulp-c/pkg/asm/token"
+)
+
+// SharedLayout is a block of .data and .bss at a fixed address in RTC
+// memory, shared by several programs that are built against it with
+// Options.Shared. The host loads Image once, then each program is loaded
+// after it with ulp_load_binary().
+type SharedLayout struct {
+	Address int      `json:"address"` // word address of the block
+	Size    int      `json:"size"`    // size in bytes
+	Hash    string   `json:"hash"`    // identifies the layout, equal for equal layouts
+	Symbols []Symbol `json:"symbols"` // every label in the block
+	Image   []byte   `json:"-"`       // the initial content, .bss is zero
+}
+
+// End returns the word address after the block.
+func (l *SharedLayout) End() int {
+	return l.Address + l.Size/4
+}
+
+// BuildShared builds the shared data of several programs. The sources can
+// only contain .data and .bss, which are placed at Options.LoadAddress.
+func BuildShared(ctx context.Context, sources []Source, opts Options) (*SharedLayout, error) {
+	opts.Shared = nil
+	opts.Format = FormatBin
+	res, err := Build(ctx, sources, opts)
+	if err != nil {
+		return nil, err
+	}
+	c := res.Compiler
+	if code := c.segmentSize(SegmentText); code != 0 {
+		return nil, fmt.Errorf("shared data cannot contain code but found %d bytes in the text segment", code)
+	}
+	l := &SharedLayout{
+		Address: c.LoadAddress,
+		Size:    c.segmentSize(SegmentData) + c.segmentSize(SegmentBss),
+		Symbols: make([]Symbol, 0),
+	}
+	l.Image = append(l.Image, c.segmentBin(SegmentData)...)
+	l.Image = append(l.Image, make([]byte, c.segmentSize(SegmentBss))...)
+	for _, s := range res.Symbols {
+		if s.Section != "" && s.Binding != BindingLocal.String() {
+			l.Symbols = append(l.Symbols, s)
+		}
+	}
+	l.Hash = l.hash()
+	return l, nil
+}
+
+// JSON returns the layout as indented JSON, without the Image.
+func (l *SharedLayout) JSON() ([]byte, error) {
+	return json.MarshalIndent(l, "", "  ")
+}
+
+// ParseSharedLayout reads a layout written by JSON(). It is an
+// error if the hash does not match the rest of the layout.
+func ParseSharedLayout(data []byte) (*SharedLayout, error) {
+	l := &SharedLayout{}
+	err := json.Unmarshal(data, l)
+	if err != nil {
+		return nil, err
+	}
+	if h := l.hash(); h != l.Hash {
+		return nil, fmt.Errorf("shared layout has hash %s but its content has hash %s", l.Hash, h)
+	}
+	return l, nil
+}
+
+// Match returns an error if the layout is not the same as
+// a saved layout, such as after the shared data changed.
+func (l *SharedLayout) Match(saved *SharedLayout) error {
+	if l.Hash != saved.Hash {
+		return fmt.Errorf("shared data has hash %s but the saved layout has hash %s, rebuild every program with the new layout", l.Hash, saved.Hash)
+	}
+	return nil
+}
+
+// hash identifies the address, size and labels of the layout.
+func (l *SharedLayout) hash() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d %d\n", l.Address, l.Size)
+	for _, s := range l.Symbols {
+		fmt.Fprintf(h, "%s %d %d\n", s.Name, s.Address, s.Size)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// genShared adds the labels of the shared data, which must not
+// be defined by the program.
+func (c *Compiler) genShared() error {
+	if c.Shared == nil {
+		return nil
+	}
+	errs := error(nil)
+	for _, s := range c.Shared.Symbols {
+		if l, ok := c.Labels[s.Name]; ok {
+			tok := Token{TokenType: token.Identifier, Lexeme: sourceName(l.Name), Ref: l.Ref}
+			errs = errors.Join(errs, GenericTokenError{tok, "label is already defined in the shared data"})
+			continue
+		}
+		c.Labels[s.Name] = &Label{
+			Name:    s.Name,
+			Value:   s.Address * 4,
+			section: &c.SharedData,
+		}
+	}
+	return errs
+}
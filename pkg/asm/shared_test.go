@@ -0,0 +1,166 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+func TestShared(t *testing.T) {
+	shared := []Source{{Name: "shared.S", Content: []byte(`
+		.data
+	counter: .int 5
+	mode: .int 0
+		.bss
+	scratch: .int 0
+	`)}}
+	sensing := []Source{{Name: "sensing.S", Content: []byte(`
+		.boot
+		move r0, counter
+		ld r1, r0, 0
+		add r1, r1, 1
+		st r1, r0, 0
+		wake
+	`)}}
+	lowBattery := []Source{{Name: "low.S", Content: []byte(`
+		.extern counter
+		.boot
+		move r0, counter
+		ld r1, r0, 0
+		lsh r1, r1, 1
+		st r1, r0, 0
+		move r2, 1
+		st r2, r0, 1
+		wake
+	`)}}
+	ctx := context.Background()
+	const reserved = 1024
+
+	layout, err := BuildShared(ctx, shared, Options{ReservedBytes: reserved})
+	if err != nil {
+		t.Fatalf("Failed to build shared data: %s", err)
+	}
+	if layout.Address != 0 || layout.Size != 12 || len(layout.Image) != 12 {
+		t.Fatalf("Unexpected layout %+v", layout)
+	}
+	again, _ := BuildShared(ctx, shared, Options{ReservedBytes: reserved})
+	if again.Hash != layout.Hash {
+		t.Errorf("Expected equal layouts to have equal hashes")
+	}
+
+	// a saved layout must match its hash and the shared data
+	saved, err := layout.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ParseSharedLayout(saved)
+	if err != nil {
+		t.Fatalf("Failed to read the saved layout: %s", err)
+	}
+	if err = layout.Match(read); err != nil {
+		t.Errorf("Expected the saved layout to match: %s", err)
+	}
+	edited := strings.Replace(string(saved), `"size": 12`, `"size": 16`, 1)
+	if _, err = ParseSharedLayout([]byte(edited)); err == nil || !strings.Contains(err.Error(), "but its content has hash") {
+		t.Errorf("Expected an error from an edited layout, got %v", err)
+	}
+	changed, err := BuildShared(ctx, []Source{{Name: "shared.S", Content: []byte(".data\ncounter: .int 5\n")}}, Options{ReservedBytes: reserved})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = changed.Match(read); err == nil || !strings.Contains(err.Error(), "but the saved layout has hash") {
+		t.Errorf("Expected changed shared data to not match, got %v", err)
+	}
+
+	opts := Options{ReservedBytes: reserved, Shared: layout}
+	programs := make([]*Result, 0)
+	for _, src := range [][]Source{sensing, lowBattery} {
+		res, err := Build(ctx, src, opts)
+		if err != nil {
+			t.Fatalf("Failed to build: %s", err)
+		}
+		if res.Compiler.LoadAddress != layout.End() {
+			t.Errorf("Expected to load at %d got %d", layout.End(), res.Compiler.LoadAddress)
+		}
+		for _, s := range res.Symbols {
+			if s.Name == "counter" && (s.Address != 0 || s.Section != ".shared") {
+				t.Errorf("Expected counter at 0 in .shared got %+v", s)
+			}
+		}
+		programs = append(programs, res)
+	}
+
+	// run one program then switch to the other, keeping the shared data
+	u, err := emu.NewUlpEmu(reserved)
+	if err != nil {
+		t.Fatalf("Failed to create emulator: %s", err)
+	}
+	err = u.Write(layout.Address, layout.Image)
+	if err != nil {
+		t.Fatalf("Failed to write shared data: %s", err)
+	}
+	for _, res := range programs {
+		err = u.LoadBinaryAt(res.Binary, res.Compiler.LoadAddress)
+		if err != nil {
+			t.Fatalf("Failed to load: %s", err)
+		}
+		for i := 0; !u.Wake; i++ {
+			if i > 100 {
+				t.Fatalf("Program did not wake")
+			}
+			if err = u.Tick(); err != nil {
+				t.Fatalf("Failed to run: %s", err)
+			}
+		}
+	}
+	if counter, mode := u.Memory[0]&0xFFFF, u.Memory[1]&0xFFFF; counter != 12 || mode != 1 {
+		t.Errorf("Expected counter 12 and mode 1 got %d and %d", counter, mode)
+	}
+
+	errors := []struct {
+		name    string
+		shared  []Source
+		program []Source
+		opts    Options
+		err     string
+	}{
+		{
+			name:   "code in shared data",
+			shared: []Source{{Name: "code.S", Content: []byte("wake\n")}},
+			err:    "shared data cannot contain code",
+		},
+		{
+			name:    "redefined",
+			program: []Source{{Name: "bad.S", Content: []byte("counter:\n\twake\n")}},
+			opts:    opts,
+			err:     "bad.S:1:1: got \"counter\", label is already defined in the shared data",
+		},
+		{
+			name:    "overlap",
+			program: sensing,
+			opts:    Options{ReservedBytes: reserved, Shared: layout, LoadAddress: 2},
+			err:     "must be after the shared data ending at word 3",
+		},
+	}
+	for _, tt := range errors {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.shared != nil {
+				_, err = BuildShared(ctx, tt.shared, tt.opts)
+			} else {
+				_, err = Build(ctx, tt.program, tt.opts)
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Expected error containing %q got %v", tt.err, err)
+			}
+		})
+	}
+}
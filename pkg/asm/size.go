@@ -0,0 +1,268 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+// SizeSymbol is the size of a function or data object.
+type SizeSymbol struct {
+	Name    string `json:"name"`
+	Section string `json:"section"`
+	Address int    `json:"address"` // byte address
+	Size    int    `json:"size"`    // size in bytes
+}
+
+// SizeReport is the size of every function and data object in a program.
+type SizeReport struct {
+	Reserved int          `json:"reserved"` // bytes reserved for the ULP
+	Used     int          `json:"used"`     // bytes used by every symbol
+	Stack    int          `json:"stack"`    // bytes left for the stack, 0 if unknown
+	Note     string       `json:"note,omitempty"`
+	Symbols  []SizeSymbol `json:"symbols"` // sorted largest first
+}
+
+// SizeReport finds the size of each function and data object.
+// A symbol starts at a label and continues until the next label in
+// the same section. Labels of the form "name.part" are part of
+// "name" if it exists, such as loops within a function.
+// Must be called after compiling.
+func (c *Compiler) SizeReport(reserved int) SizeReport {
+	symbols := make([]SizeSymbol, 0)
+	for _, n := range c.namedSections() {
+		if n.section == &c.Stack || n.section == &c.SharedData {
+			continue // nothing is placed in the stack, shared data is not part of the program
+		}
+		symbols = append(symbols, c.sectionSymbols(n.name, n.section)...)
+	}
+	r := newSizeReport(symbols, reserved)
+	r.Stack = c.Stack.Size
+	return r
+}
+
+// sectionSymbols splits a section into symbols.
+func (c *Compiler) sectionSymbols(name string, section *Section) []SizeSymbol {
+	extents := c.labelExtents(section)
+	symbols := make([]SizeSymbol, 0)
+	if len(extents) == 0 || extents[0].label.Value != section.Offset {
+		// unlabelled code at the start of the section
+		end := section.Offset + section.Size
+		if len(extents) != 0 {
+			end = extents[0].label.Value
+		}
+		symbols = append(symbols, SizeSymbol{
+			Name:    fmt.Sprintf("(%s)", name),
+			Section: name,
+			Address: section.Offset,
+			Size:    end - section.Offset,
+		})
+	}
+	for _, e := range extents {
+		if e.sub {
+			continue
+		}
+		symbols = append(symbols, SizeSymbol{
+			Name:    sourceName(e.label.Name),
+			Section: name,
+			Address: e.label.Value,
+			Size:    e.end - e.label.Value,
+		})
+	}
+	filtered := symbols[:0]
+	for _, s := range symbols {
+		if s.Size > 0 {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// labelExtent is the bytes of a section belonging to a label.
+type labelExtent struct {
+	label *Label
+	end   int  // byte address after the label
+	sub   bool // part of another label, see isSubLabel
+}
+
+// labelExtents finds the extent of every label of a section, sorted by
+// address then name. A label continues until the next label that is not
+// part of it, such as "func" continuing past "func.loop", or the end of
+// the section. This is shared by the size report and the symbol table.
+func (c *Compiler) labelExtents(section *Section) []labelExtent {
+	labels := make([]*Label, 0)
+	for _, l := range c.Labels {
+		if l.section == section {
+			labels = append(labels, l)
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].Value != labels[j].Value {
+			return labels[i].Value < labels[j].Value
+		}
+		return labels[i].Name < labels[j].Name
+	})
+	extents := make([]labelExtent, len(labels))
+	for i, l := range labels {
+		end := section.Offset + section.Size
+		for _, after := range labels[i+1:] {
+			if !isPartOf(after, l) {
+				end = after.Value
+				break
+			}
+		}
+		extents[i] = labelExtent{l, max(end, l.Value), c.isSubLabel(l)}
+	}
+	return extents
+}
+
+// isPartOf returns true if label `l` is part of `parent`,
+// such as "func.loop.1" being part of "func".
+func isPartOf(l *Label, parent *Label) bool {
+	return l.section == parent.section && strings.HasPrefix(l.Name, parent.Name+".")
+}
+
+// isSubLabel returns true if a label is part of another label in
+// the same section, such as "func.loop" being part of "func".
+func (c *Compiler) isSubLabel(l *Label) bool {
+	name := l.Name
+	for {
+		i := strings.LastIndex(name, ".")
+		if i <= 0 {
+			return false
+		}
+		name = name[:i]
+		parent, ok := c.Labels[name]
+		if ok && isPartOf(l, parent) {
+			return true
+		}
+	}
+}
+
+// BinarySizeReport finds the size of each section of a built binary.
+// The header's .bss size also holds the stack so the two cannot be
+// told apart. They are left out of the symbols and described by the
+// note instead.
+func BinarySizeReport(bin []byte, reserved int) (SizeReport, error) {
+	h, err := emu.ParseHeader(bin)
+	if err != nil {
+		return SizeReport{}, err
+	}
+	symbols := []SizeSymbol{
+		{Name: ".text", Section: ".text", Address: 0, Size: h.TextSize},
+		{Name: ".data", Section: ".data", Address: h.TextSize, Size: h.DataSize},
+	}
+	r := newSizeReport(symbols, reserved)
+	r.Note = fmt.Sprintf("the binary does not separate .bss from the stack, %d bytes of .bss and stack are not counted", h.BssSize)
+	return r, nil
+}
+
+func newSizeReport(symbols []SizeSymbol, reserved int) SizeReport {
+	used := 0
+	for _, s := range symbols {
+		used += s.Size
+	}
+	sort.SliceStable(symbols, func(i, j int) bool {
+		if symbols[i].Size != symbols[j].Size {
+			return symbols[i].Size > symbols[j].Size
+		}
+		return symbols[i].Name < symbols[j].Name
+	})
+	return SizeReport{
+		Reserved: reserved,
+		Used:     used,
+		Symbols:  symbols,
+	}
+}
+
+// percent returns the share of the reserved memory used by `size` bytes.
+func (r SizeReport) percent(size int) string {
+	if r.Reserved <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(size)/float64(r.Reserved))
+}
+
+func (r SizeReport) String() string {
+	return r.Compare(nil)
+}
+
+// Compare formats the report with the growth of each symbol since
+// a previous report. If `prev` is nil then growth is not shown.
+func (r SizeReport) Compare(prev *SizeReport) string {
+	type row struct {
+		name, section, size, share, change string
+	}
+	rows := []row{{"symbol", "section", "bytes", "reserved", "change"}}
+	previous := make(map[string]int)
+	if prev != nil {
+		for _, s := range prev.Symbols {
+			previous[s.Section+" "+s.Name] = s.Size
+		}
+	}
+	for _, s := range r.Symbols {
+		change := ""
+		if prev != nil {
+			key := s.Section + " " + s.Name
+			old, ok := previous[key]
+			if ok {
+				change = formatChange(s.Size - old)
+				delete(previous, key)
+			} else {
+				change = "new"
+			}
+		}
+		rows = append(rows, row{s.Name, s.Section, fmt.Sprint(s.Size), r.percent(s.Size), change})
+	}
+	if prev != nil {
+		// symbols that no longer exist
+		for _, s := range prev.Symbols {
+			if _, ok := previous[s.Section+" "+s.Name]; ok {
+				rows = append(rows, row{s.Name, s.Section, "0", r.percent(0), "removed"})
+			}
+		}
+	}
+
+	widths := [4]int{}
+	for _, rw := range rows {
+		widths[0] = max(widths[0], len(rw.name))
+		widths[1] = max(widths[1], len(rw.section))
+		widths[2] = max(widths[2], len(rw.size))
+		widths[3] = max(widths[3], len(rw.share))
+	}
+	s := ""
+	for _, rw := range rows {
+		line := fmt.Sprintf("%-*s %-*s %*s %*s", widths[0], rw.name, widths[1], rw.section, widths[2], rw.size, widths[3], rw.share)
+		if prev != nil {
+			line += " " + rw.change
+		}
+		s += line + "\n"
+	}
+	s += fmt.Sprintf("total %d of %d reserved bytes (%s)", r.Used, r.Reserved, r.percent(r.Used))
+	if prev != nil {
+		s += fmt.Sprintf(", %s since previous", formatChange(r.Used-prev.Used))
+	}
+	if r.Stack > 0 {
+		s += fmt.Sprintf("\nstack %d bytes (%s)", r.Stack, r.percent(r.Stack))
+	}
+	if r.Note != "" {
+		s += "\nnote: " + r.Note
+	}
+	return s
+}
+
+func formatChange(diff int) string {
+	if diff > 0 {
+		return fmt.Sprintf("+%d", diff)
+	}
+	return fmt.Sprint(diff)
+}
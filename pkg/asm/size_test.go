@@ -0,0 +1,86 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSizeReport(t *testing.T) {
+	asm := `
+	.boot
+	move r0, 0
+entry:
+	call func
+	halt
+	.text
+func:
+	move r0, 1
+func.loop:
+	jumpr func.loop, 10, lt
+	jump r2
+	.data
+a: .int 1
+b:
+c: .int 1, 2, 3
+	.bss
+d: .int 0
+	`
+	a := Assembler{}
+	bin, err := a.BuildFile(asm, "test.S", 8176, false)
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	got := a.Compiler.SizeReport(8176)
+	expect := SizeReport{
+		Reserved: 8176,
+		Used:     48,
+		Stack:    8128,
+		Symbols: []SizeSymbol{
+			{Name: "c", Section: ".data", Address: 32, Size: 12},
+			{Name: "entry", Section: ".boot", Address: 4, Size: 12},
+			{Name: "func", Section: ".text", Address: 16, Size: 12},
+			{Name: "(.boot)", Section: ".boot", Address: 0, Size: 4},
+			{Name: "a", Section: ".data", Address: 28, Size: 4},
+			{Name: "d", Section: ".bss", Address: 44, Size: 4},
+		},
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("expected %#v got %#v", expect, got)
+	}
+
+	fromBin, err := BinarySizeReport(bin, 8176)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromBin.Used != 44 || len(fromBin.Symbols) != 2 || fromBin.Stack != 0 {
+		t.Errorf("unexpected binary report %+v", fromBin)
+	}
+	if !strings.Contains(fromBin.String(), "8132 bytes of .bss and stack") {
+		t.Errorf("expected the stack to be explained:\n%s", fromBin)
+	}
+	_, err = BinarySizeReport(bin[:8], 8176)
+	if err == nil {
+		t.Errorf("expected an error from a short binary")
+	}
+
+	prev := got
+	prev.Used = 40
+	prev.Symbols = []SizeSymbol{
+		{Name: "c", Section: ".data", Size: 8},
+		{Name: "gone", Section: ".data", Size: 4},
+	}
+	compared := got.Compare(&prev)
+	for _, s := range []string{"+4", "new", "removed", "+8 since previous"} {
+		if !strings.Contains(compared, s) {
+			t.Errorf("expected \"%s\" in comparison:\n%s", s, compared)
+		}
+	}
+}
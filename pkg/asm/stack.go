@@ -0,0 +1,213 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Molorius/ulp-c/pkg/asm/token"
+)
+
+// StackFunction is the worst case stack depth of a single function,
+// including every function it calls.
+type StackFunction struct {
+	Name    string
+	Address int // word address of the function
+	Depth   int // worst case depth in bytes
+}
+
+// StackReport is the result of the static stack analysis.
+type StackReport struct {
+	Bounded   bool   // if the worst case depth could be found
+	Reason    string // why the depth could not be bounded
+	Depth     int    // worst case depth in bytes from the entry point
+	Available int    // bytes available between the initial stack pointer and __stack_start
+	Functions []StackFunction
+}
+
+// Overflows returns true if the stack is known to grow past the available space.
+func (r StackReport) Overflows() bool {
+	return r.Bounded && r.Depth > r.Available
+}
+
+func (r StackReport) String() string {
+	s := ""
+	if len(r.Functions) > 0 {
+		width := len("function")
+		for _, f := range r.Functions {
+			width = max(width, len(f.Name))
+		}
+		s += fmt.Sprintf("%-*s %s\n", width, "function", "stack")
+		for _, f := range r.Functions {
+			s += fmt.Sprintf("%-*s %d\n", width, f.Name, f.Depth)
+		}
+	}
+	if !r.Bounded {
+		return s + fmt.Sprintf("stack depth could not be bounded: %s", r.Reason)
+	}
+	s += fmt.Sprintf("worst case stack depth %d of %d available bytes", r.Depth, r.Available)
+	if r.Overflows() {
+		s += fmt.Sprintf(", overflowing by %d bytes", r.Depth-r.Available)
+	}
+	return s
+}
+
+type stackAnalyzer struct {
+	g       *flowGraph
+	depths  map[int]int  // memoized worst case depth of each function, in words
+	active  map[int]bool // functions currently being analyzed, to find recursion
+	initial int          // initial stack pointer as a word address, -1 if not set
+}
+
+// StackReport walks every call from the entry point at "__boot_start"
+// and every "sub r3, r3, N" / "add r3, r3, N" to find the worst case
+// stack depth. Must be called after compiling.
+func (c *Compiler) StackReport() StackReport {
+	a := stackAnalyzer{
+		g:       c.flowGraph(),
+		depths:  make(map[int]int),
+		active:  make(map[int]bool),
+		initial: -1,
+	}
+	stackStart := c.Labels["__stack_start"].Value / 4
+	stackEnd := c.Labels["__stack_end"].Value / 4
+	report := StackReport{}
+
+	depth, err := a.function(a.g.start, true)
+	if a.initial < 0 {
+		a.initial = stackEnd
+	}
+	report.Available = (a.initial - stackStart) * 4
+	for addr, d := range a.depths {
+		if addr == a.g.start {
+			continue
+		}
+		report.Functions = append(report.Functions, StackFunction{
+			Name:    a.g.describe(addr),
+			Address: addr,
+			Depth:   d * 4,
+		})
+	}
+	sort.Slice(report.Functions, func(i, j int) bool {
+		return report.Functions[i].Address < report.Functions[j].Address
+	})
+	if err != nil {
+		report.Reason = err.Error()
+		return report
+	}
+	report.Bounded = true
+	report.Depth = depth * 4
+	return report
+}
+
+// function finds the worst case depth, in words, of the function at word address `entry`.
+func (a *stackAnalyzer) function(entry int, isEntry bool) (int, error) {
+	if d, ok := a.depths[entry]; ok {
+		return d, nil
+	}
+	if a.active[entry] {
+		return 0, fmt.Errorf("recursive call to %s", a.g.describe(entry))
+	}
+	a.active[entry] = true
+	defer delete(a.active, entry)
+
+	type state struct {
+		addr  int
+		depth int
+	}
+	seen := make(map[int]int) // address to the depth when it was reached
+	work := []state{{entry, 0}}
+	worst := 0
+	for len(work) > 0 {
+		s := work[len(work)-1]
+		work = work[:len(work)-1]
+		if d, ok := seen[s.addr]; ok {
+			if d != s.depth {
+				return 0, fmt.Errorf("stack depth at %s is reached with both %d and %d words, is it changed in a loop?",
+					a.g.describe(s.addr), d, s.depth)
+			}
+			continue
+		}
+		seen[s.addr] = s.depth
+
+		d, err := a.g.instr(s.addr)
+		if err != nil {
+			return 0, err
+		}
+		depth, peak, err := a.adjust(d, s.addr, s.depth, isEntry)
+		if err != nil {
+			return 0, err
+		}
+		worst = max(worst, peak)
+
+		f, err := a.g.flow(s.addr)
+		if err != nil {
+			return 0, err
+		}
+		switch f.Kind {
+		case flowNext:
+			work = append(work, state{s.addr + 1, depth})
+		case flowBranch:
+			work = append(work, state{s.addr + 1, depth}, state{f.Target, depth})
+		case flowJump:
+			work = append(work, state{f.Target, depth})
+		case flowCall:
+			callee, err := a.function(f.Target, false)
+			if err != nil {
+				return 0, err
+			}
+			worst = max(worst, depth+callee)
+			work = append(work, state{f.Return, depth})
+		case flowReturn, flowHalt:
+		case flowIndirect:
+			return 0, fmt.Errorf("indirect jump at %s", a.g.describe(s.addr))
+		case flowIndirectCall:
+			return 0, fmt.Errorf("indirect call at %s", a.g.describe(s.addr))
+		}
+	}
+	a.depths[entry] = worst
+	return worst, nil
+}
+
+// adjust applies the stack effects of an instruction.
+// Returns the new depth and the peak depth used by the instruction.
+func (a *stackAnalyzer) adjust(d Decoded, addr int, depth int, isEntry bool) (int, int, error) {
+	switch d.TokenType {
+	case token.St, token.Ld:
+		// accessing below the stack pointer still uses the stack
+		if d.Rsrc1 == 3 && d.Imm < 0 {
+			return depth, depth - d.Imm, nil
+		}
+		return depth, depth, nil
+	case token.Add, token.Sub, token.And, token.Or, token.Lsh, token.Rsh, token.Move:
+	default:
+		return depth, depth, nil
+	}
+	if d.Rdst != 3 {
+		return depth, depth, nil
+	}
+	switch {
+	case d.TokenType == token.Sub && d.Rsrc1 == 3 && !d.IsReg:
+		depth += d.Imm
+	case d.TokenType == token.Add && d.Rsrc1 == 3 && !d.IsReg:
+		depth -= d.Imm
+	case d.TokenType == token.Move && !d.IsReg && isEntry:
+		// the entry point sets up the stack pointer
+		if a.initial >= 0 && a.initial != d.Imm {
+			return 0, 0, fmt.Errorf("stack pointer set to both %d and %d", a.initial, d.Imm)
+		}
+		a.initial = d.Imm
+		depth = 0
+	default:
+		return 0, 0, fmt.Errorf("stack pointer changed by \"%s\" at %s",
+			strings.TrimSpace(d.Disassemble(addr)), a.g.describe(addr))
+	}
+	return depth, depth, nil
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStackReport(t *testing.T) {
+	tests := []struct {
+		name     string
+		asm      string
+		reserved int
+		bounded  bool
+		reason   string // part of the reason when not bounded
+		depth    int
+		overflow bool
+	}{
+		{
+			name:     "test prelude",
+			asm:      TEST_PRELUDE + TEST_POSTLUDE,
+			reserved: 8176,
+			bounded:  true,
+			depth:    5 * 4, // done() + send_esp() + ulp_mutex_take()
+		},
+		{
+			name: "nested calls",
+			asm: `
+			.boot
+			move r3, __stack_end
+			call a
+			halt
+		a:
+			sub r3, r3, 2
+			st r2, r3, 0
+			call b
+			ld r2, r3, 0
+			add r3, r3, 2
+			jump r2
+		b:
+			sub r3, r3, 3
+			add r3, r3, 3
+			jump r2
+			`,
+			reserved: 8176,
+			bounded:  true,
+			depth:    5 * 4,
+		},
+		{
+			name: "overflow",
+			asm: `
+			.boot
+			move r3, __stack_end
+			sub r3, r3, 20
+			add r3, r3, 20
+			halt
+			`,
+			reserved: 4*4 + 10*4,
+			bounded:  true,
+			depth:    20 * 4,
+			overflow: true,
+		},
+		{
+			name: "recursion",
+			asm: `
+			.boot
+			call a
+			halt
+		a:
+			sub r3, r3, 1
+			st r2, r3, 0
+			call a
+			ld r2, r3, 0
+			add r3, r3, 1
+			jump r2
+			`,
+			reserved: 8176,
+			reason:   "recursive call to a",
+		},
+		{
+			name: "indirect call",
+			asm: `
+			.boot
+			move r0, a
+			call r0
+			halt
+		a:
+			jump r2
+			`,
+			reserved: 8176,
+			reason:   "indirect call",
+		},
+		{
+			name: "pointer in r2",
+			asm: `
+			.boot
+			move r2, buffer
+			jump handler
+		handler:
+			sub r3, r3, 2
+			ld r0, r2, 0
+			add r3, r3, 2
+			halt
+			.data
+		buffer: .int 0
+			`,
+			reserved: 8176,
+			bounded:  true,
+			depth:    2 * 4,
+		},
+		{
+			name: "growing loop",
+			asm: `
+			.boot
+		loop:
+			sub r3, r3, 1
+			jump loop
+			`,
+			reserved: 8176,
+			reason:   "changed in a loop",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := Assembler{}
+			_, err := a.BuildFile(tt.asm, "test.S", tt.reserved, false)
+			if err != nil {
+				t.Fatalf("Failed to compile: %s", err)
+			}
+			report := a.Compiler.StackReport()
+			if report.Bounded != tt.bounded {
+				t.Fatalf("expected bounded %v got %v: %s", tt.bounded, report.Bounded, report.Reason)
+			}
+			if !tt.bounded {
+				if !strings.Contains(report.Reason, tt.reason) {
+					t.Errorf("expected reason containing \"%s\" got \"%s\"", tt.reason, report.Reason)
+				}
+				return
+			}
+			if report.Depth != tt.depth {
+				t.Errorf("expected depth %d got %d", tt.depth, report.Depth)
+			}
+			if report.Overflows() != tt.overflow {
+				t.Errorf("expected overflow %v got %v: %s", tt.overflow, report.Overflows(), report)
+			}
+		})
+	}
+}
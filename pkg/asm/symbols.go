@@ -0,0 +1,62 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"encoding/json"
+
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+// SymbolTable describes a built program for host tools,
+// such as reading variables from RTC memory by name.
+type SymbolTable struct {
+	Header   *emu.Header   `json:"header,omitempty"` // nil if the program is not a binary
+	Shared   *SharedLayout `json:"shared,omitempty"` // the data shared with other programs, if any
+	Sections []SectionInfo `json:"sections"`         // in memory order
+	Symbols  []Symbol      `json:"symbols"`          // sorted by address
+}
+
+// SymbolTable returns every label and section of the program along with
+// the header of `bin`, the binary built by the compiler.
+// Must be called after compiling.
+func (c *Compiler) SymbolTable(bin []byte) SymbolTable {
+	t := SymbolTable{
+		Shared:   c.Shared,
+		Sections: c.SectionInfo(),
+		Symbols:  c.Symbols(),
+	}
+	if h, err := emu.ParseHeader(bin); err == nil {
+		t.Header = &h
+	}
+	return t
+}
+
+// JSON returns the symbol table as indented JSON.
+func (t SymbolTable) JSON() ([]byte, error) {
+	return json.MarshalIndent(t, "", "  ")
+}
+
+// ParseSymbolTable reads a symbol table written by JSON().
+func ParseSymbolTable(data []byte) (SymbolTable, error) {
+	t := SymbolTable{}
+	err := json.Unmarshal(data, &t)
+	return t, err
+}
+
+// labelSizes finds the size in bytes of each label with a section,
+// see labelExtents.
+func (c *Compiler) labelSizes() map[string]int {
+	sizes := make(map[string]int)
+	for _, n := range c.namedSections() {
+		for _, e := range c.labelExtents(n.section) {
+			sizes[e.label.Name] = e.end - e.label.Value
+		}
+	}
+	return sizes
+}
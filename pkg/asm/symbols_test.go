@@ -0,0 +1,67 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSymbolTable(t *testing.T) {
+	src := `
+		.boot
+		.global entry
+	entry:
+		move r0, 1
+	entry.loop:
+		jump entry.loop
+	after:
+		halt
+		.data
+	value: .int 0, 1
+	`
+	res, err := Build(context.Background(), []Source{{Name: "test.S", Content: []byte(src)}}, Options{})
+	if err != nil {
+		t.Fatalf("Failed to build: %s", err)
+	}
+	b, err := res.Compiler.SymbolTable(res.Binary).JSON()
+	if err != nil {
+		t.Fatalf("Failed to encode: %s", err)
+	}
+	table, err := ParseSymbolTable(b)
+	if err != nil {
+		t.Fatalf("Failed to decode: %s", err)
+	}
+
+	if table.Header == nil || table.Header.TextSize != 12 || table.Header.DataSize != 8 {
+		t.Errorf("Unexpected header %+v", table.Header)
+	}
+	if len(table.Sections) != 6 || table.Sections[3].Name != ".data" || table.Sections[3].Address != 12 {
+		t.Errorf("Unexpected sections %+v", table.Sections)
+	}
+	tests := []Symbol{
+		{Name: "entry", Address: 0, Section: ".boot", Global: true, Binding: "default", Size: 8},
+		{Name: "entry.loop", Address: 1, Section: ".boot", Binding: "default", Size: 4},
+		{Name: "after", Address: 2, Section: ".boot", Binding: "default", Size: 4},
+		{Name: "value", Address: 3, Section: ".data", Binding: "default", Size: 8},
+		{Name: "__data_start", Address: 3, Binding: "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			for _, s := range table.Symbols {
+				if s.Name == tt.Name {
+					if s != tt {
+						t.Errorf("Expected %+v, got %+v", tt, s)
+					}
+					return
+				}
+			}
+			t.Errorf("Symbol %s not found", tt.Name)
+		})
+	}
+}
@@ -0,0 +1,320 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+// CycleRange is the best and worst case number of cycles.
+type CycleRange struct {
+	Best  uint64
+	Worst uint64
+}
+
+func (r CycleRange) String() string {
+	return fmt.Sprintf("%d-%d cycles", r.Best, r.Worst)
+}
+
+func (r CycleRange) add(other CycleRange) CycleRange {
+	return CycleRange{r.Best + other.Best, r.Worst + other.Worst}
+}
+
+// FunctionCycles is the best and worst case number of cycles for a function,
+// from its entry until it returns or halts. Includes every function it calls.
+type FunctionCycles struct {
+	Name    string
+	Address int // word address of the function
+	Cycles  CycleRange
+	Err     error // why the cycles could not be found
+}
+
+type CycleReport struct {
+	Functions []FunctionCycles
+}
+
+func (r CycleReport) String() string {
+	width := len("function")
+	for _, f := range r.Functions {
+		width = max(width, len(f.Name))
+	}
+	s := fmt.Sprintf("%-*s %10s %10s\n", width, "function", "best", "worst")
+	for _, f := range r.Functions {
+		if f.Err != nil {
+			s += fmt.Sprintf("%-*s %s\n", width, f.Name, f.Err)
+			continue
+		}
+		s += fmt.Sprintf("%-*s %10d %10d\n", width, f.Name, f.Cycles.Best, f.Cycles.Worst)
+	}
+	return strings.TrimSuffix(s, "\n")
+}
+
+type timingAnalyzer struct {
+	g      *flowGraph
+	bounds map[int]*loopBound
+	funcs  map[int]CycleRange
+	errs   map[int]error
+	active map[int]bool // functions currently being analyzed, to find recursion
+}
+
+func (c *Compiler) timingAnalyzer() *timingAnalyzer {
+	return &timingAnalyzer{
+		g:      c.flowGraph(),
+		bounds: c.bounds,
+		funcs:  make(map[int]CycleRange),
+		errs:   make(map[int]error),
+		active: make(map[int]bool),
+	}
+}
+
+// CycleReport finds the best and worst case cycles of the entry point and
+// every function that is called, using the same cycle costs as the emulator.
+// Loops must be limited with the .bound directive.
+// Must be called after compiling.
+func (c *Compiler) CycleReport() CycleReport {
+	a := c.timingAnalyzer()
+	entries := []int{a.g.start}
+	for addr := a.g.start; addr < a.g.end; addr++ {
+		f, err := a.g.flow(addr)
+		if err == nil && f.Kind == flowCall && !slices.Contains(entries, f.Target) {
+			entries = append(entries, f.Target)
+		}
+	}
+	sort.Ints(entries)
+
+	report := CycleReport{}
+	for _, entry := range entries {
+		cycles, err := a.function(entry)
+		report.Functions = append(report.Functions, FunctionCycles{
+			Name:    a.g.describe(entry),
+			Address: entry,
+			Cycles:  cycles,
+			Err:     err,
+		})
+	}
+	return report
+}
+
+// PathCycles finds the best and worst case cycles from label `from`
+// until label `to` is reached. Paths that return or halt before
+// reaching `to` are ignored. Must be called after compiling.
+func (c *Compiler) PathCycles(from string, to string) (CycleRange, error) {
+	start, ok := c.Labels[from]
+	if !ok {
+		return CycleRange{}, fmt.Errorf("unknown label \"%s\"", from)
+	}
+	end, ok := c.Labels[to]
+	if !ok {
+		return CycleRange{}, fmt.Errorf("unknown label \"%s\"", to)
+	}
+	return c.timingAnalyzer().path(start.Value/4, end.Value/4)
+}
+
+// function finds the cycles of the function at word address `entry`.
+func (a *timingAnalyzer) function(entry int) (CycleRange, error) {
+	if r, ok := a.funcs[entry]; ok {
+		return r, nil
+	}
+	if err, ok := a.errs[entry]; ok {
+		return CycleRange{}, err
+	}
+	if a.active[entry] {
+		return CycleRange{}, fmt.Errorf("recursive call to %s", a.g.describe(entry))
+	}
+	a.active[entry] = true
+	defer delete(a.active, entry)
+
+	r, err := a.path(entry, -1)
+	if err != nil {
+		a.errs[entry] = err
+		return CycleRange{}, err
+	}
+	a.funcs[entry] = r
+	return r, nil
+}
+
+// path finds the cycles from word address `from` to `to`.
+// If `to` is negative then the path ends at a return or halt.
+func (a *timingAnalyzer) path(from int, to int) (CycleRange, error) {
+	w := timingWalk{
+		a:      a,
+		to:     to,
+		memo:   make(map[string]timingResult),
+		onPath: make(map[string]bool),
+	}
+	r, err := w.walk(from, nil)
+	if err != nil {
+		return CycleRange{}, err
+	}
+	if !r.ok {
+		if to < 0 {
+			return CycleRange{}, fmt.Errorf("%s never returns", a.g.describe(from))
+		}
+		return CycleRange{}, fmt.Errorf("%s never reaches %s", a.g.describe(from), a.g.describe(to))
+	}
+	return r.cycles, nil
+}
+
+type timingResult struct {
+	cycles CycleRange
+	ok     bool // if any path reaches the end
+}
+
+// loopCount is the number of times a bounded loop has jumped backwards.
+type loopCount struct {
+	bound  *loopBound
+	target int // word address the loop jumps back to
+	count  int
+}
+
+type timingWalk struct {
+	a      *timingAnalyzer
+	to     int
+	memo   map[string]timingResult
+	onPath map[string]bool
+}
+
+func (w *timingWalk) key(addr int, counts []loopCount) string {
+	s := fmt.Sprintf("%d", addr)
+	for _, c := range counts {
+		s += fmt.Sprintf(" %d:%d", c.bound.Start, c.count)
+	}
+	return s
+}
+
+func (w *timingWalk) walk(addr int, counts []loopCount) (timingResult, error) {
+	if addr == w.to {
+		return timingResult{ok: true}, nil
+	}
+	// forget any loops that we have left
+	inside := make([]loopCount, 0, len(counts))
+	for _, c := range counts {
+		if addr >= c.target && addr < c.bound.End {
+			inside = append(inside, c)
+		}
+	}
+	counts = inside
+
+	key := w.key(addr, counts)
+	if r, ok := w.memo[key]; ok {
+		return r, nil
+	}
+	if w.onPath[key] {
+		return timingResult{}, fmt.Errorf("loop at %s needs a .bound", w.a.g.describe(addr))
+	}
+	w.onPath[key] = true
+	defer delete(w.onPath, key)
+
+	d, err := w.a.g.instr(addr)
+	if err != nil {
+		return timingResult{}, err
+	}
+	cost, err := w.a.g.c.cycles(d.Word)
+	if err != nil {
+		return timingResult{}, fmt.Errorf("%s: %s", w.a.g.describe(addr), err)
+	}
+	f, err := w.a.g.flow(addr)
+	if err != nil {
+		return timingResult{}, err
+	}
+
+	results := make([]timingResult, 0, 2)
+	add := func(r timingResult, err error) error {
+		results = append(results, r)
+		return err
+	}
+	switch f.Kind {
+	case flowNext:
+		err = add(w.walk(addr+1, counts))
+	case flowBranch:
+		err = add(w.walk(addr+1, counts))
+		if err == nil {
+			err = add(w.edge(addr, f.Target, counts))
+		}
+	case flowJump:
+		err = add(w.edge(addr, f.Target, counts))
+	case flowCall:
+		callee, e := w.a.function(f.Target)
+		if e != nil {
+			return timingResult{}, e
+		}
+		r, e := w.walk(f.Return, counts)
+		r.cycles = r.cycles.add(callee)
+		err = add(r, e)
+	case flowReturn, flowHalt:
+		results = append(results, timingResult{ok: w.to < 0})
+	case flowIndirect:
+		return timingResult{}, fmt.Errorf("indirect jump at %s", w.a.g.describe(addr))
+	case flowIndirectCall:
+		return timingResult{}, fmt.Errorf("indirect call at %s", w.a.g.describe(addr))
+	}
+	if err != nil {
+		return timingResult{}, err
+	}
+
+	out := timingResult{}
+	for _, r := range results {
+		if !r.ok {
+			continue
+		}
+		if !out.ok {
+			out = r
+			continue
+		}
+		out.cycles.Best = min(out.cycles.Best, r.cycles.Best)
+		out.cycles.Worst = max(out.cycles.Worst, r.cycles.Worst)
+	}
+	if out.ok {
+		out.cycles = out.cycles.add(CycleRange{cost, cost})
+	}
+	w.memo[key] = out
+	return out, nil
+}
+
+// edge follows a jump from `from` to `target`, counting bounded loops.
+func (w *timingWalk) edge(from int, target int, counts []loopCount) (timingResult, error) {
+	bound, ok := w.a.bounds[from]
+	if !ok || target > from {
+		return w.walk(target, counts)
+	}
+	next := make([]loopCount, 0, len(counts)+1)
+	found := false
+	for _, c := range counts {
+		if c.bound == bound {
+			found = true
+			if c.count >= bound.N {
+				return timingResult{}, nil // this loop is finished
+			}
+			c.count++
+		}
+		next = append(next, c)
+	}
+	if !found {
+		if bound.N == 0 {
+			return timingResult{}, nil
+		}
+		next = append(next, loopCount{bound: bound, target: target, count: 1})
+		sort.Slice(next, func(i, j int) bool {
+			return next[i].bound.Start < next[j].bound.Start
+		})
+	}
+	return w.walk(target, next)
+}
+
+// cycles returns the cycles of an instruction with the chosen Timing.
+func (c *Compiler) cycles(instr uint32) (uint64, error) {
+	if c.Timing == emu.TimingAccurate {
+		return emu.AccurateCycles(instr)
+	}
+	return emu.Cycles(instr)
+}
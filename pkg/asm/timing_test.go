@@ -0,0 +1,409 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package asm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+func TestCycleReport(t *testing.T) {
+	tests := []struct {
+		name   string
+		asm    string
+		fn     string // function to check
+		expect CycleRange
+		err    string // part of the error, if expected
+	}{
+		{
+			name: "straight",
+			asm: `
+			.boot
+		entry:
+			move r0, 1
+			wait 10
+			halt
+			`,
+			fn:     "entry",
+			expect: CycleRange{4 + 16 + 2, 4 + 16 + 2},
+		},
+		{
+			name: "branch",
+			asm: `
+			.boot
+		entry:
+			jump entry.wait, eq
+			halt
+		entry.wait:
+			wait 100
+			halt
+			`,
+			fn:     "entry",
+			expect: CycleRange{4 + 2, 4 + 106 + 2},
+		},
+		{
+			name: "bounded loop",
+			asm: `
+			.boot
+		entry:
+			move r0, 0
+		entry.loop:
+			add r0, r0, 1
+			.bound 9
+			jumpr entry.loop, 10, lt
+			halt
+			`,
+			fn:     "entry",
+			expect: CycleRange{4 + 8 + 2, 4 + 10*8 + 2},
+		},
+		{
+			name: "bounded loop exit at top",
+			asm: `
+			.boot
+		entry:
+			stage_rst
+		entry.loop:
+			jumps entry.end, 5, ge
+			stage_inc 1
+			.bound 5
+			jump entry.loop
+		entry.end:
+			halt
+			`,
+			fn:     "entry",
+			expect: CycleRange{4 + 4 + 2, 4 + 6*4 + 5*8 + 2},
+		},
+		{
+			name: "nested loops",
+			asm: `
+			.boot
+		entry:
+			move r1, 0
+		entry.outer:
+			move r0, 0
+		entry.inner:
+			add r0, r0, 1
+			.bound 2
+			jumpr entry.inner, 3, lt
+			add r1, r1, 1
+			move r0, r1
+			.bound 3
+			jumpr entry.outer, 4, lt
+			halt
+			`,
+			fn: "entry",
+			// each outer iteration is 4 + (3 inner * 8) + 12
+			expect: CycleRange{4 + 4 + 8 + 12 + 2, 4 + 4*(4+3*8+12) + 2},
+		},
+		{
+			name: "function call",
+			asm: `
+			.boot
+		entry:
+			call f
+			call f
+			halt
+		f:
+			wait 10
+			jump r2
+			`,
+			fn:     "entry",
+			expect: CycleRange{2*(8+16+4) + 2, 2*(8+16+4) + 2},
+		},
+		{
+			name: "unbounded loop",
+			asm: `
+			.boot
+		entry:
+			add r0, r0, 1
+			jumpr entry, 10, lt
+			halt
+			`,
+			fn:  "entry",
+			err: "needs a .bound",
+		},
+		{
+			name: "indirect jump",
+			asm: `
+			.boot
+		entry:
+			jump r0
+			`,
+			fn:  "entry",
+			err: "indirect jump",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := Assembler{}
+			_, err := a.BuildFile(tt.asm, "test.S", 8176, false)
+			if err != nil {
+				t.Fatalf("Failed to compile: %s", err)
+			}
+			report := a.Compiler.CycleReport()
+			for _, f := range report.Functions {
+				if f.Name != tt.fn {
+					continue
+				}
+				if tt.err != "" {
+					if f.Err == nil || !strings.Contains(f.Err.Error(), tt.err) {
+						t.Errorf("expected error containing \"%s\" got %v", tt.err, f.Err)
+					}
+					return
+				}
+				if f.Err != nil {
+					t.Fatalf("unexpected error: %s", f.Err)
+				}
+				if f.Cycles != tt.expect {
+					t.Errorf("expected %s got %s", tt.expect, f.Cycles)
+				}
+				return
+			}
+			t.Fatalf("function %s not found in report:\n%s", tt.fn, report)
+		})
+	}
+}
+
+func TestPathCycles(t *testing.T) {
+	asm := `
+	.boot
+	move r0, 0
+start:
+	jumpr skip, 1, lt
+	wait 20
+skip:
+	move r1, 0
+end:
+	halt
+	`
+	a := Assembler{}
+	_, err := a.BuildFile(asm, "test.S", 8176, false)
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	got, err := a.Compiler.PathCycles("start", "end")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := CycleRange{4 + 4, 4 + 26 + 4}
+	if got != expect {
+		t.Errorf("expected %s got %s", expect, got)
+	}
+	_, err = a.Compiler.PathCycles("end", "start")
+	if err == nil {
+		t.Errorf("expected an error when the end is never reached")
+	}
+}
+
+func TestTimingRegion(t *testing.T) {
+	tests := []struct {
+		name   string
+		asm    string
+		reduce bool
+		timing emu.Timing
+		err    string // part of the error, if expected
+	}{
+		{
+			name: "in range",
+			asm: `
+			.boot
+		entry:
+			.timing 4, 20
+			jumpr entry.skip, 1, lt
+			wait 10
+		entry.skip:
+			.endtiming
+			halt
+			`,
+		},
+		{
+			name: "too slow",
+			asm: `
+			.boot
+		entry:
+			.timing 4, 16
+			jumpr entry.skip, 1, lt
+			wait 10
+		entry.skip:
+			.endtiming
+			halt
+			`,
+			err: "takes 4-20 cycles but expected 4 to 16 cycles",
+		},
+		{
+			name: "too fast",
+			asm: `
+			.boot
+		entry:
+			.timing 6, 30
+			jumpr entry.skip, 1, lt
+			wait 10
+		entry.skip:
+			.endtiming
+			halt
+			`,
+			err: "takes 4-20 cycles but expected 6 to 30 cycles",
+		},
+		{
+			name: "bounded loop",
+			asm: `
+			.boot
+		entry:
+			.timing 12, 84
+			move r0, 0
+		entry.loop:
+			add r0, r0, 1
+			.bound 9
+			jumpr entry.loop, 10, lt
+			.endtiming
+			halt
+			`,
+		},
+		{
+			name: "unbounded loop",
+			asm: `
+			.boot
+		entry:
+			.timing 0, 100
+		entry.loop:
+			jump entry.loop
+			.endtiming
+			halt
+			`,
+			err: "needs a .bound",
+		},
+		{
+			name:   "broken by reduce",
+			reduce: true,
+			asm: `
+			.boot
+		entry:
+			move r0, 1
+			move r1, 2
+			move r2, 3
+			jump end
+		other:
+			.timing 16, 16
+			move r0, 1
+			move r1, 2
+			move r2, 3
+			jump end
+		end:
+			.endtiming
+			halt
+			`,
+			err: "takes 20-20 cycles but expected 16 to 16 cycles",
+		},
+		{
+			name: "unchanged without reduce",
+			asm: `
+			.boot
+		entry:
+			move r0, 1
+			move r1, 2
+			move r2, 3
+			jump end
+		other:
+			.timing 16, 16
+			move r0, 1
+			move r1, 2
+			move r2, 3
+			jump end
+		end:
+			.endtiming
+			halt
+			`,
+		},
+		{
+			name:   "accurate",
+			timing: emu.TimingAccurate,
+			asm: `
+			.boot
+			.timing 30, 30
+			reg_wr 0x123, 1, 1, 1
+			move r0, 1
+			reg_wr 0x123, 1, 1, 0
+			.endtiming
+			halt
+			`,
+		},
+		{
+			name:   "estimate is not accurate",
+			timing: emu.TimingAccurate,
+			asm: `
+			.boot
+			.timing 28, 28
+			reg_wr 0x123, 1, 1, 1
+			move r0, 1
+			reg_wr 0x123, 1, 1, 0
+			.endtiming
+			halt
+			`,
+			err: "takes 30-30 cycles but expected 28 to 28 cycles",
+		},
+		{
+			name: "missing endtiming",
+			asm: `
+			.boot
+			.timing 0, 10
+			halt
+			`,
+			err: "expected an .endtiming",
+		},
+		{
+			name: "missing timing",
+			asm: `
+			.boot
+			halt
+			.endtiming
+			`,
+			err: ".endtiming without a .timing",
+		},
+		{
+			name: "nested",
+			asm: `
+			.boot
+			.timing 0, 10
+			.timing 0, 10
+			halt
+			.endtiming
+			.endtiming
+			`,
+			err: "cannot nest .timing",
+		},
+		{
+			name: "data section",
+			asm: `
+			.data
+			.timing 0, 10
+			.int 0
+			.endtiming
+			`,
+			err: ".timing must be in .boot or .text",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources := []Source{{Name: "test.S", Content: []byte(tt.asm)}}
+			opts := Options{ReservedBytes: 8176, Reduce: tt.reduce, Timing: tt.timing}
+			_, err := Build(context.Background(), sources, opts)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("Failed to compile: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing \"%s\" got %v", tt.err, err)
+			}
+		})
+	}
+}
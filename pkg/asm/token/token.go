@@ -7,6 +7,8 @@ file, You can obtain one at https://mozilla.org/MPL/2.0/.
 */
 package token
 
+import "sort"
+
 type Type int // the individual Type of each token
 
 const (
@@ -34,10 +36,17 @@ const (
 	__directive_start
 	// directives
 
-	Macro    // token for .macro
-	EndMacro // token for .endmacro
-	Global   // token for .global
-	Int      // token for .int
+	Macro     // token for .macro
+	EndMacro  // token for .endmacro
+	Global    // token for .global
+	Local     // token for .local
+	Weak      // token for .weak
+	Extern    // token for .extern
+	Int       // token for .int
+	Bound     // token for .bound
+	Timing    // token for .timing
+	EndTiming // token for .endtiming
+	Section   // token for .section
 
 	// sections
 
@@ -117,7 +126,14 @@ var toToken = map[string]Type{
 	".macro":     Macro,
 	".endmacro":  EndMacro,
 	".global":    Global,
+	".local":     Local,
+	".weak":      Weak,
+	".extern":    Extern,
 	".int":       Int,
+	".bound":     Bound,
+	".timing":    Timing,
+	".endtiming": EndTiming,
+	".section":   Section,
 	".":          Here,
 	".boot":      Boot,
 	".boot.data": BootData,
@@ -188,6 +204,19 @@ func (t Type) String() string {
 	}
 }
 
+// Types returns every type that has a fixed string, such as
+// instructions and registers, in order.
+func Types() []Type {
+	types := make([]Type, 0, len(toToken))
+	for _, t := range toToken {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i] < types[j]
+	})
+	return types
+}
+
 func ToType(str string) Type {
 	val, ok := toToken[str]
 	if ok {
@@ -203,6 +232,11 @@ func (t Type) IsDirective() bool {
 	return t > __directive_start && t < __directive_end
 }
 
+// IsSection returns true for the directives that switch section, such as .text.
+func (t Type) IsSection() bool {
+	return t >= Boot && t <= Bss
+}
+
 func (t Type) IsInstruction() bool {
 	return t > __instruction_start && t < __instruction_end
 }
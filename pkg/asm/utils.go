@@ -8,6 +8,7 @@ file, You can obtain one at https://mozilla.org/MPL/2.0/.
 package asm
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -109,9 +110,10 @@ send_esp.end:
 // }
     .text
 done:
-	sub r3, r3, 1 // increase stack
+	sub r3, r3, 2 // increase stack
 	move r0, 1 // set to DONE
 	st r0, r3, 0
+	st r0, r3, 1 // the parameter is not used but send_esp() reads it
 	call send_esp
     halt
 
@@ -157,6 +159,8 @@ type Runner struct {
 	ReservedBytes int           // the number of bytes reserved for the emulator
 	Reduce        bool          // should the assembler perform code reduction
 	Timeout       time.Duration // maximum time per test allowed
+	Check         bool          // fail the emulator test on memory safety violations
+	Coverage      *Coverage     // adds the coverage of each emulator test if not nil
 	Hardware      usb.Hardware  // the serial port (optional)
 }
 
@@ -184,18 +188,45 @@ func (r *Runner) SetDefaults() {
 	r.Timeout = 2 * time.Second
 }
 
+// RunTestWithHeader runs `asm` between TEST_PRELUDE and TEST_POSTLUDE.
+// With Coverage they are built as separate sources so their coverage is
+// merged between tests, while each test has its own source.
 func (r *Runner) RunTestWithHeader(t *testing.T, asm string, expect string) {
-	content := TEST_PRELUDE + asm + TEST_POSTLUDE
-	r.RunTest(t, content, expect)
+	if r.Coverage == nil {
+		content := TEST_PRELUDE + asm + TEST_POSTLUDE
+		r.RunTest(t, content, expect)
+		return
+	}
+	sources := []Source{
+		{Name: "prelude.S", Content: []byte(TEST_PRELUDE)},
+		{Name: r.sourceName(t), Content: []byte(asm)},
+		{Name: "postlude.S", Content: []byte(TEST_POSTLUDE)},
+	}
+	r.run(t, sources, expect)
 }
 
 func (r *Runner) RunTest(t *testing.T, asm string, expect string) {
+	name := r.AssemblyName
+	if r.Coverage != nil {
+		name = r.sourceName(t)
+	}
+	r.run(t, []Source{{Name: name, Content: []byte(asm)}}, expect)
+}
+
+// sourceName is the unique name of the source of a test with Coverage,
+// such as "TestAlu/add/test.S".
+func (r *Runner) sourceName(t *testing.T) string {
+	return t.Name() + "/" + r.AssemblyName
+}
+
+func (r *Runner) run(t *testing.T, sources []Source, expect string) {
 	// compile the binary
-	a := Assembler{}
-	bin, err := a.BuildFile(asm, r.AssemblyName, r.ReservedBytes, r.Reduce)
+	opts := Options{ReservedBytes: r.ReservedBytes, Reduce: r.Reduce}
+	res, err := Build(context.Background(), sources, opts)
 	if err != nil {
 		t.Fatalf("Failed to compile: %s", err)
 	}
+	bin := res.Binary
 
 	// run the test on hardware
 	t.Run("hardware", func(t *testing.T) {
@@ -219,10 +250,27 @@ func (r *Runner) RunTest(t *testing.T, asm string, expect string) {
 		if err != nil {
 			t.Fatalf("Loading binary failed: %s", err)
 		}
+		if r.Check {
+			u.Checker = res.Compiler.MemoryChecker()
+		}
+		if r.Coverage != nil {
+			u.Coverage = emu.NewCoverage()
+		}
 		got, err := u.RunWithSystem(maxCycles, t)
 		if err != nil {
 			t.Fatalf("Execution failed: %s", err)
 		}
+		if u.Checker != nil {
+			for _, v := range u.Checker.Violations {
+				t.Errorf("%s: %s", v.Kind, v)
+			}
+		}
+		if r.Coverage != nil {
+			r.Coverage.Add(res.Compiler, u.Coverage)
+			for _, src := range sources {
+				r.Coverage.AddSource(src.Name, src.Content)
+			}
+		}
 		if got != expect {
 			t.Errorf("expected \"%s\" got \"%s\"", expect, got)
 		}
@@ -72,3 +72,95 @@ func TestTheRunnerWithHeaders(t *testing.T) {
 		})
 	}
 }
+
+func TestTheRunnerWithChecks(t *testing.T) {
+	tests := []struct {
+		name   string
+		asm    string
+		expect string
+	}{
+		{
+			name:   "simple",
+			asm:    "",
+			expect: "",
+		},
+		{
+			name: "print_char",
+			asm: `
+			move r0, 65
+			st r0, r3, 0
+			call print_char
+			`,
+			expect: "A",
+		},
+	}
+	r := Runner{}
+	r.SetDefaults()
+	r.Check = true
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r.RunTestWithHeader(t, tt.asm, tt.expect)
+		})
+	}
+}
+
+func TestTheRunnerWithCoverage(t *testing.T) {
+	tests := []struct {
+		name   string
+		asm    string
+		expect string
+	}{
+		{
+			name: "print_u16",
+			asm: `
+			move r0, 123
+			st r0, r3, 0
+			call print_u16
+			`,
+			expect: "123 ",
+		},
+		{
+			name: "print_char",
+			asm: `
+			move r0, 65
+			st r0, r3, 0
+			call print_char
+			`,
+			expect: "A",
+		},
+	}
+	r := Runner{}
+	r.SetDefaults()
+	r.Coverage = NewCoverage()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r.RunTestWithHeader(t, tt.asm, tt.expect)
+		})
+	}
+
+	// each test has its own source, the prelude is merged
+	for _, tt := range tests {
+		name := t.Name() + "/" + tt.name + "/test.S"
+		l, ok := r.Coverage.Lines[name][2]
+		if !ok || l.Hits != 1 {
+			t.Errorf("Expected line 2 of %s to run once, got %+v", name, l)
+		}
+		if _, ok := r.Coverage.sources[name]; !ok {
+			t.Errorf("Expected the source of %s", name)
+		}
+	}
+	if _, ok := r.Coverage.Lines[""]; ok {
+		t.Errorf("Expected the jumps of reduction to not have lines")
+	}
+	for _, l := range r.Coverage.Labels() {
+		if l.Name == "main" && l.File == "prelude.S" {
+			t.Errorf("Expected main to start in the source of each test, got %+v", l)
+		}
+		if (l.Name == "print_u16" || l.Name == "print_char") && l.Covered != l.Instructions {
+			t.Errorf("Expected %s to be covered, got %+v", l.Name, l)
+		}
+		if l.Name == "done" && l.Hits != 2 {
+			t.Errorf("Expected done to run in both tests, got %+v", l)
+		}
+	}
+}
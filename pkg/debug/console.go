@@ -0,0 +1,298 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package debug
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// listContext is the number of instructions shown before and after the IP.
+const listContext = 4
+
+const help = `commands:
+  break|b loc         stop before the instruction at loc
+  delete|d loc        remove the breakpoint at loc
+  watch|w loc         stop after the word at loc changes
+  unwatch loc         remove the watchpoint at loc
+  info                list breakpoints and watchpoints
+  step|s [n]          execute n instructions, 1 by default
+  continue|c          run until a breakpoint, watchpoint or halt
+  regs|r              show the registers, flags and stage count
+  x loc [n]           show n words of memory, 1 by default
+  set loc|reg value   write the lower 16 bits of a word or a register
+  list|l [loc]        disassemble around loc, the IP by default
+  help|h              show this message
+  quit|q              exit
+a loc is an address, a symbol or a symbol with an offset such as "buffer+2"
+`
+
+// Console reads debugger commands and writes their results.
+type Console struct {
+	Debugger *Debugger
+	in       *bufio.Scanner
+	out      io.Writer
+}
+
+// NewConsole creates a console that reads commands from `in`
+// and writes to `out`, such as stdin and stdout.
+func NewConsole(d *Debugger, in io.Reader, out io.Writer) *Console {
+	return &Console{
+		Debugger: d,
+		in:       bufio.NewScanner(in),
+		out:      out,
+	}
+}
+
+// Run handles commands until quit or the input closes.
+// An empty line repeats the previous command.
+func (c *Console) Run() error {
+	previous := ""
+	for {
+		fmt.Fprint(c.out, "(ulp) ")
+		if !c.in.Scan() {
+			fmt.Fprintln(c.out)
+			return c.in.Err()
+		}
+		line := strings.TrimSpace(c.in.Text())
+		if line == "" {
+			line = previous
+		}
+		if line == "" {
+			continue
+		}
+		previous = line
+		quit, err := c.Execute(line)
+		if err != nil {
+			fmt.Fprintf(c.out, "error: %s\n", err)
+		}
+		if quit {
+			return nil
+		}
+	}
+}
+
+// Execute runs a single command, returning true if it was quit.
+func (c *Console) Execute(line string) (bool, error) {
+	d := c.Debugger
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false, nil
+	}
+	args := fields[1:]
+	switch fields[0] {
+	case "quit", "q":
+		return true, nil
+	case "help", "h":
+		fmt.Fprint(c.out, help)
+	case "break", "b":
+		addr, err := c.location(args)
+		if err != nil {
+			return false, err
+		}
+		err = d.SetBreakpoint(addr)
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(c.out, "breakpoint at 0x%04x %s\n", addr, d.Describe(addr))
+	case "delete", "d":
+		addr, err := c.location(args)
+		if err != nil {
+			return false, err
+		}
+		if !d.ClearBreakpoint(addr) {
+			return false, fmt.Errorf("no breakpoint at 0x%04x", addr)
+		}
+	case "watch", "w":
+		addr, err := c.location(args)
+		if err != nil {
+			return false, err
+		}
+		err = d.SetWatchpoint(addr)
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(c.out, "watchpoint at 0x%04x %s\n", addr, d.Describe(addr))
+	case "unwatch":
+		addr, err := c.location(args)
+		if err != nil {
+			return false, err
+		}
+		if !d.ClearWatchpoint(addr) {
+			return false, fmt.Errorf("no watchpoint at 0x%04x", addr)
+		}
+	case "info":
+		for _, addr := range d.Breakpoints() {
+			fmt.Fprintf(c.out, "breakpoint 0x%04x %s\n", addr, d.Describe(addr))
+		}
+		for _, addr := range d.Watchpoints() {
+			fmt.Fprintf(c.out, "watchpoint 0x%04x %s\n", addr, d.Describe(addr))
+		}
+	case "step", "s":
+		n := 1
+		if len(args) > 0 {
+			v, err := strconv.Atoi(args[0])
+			if err != nil || v < 1 {
+				return false, fmt.Errorf("invalid count \"%s\"", args[0])
+			}
+			n = v
+		}
+		for i := 0; i < n; i++ {
+			stop, err := d.Step()
+			if err != nil {
+				return false, err
+			}
+			if stop.Reason != ReasonStep || i == n-1 {
+				c.printStop(stop)
+				break
+			}
+		}
+	case "continue", "c":
+		stop, err := d.Continue()
+		if err != nil {
+			return false, err
+		}
+		c.printStop(stop)
+	case "regs", "r":
+		c.printRegisters()
+	case "x":
+		if len(args) == 0 {
+			return false, fmt.Errorf("expected a location")
+		}
+		addr, err := d.Resolve(args[0])
+		if err != nil {
+			return false, err
+		}
+		n := 1
+		if len(args) > 1 {
+			n, err = strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return false, fmt.Errorf("invalid count \"%s\"", args[1])
+			}
+		}
+		for i := addr; i < addr+n; i++ {
+			word, err := d.ReadWord(i)
+			if err != nil {
+				return false, err
+			}
+			fmt.Fprintf(c.out, "0x%04x %-16s 0x%08x %d\n", i, d.Describe(i), word, int16(word))
+		}
+	case "set":
+		if len(args) != 2 {
+			return false, fmt.Errorf("expected a location or register and a value")
+		}
+		v, err := strconv.ParseInt(args[1], 0, 32)
+		if err != nil || v < -0x8000 || v > 0xFFFF {
+			return false, fmt.Errorf("invalid value \"%s\"", args[1])
+		}
+		if c.setRegister(args[0], uint16(v)) {
+			return false, nil
+		}
+		addr, err := d.Resolve(args[0])
+		if err != nil {
+			return false, err
+		}
+		return false, d.WriteWord(addr, uint16(v))
+	case "list", "l":
+		addr := int(d.Emu.IP)
+		if len(args) > 0 {
+			var err error
+			addr, err = d.Resolve(args[0])
+			if err != nil {
+				return false, err
+			}
+		}
+		c.printList(addr)
+	default:
+		return false, fmt.Errorf("unknown command \"%s\", try help", fields[0])
+	}
+	return false, nil
+}
+
+// location resolves the only argument of a command.
+func (c *Console) location(args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("expected a location")
+	}
+	return c.Debugger.Resolve(args[0])
+}
+
+// setRegister sets a register by name, returning false if it is not one.
+func (c *Console) setRegister(name string, v uint16) bool {
+	u := c.Debugger.Emu
+	switch strings.ToLower(name) {
+	case "r0", "r1", "r2", "r3":
+		u.R[name[1]-'0'] = v
+	case "ip", "pc":
+		u.IP = v
+	case "stage", "sc":
+		u.SC = uint8(v)
+	default:
+		return false
+	}
+	return true
+}
+
+func (c *Console) printStop(stop Stop) {
+	d := c.Debugger
+	switch stop.Reason {
+	case ReasonWatchpoint:
+		fmt.Fprintf(c.out, "watchpoint 0x%04x %s: 0x%08x -> 0x%08x\n", stop.Addr, d.Describe(stop.Addr), stop.Old, stop.New)
+	case ReasonBreakpoint:
+		fmt.Fprintf(c.out, "breakpoint 0x%04x %s\n", stop.IP, d.Describe(int(stop.IP)))
+	case ReasonHalt:
+		fmt.Fprintf(c.out, "halted after %d cycles, the next step restarts at 0x%04x\n", d.Emu.Elapsed(), d.Emu.Entry)
+		return
+	case ReasonCycles:
+		fmt.Fprintf(c.out, "stopped after %d cycles\n", d.Emu.Elapsed())
+	}
+	c.printInstruction(int(stop.IP), true)
+}
+
+func (c *Console) printRegisters() {
+	u := c.Debugger.Emu
+	for i, r := range u.R {
+		fmt.Fprintf(c.out, "r%d    0x%04x %d\n", i, r, r)
+	}
+	fmt.Fprintf(c.out, "ip    0x%04x %s\n", u.IP, c.Debugger.Describe(int(u.IP)))
+	fmt.Fprintf(c.out, "stage %d\n", u.SC)
+	fmt.Fprintf(c.out, "flags zero=%v overflow=%v\n", u.Zero, u.Overflow)
+	fmt.Fprintf(c.out, "wake  %v halted=%v cycles=%d\n", u.Wake, u.Halted, u.Elapsed())
+}
+
+func (c *Console) printList(center int) {
+	u := c.Debugger.Emu
+	start := max(center-listContext, 0)
+	end := min(center+listContext+1, u.MemoryWords())
+	for addr := start; addr < end; addr++ {
+		for _, name := range c.Debugger.Labels(addr) {
+			fmt.Fprintf(c.out, "%s:\n", name)
+		}
+		c.printInstruction(addr, addr == int(u.IP))
+	}
+}
+
+func (c *Console) printInstruction(addr int, current bool) {
+	text, err := c.Debugger.Disassemble(addr)
+	if err != nil {
+		fmt.Fprintf(c.out, "error: %s\n", err)
+		return
+	}
+	marker := "  "
+	if current {
+		marker = "=>"
+	}
+	brk := " "
+	if c.Debugger.breakpoints[addr] {
+		brk = "*"
+	}
+	fmt.Fprintf(c.out, "%s%s0x%04x: %s\n", marker, brk, addr, text)
+}
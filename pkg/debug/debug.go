@@ -0,0 +1,310 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+
+// Package debug controls and inspects a program running in the emulator,
+// with breakpoints, watchpoints and the symbols of the build.
+package debug
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Molorius/ulp-c/pkg/asm"
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+// DefaultMaxCycles is how long Continue() runs without stopping.
+const DefaultMaxCycles = 100_000_000
+
+// Reason is why execution stopped.
+type Reason int
+
+const (
+	ReasonStep       Reason = iota // a single instruction was executed
+	ReasonBreakpoint               // the next instruction has a breakpoint
+	ReasonWatchpoint               // a watched word changed
+	ReasonHalt                     // the program halted
+	ReasonCycles                   // MaxCycles elapsed
+	ReasonInterrupt                // stopped from outside, such as by gdb
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonStep:
+		return "step"
+	case ReasonBreakpoint:
+		return "breakpoint"
+	case ReasonWatchpoint:
+		return "watchpoint"
+	case ReasonHalt:
+		return "halt"
+	case ReasonCycles:
+		return "cycles"
+	case ReasonInterrupt:
+		return "interrupt"
+	default:
+		return "unknown"
+	}
+}
+
+// Stop describes where and why execution stopped.
+type Stop struct {
+	Reason Reason
+	IP     uint16 // the next instruction
+	Addr   int    // the word that changed for ReasonWatchpoint
+	Old    uint32 // the value before a watchpoint
+	New    uint32 // the value after a watchpoint
+}
+
+// Debugger runs a program one instruction at a time.
+type Debugger struct {
+	Emu         *emu.UlpEmu
+	Symbols     []asm.Symbol // sorted by address
+	MaxCycles   uint64       // the cycles Continue() runs, DefaultMaxCycles if 0
+	breakpoints map[int]bool
+	watchpoints map[int]uint32 // the last value of each watched word
+}
+
+// New creates a debugger for a loaded emulator, `symbols` can be nil.
+func New(u *emu.UlpEmu, symbols []asm.Symbol) *Debugger {
+	s := append([]asm.Symbol(nil), symbols...)
+	sort.SliceStable(s, func(i, j int) bool {
+		return s[i].Address < s[j].Address
+	})
+	return &Debugger{
+		Emu:         u,
+		Symbols:     s,
+		breakpoints: make(map[int]bool),
+		watchpoints: make(map[int]uint32),
+	}
+}
+
+// Resolve converts a location to a word address. A location is a
+// number, a symbol or a symbol plus or minus a number of words,
+// such as "main", "0x10" or "buffer+2".
+func (d *Debugger) Resolve(loc string) (int, error) {
+	loc = strings.TrimSpace(loc)
+	offset := 0
+	if i := strings.LastIndexAny(loc, "+-"); i > 0 {
+		n, err := strconv.ParseInt(strings.TrimSpace(loc[i+1:]), 0, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid offset in \"%s\"", loc)
+		}
+		offset = int(n)
+		if loc[i] == '-' {
+			offset = -offset
+		}
+		loc = strings.TrimSpace(loc[:i])
+	}
+	if n, err := strconv.ParseInt(loc, 0, 32); err == nil {
+		return int(n) + offset, nil
+	}
+	for _, s := range d.Symbols {
+		if s.Name == loc && s.Binding != "local" {
+			return s.Address + offset, nil
+		}
+	}
+	for _, s := range d.Symbols {
+		if s.Name == loc {
+			return s.Address + offset, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown symbol \"%s\"", loc)
+}
+
+// Labels returns the names of the labels at a word address.
+func (d *Debugger) Labels(addr int) []string {
+	names := make([]string, 0)
+	for _, s := range d.Symbols {
+		if s.Address == addr && s.Section != "" {
+			names = append(names, s.Name)
+		}
+	}
+	return names
+}
+
+// Describe returns a word address as the nearest label at or before
+// it, such as "main+3", or as a number if there is none.
+func (d *Debugger) Describe(addr int) string {
+	best := -1
+	for i, s := range d.Symbols {
+		if s.Section == "" || s.Address > addr {
+			continue
+		}
+		if best == -1 || s.Address >= d.Symbols[best].Address {
+			best = i
+		}
+	}
+	if best == -1 {
+		return fmt.Sprintf("0x%04x", addr)
+	}
+	s := d.Symbols[best]
+	if s.Address == addr {
+		return s.Name
+	}
+	return fmt.Sprintf("%s+%d", s.Name, addr-s.Address)
+}
+
+func (d *Debugger) checkAddr(addr int) error {
+	if addr < 0 || addr >= d.Emu.MemoryWords() {
+		return fmt.Errorf("address %d is outside of the %d words of memory", addr, d.Emu.MemoryWords())
+	}
+	return nil
+}
+
+// SetBreakpoint stops execution before the instruction at a word address.
+func (d *Debugger) SetBreakpoint(addr int) error {
+	err := d.checkAddr(addr)
+	if err != nil {
+		return err
+	}
+	d.breakpoints[addr] = true
+	return nil
+}
+
+// ClearBreakpoint removes a breakpoint, returning false if there was none.
+func (d *Debugger) ClearBreakpoint(addr int) bool {
+	ok := d.breakpoints[addr]
+	delete(d.breakpoints, addr)
+	return ok
+}
+
+// Breakpoints returns the address of every breakpoint in order.
+func (d *Debugger) Breakpoints() []int {
+	return sortedKeys(d.breakpoints)
+}
+
+// SetWatchpoint stops execution after a memory word changes.
+func (d *Debugger) SetWatchpoint(addr int) error {
+	err := d.checkAddr(addr)
+	if err != nil {
+		return err
+	}
+	d.watchpoints[addr] = d.Emu.Memory[addr]
+	return nil
+}
+
+// ClearWatchpoint removes a watchpoint, returning false if there was none.
+func (d *Debugger) ClearWatchpoint(addr int) bool {
+	_, ok := d.watchpoints[addr]
+	delete(d.watchpoints, addr)
+	return ok
+}
+
+// Watchpoints returns the address of every watchpoint in order.
+func (d *Debugger) Watchpoints() []int {
+	return sortedKeys(d.watchpoints)
+}
+
+// Step executes a single instruction, or restarts a halted program.
+func (d *Debugger) Step() (Stop, error) {
+	err := d.Emu.Tick()
+	if err != nil {
+		return Stop{IP: d.Emu.IP}, err
+	}
+	if stop, ok := d.watched(); ok {
+		return stop, nil
+	}
+	if d.Emu.Halted {
+		return Stop{Reason: ReasonHalt, IP: d.Emu.IP}, nil
+	}
+	return Stop{Reason: ReasonStep, IP: d.Emu.IP}, nil
+}
+
+// Continue executes until a breakpoint, watchpoint, halt or MaxCycles.
+func (d *Debugger) Continue() (Stop, error) {
+	return d.ContinueFor(d.maxCycles())
+}
+
+// ContinueFor executes until a breakpoint, watchpoint, halt or until
+// `cycles` elapse, which stops with ReasonCycles.
+func (d *Debugger) ContinueFor(cycles uint64) (Stop, error) {
+	start := d.Emu.Elapsed()
+	for {
+		stop, err := d.Step()
+		if err != nil || stop.Reason != ReasonStep {
+			return stop, err
+		}
+		if d.breakpoints[int(d.Emu.IP)] {
+			return Stop{Reason: ReasonBreakpoint, IP: d.Emu.IP}, nil
+		}
+		if d.Emu.Elapsed()-start >= cycles {
+			return Stop{Reason: ReasonCycles, IP: d.Emu.IP}, nil
+		}
+	}
+}
+
+func (d *Debugger) maxCycles() uint64 {
+	if d.MaxCycles == 0 {
+		return DefaultMaxCycles
+	}
+	return d.MaxCycles
+}
+
+// watched checks each watchpoint for a change, updating its value.
+func (d *Debugger) watched() (Stop, bool) {
+	for _, addr := range d.Watchpoints() {
+		old := d.watchpoints[addr]
+		v := d.Emu.Memory[addr]
+		if v != old {
+			d.watchpoints[addr] = v
+			return Stop{Reason: ReasonWatchpoint, IP: d.Emu.IP, Addr: addr, Old: old, New: v}, true
+		}
+	}
+	return Stop{}, false
+}
+
+// ReadWord returns the word at an address.
+func (d *Debugger) ReadWord(addr int) (uint32, error) {
+	err := d.checkAddr(addr)
+	if err != nil {
+		return 0, err
+	}
+	return d.Emu.Memory[addr], nil
+}
+
+// WriteWord sets the lower 16 bits of a word, as st would,
+// keeping the upper bits.
+func (d *Debugger) WriteWord(addr int, value uint16) error {
+	err := d.checkAddr(addr)
+	if err != nil {
+		return err
+	}
+	d.Emu.Memory[addr] = (d.Emu.Memory[addr] &^ 0xFFFF) | uint32(value)
+	d.syncWatchpoints()
+	return nil
+}
+
+// syncWatchpoints takes the current value of each watched word,
+// so writes by the debugger are not reported as changes.
+func (d *Debugger) syncWatchpoints() {
+	for addr := range d.watchpoints {
+		d.watchpoints[addr] = d.Emu.Memory[addr]
+	}
+}
+
+// Disassemble returns the instruction at an address as assembly.
+func (d *Debugger) Disassemble(addr int) (string, error) {
+	word, err := d.ReadWord(addr)
+	if err != nil {
+		return "", err
+	}
+	decoded, _ := asm.Decode(word)
+	return decoded.Disassemble(addr), nil
+}
+
+func sortedKeys[V any](m map[int]V) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
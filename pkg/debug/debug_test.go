@@ -0,0 +1,192 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package debug
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Molorius/ulp-c/pkg/asm"
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+const program = `
+	.global entry
+entry:
+	move r2, 0
+	move r1, count
+loop:
+	ld r0, r1, 0
+	add r0, r0, 1
+	st r0, r1, 0
+	add r2, r2, 1
+	jumpr loop, 3, lt
+done:
+	halt
+	.data
+count: .int 0
+buffer: .int 1, 2, 3
+`
+
+// build assembles a program and creates a debugger for it.
+func build(t *testing.T, src string) *Debugger {
+	t.Helper()
+	sources := []asm.Source{{Name: "test.S", Content: []byte(src)}}
+	res, err := asm.Build(context.Background(), sources, asm.Options{ReservedBytes: 1024})
+	if err != nil {
+		t.Fatalf("Failed to build: %s", err)
+	}
+	u, err := emu.NewUlpEmu(1024)
+	if err != nil {
+		t.Fatalf("Failed to create emulator: %s", err)
+	}
+	err = u.LoadBinary(res.Binary)
+	if err != nil {
+		t.Fatalf("Failed to load: %s", err)
+	}
+	return New(u, res.Symbols)
+}
+
+func TestResolve(t *testing.T) {
+	d := build(t, program)
+	tests := []struct {
+		loc    string
+		expect int
+		err    bool
+	}{
+		{"entry", 0, false},
+		{"loop", 2, false},
+		{"count", 8, false},
+		{"buffer+2", 11, false},
+		{"buffer - 1", 8, false},
+		{"0x10", 16, false},
+		{"missing", 0, true},
+		{"count+x", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.loc, func(t *testing.T) {
+			addr, err := d.Resolve(tt.loc)
+			if (err != nil) != tt.err {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if addr != tt.expect {
+				t.Errorf("Expected %d got %d", tt.expect, addr)
+			}
+		})
+	}
+	if got := d.Describe(4); got != "loop+2" {
+		t.Errorf("Expected loop+2 got %s", got)
+	}
+}
+
+func TestDebugger(t *testing.T) {
+	d := build(t, program)
+	count, _ := d.Resolve("count")
+	done, _ := d.Resolve("done")
+	err := d.SetBreakpoint(2)
+	if err != nil {
+		t.Fatalf("Failed to set breakpoint: %s", err)
+	}
+	stop, err := d.Continue()
+	if err != nil || stop.Reason != ReasonBreakpoint || stop.IP != 2 {
+		t.Fatalf("Expected the breakpoint at 2, got %+v %v", stop, err)
+	}
+	// the breakpoint is hit on each loop
+	stop, err = d.Continue()
+	if err != nil || stop.Reason != ReasonBreakpoint || d.Emu.R[2] != 1 {
+		t.Fatalf("Expected the second loop, got %+v %v r2=%d", stop, err, d.Emu.R[2])
+	}
+	d.ClearBreakpoint(2)
+
+	err = d.SetWatchpoint(count)
+	if err != nil {
+		t.Fatalf("Failed to set watchpoint: %s", err)
+	}
+	stop, err = d.Continue()
+	if err != nil || stop.Reason != ReasonWatchpoint || stop.Addr != count || stop.New&0xFFFF != 2 {
+		t.Fatalf("Expected count to change to 2, got %+v %v", stop, err)
+	}
+	if stop.Old&0xFFFF != 1 {
+		t.Errorf("Expected the old value 1, got %d", stop.Old&0xFFFF)
+	}
+	d.ClearWatchpoint(count)
+
+	stop, err = d.Continue()
+	if err != nil || stop.Reason != ReasonHalt || stop.IP != uint16(done) {
+		t.Fatalf("Expected to halt at done, got %+v %v", stop, err)
+	}
+	// the next step restarts the program
+	stop, err = d.Step()
+	if err != nil || stop.Reason != ReasonStep || stop.IP != 0 || d.Emu.Runs != 2 {
+		t.Errorf("Expected to restart, got %+v %v", stop, err)
+	}
+
+	err = d.WriteWord(count, 0x1234)
+	if err != nil {
+		t.Fatalf("Failed to write: %s", err)
+	}
+	if word, _ := d.ReadWord(count); word&0xFFFF != 0x1234 {
+		t.Errorf("Expected 0x1234 got 0x%x", word)
+	}
+	if d.SetBreakpoint(1000) == nil {
+		t.Errorf("Expected an error for a breakpoint outside of memory")
+	}
+}
+
+func TestConsole(t *testing.T) {
+	d := build(t, program)
+	in := strings.Join([]string{
+		"break loop",
+		"c",
+		"s 2",
+		"",
+		"regs",
+		"set r3 0x42",
+		"set buffer+1 7",
+		"x buffer 3",
+		"watch count",
+		"d loop",
+		"info",
+		"c",
+		"list done",
+		"bogus",
+		"q",
+		"regs",
+	}, "\n")
+	out := &bytes.Buffer{}
+	err := NewConsole(d, strings.NewReader(in), out).Run()
+	if err != nil {
+		t.Fatalf("Failed to run: %s", err)
+	}
+	expect := []string{
+		"breakpoint at 0x0002 loop",
+		"breakpoint 0x0002 loop\n=>*0x0002: ld r0, r1, 0",
+		"=> 0x0004: st r0, r1, 0",
+		"=> 0x0006: jumpr 2, 3, lt",
+		"r3    0x0000 0",
+		"0x000a buffer+1         0x00000007 7",
+		"0x000b buffer+2         0x00000003 3",
+		"watchpoint 0x0008 count\n",
+		"watchpoint 0x0008 count: 0x00810001 -> 0x00810002",
+		"done:\n   0x0007: halt",
+		"error: unknown command \"bogus\"",
+	}
+	for _, e := range expect {
+		if !strings.Contains(out.String(), e) {
+			t.Errorf("Expected output to contain %q, got:\n%s", e, out.String())
+		}
+	}
+	if d.Emu.R[3] != 0x42 {
+		t.Errorf("Expected r3 0x42 got 0x%x", d.Emu.R[3])
+	}
+	if strings.Count(out.String(), "r0    ") != 1 {
+		t.Errorf("Expected commands after quit to be ignored")
+	}
+}
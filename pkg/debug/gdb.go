@@ -0,0 +1,565 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package debug
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// TargetXML describes the registers to gdb. Addresses are in bytes,
+// so pc is the word address of the next instruction times 4. It has no
+// <architecture> as gdb does not have one for the ULP, an unknown name
+// would only be ignored with a warning. See the GDB section of the emu
+// README for the gdb configuration.
+const TargetXML = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <feature name="org.ulp-c.esp32ulp">
+    <reg name="r0" bitsize="16" type="uint16" regnum="0"/>
+    <reg name="r1" bitsize="16" type="uint16"/>
+    <reg name="r2" bitsize="16" type="uint16"/>
+    <reg name="r3" bitsize="16" type="uint16"/>
+    <reg name="pc" bitsize="32" type="code_ptr"/>
+    <reg name="flags" bitsize="32" type="uint32"/>
+    <reg name="stage" bitsize="32" type="uint32"/>
+  </feature>
+</target>
+`
+
+// gdbRegisters is the size in bytes of each register of TargetXML.
+var gdbRegisters = []int{2, 2, 2, 2, 4, 4, 4}
+
+// Bits of the flags register.
+const (
+	flagZero     = 1 << 0
+	flagOverflow = 1 << 1
+)
+
+// Signals reported to gdb when execution stops.
+const (
+	sigInt  = 2  // interrupted by gdb or ran for MaxCycles
+	sigTrap = 5  // a step, breakpoint, watchpoint or halt
+	sigSegv = 11 // the emulator returned an error
+)
+
+// gdbPollCycles is how often a continue checks for an interrupt from gdb.
+const gdbPollCycles = 100_000
+
+// GdbServer serves a debugger over the GDB Remote Serial Protocol.
+type GdbServer struct {
+	Debugger *Debugger
+	Log      io.Writer // errors from the emulator are written here if set
+	conn     io.Closer // closed when Serve() returns
+	in       *bufio.Reader
+	out      io.Writer
+	noAck    bool          // QStartNoAckMode was accepted
+	bytes    chan gdbByte  // read from the connection by receive()
+	pending  []gdbByte     // read while checking for an interrupt
+	done     chan struct{} // closed when Serve() returns
+}
+
+// gdbByte is a byte read from the connection, or the error reading it.
+type gdbByte struct {
+	b   byte
+	err error
+}
+
+// NewGdbServer creates a server on a connection to gdb. The server owns
+// the connection, Serve() closes it when it returns.
+func NewGdbServer(d *Debugger, conn io.ReadWriteCloser) *GdbServer {
+	return &GdbServer{
+		Debugger: d,
+		conn:     conn,
+		in:       bufio.NewReader(conn),
+		out:      conn,
+	}
+}
+
+// errGdbDone ends Serve() without an error.
+var errGdbDone = errors.New("done")
+
+// Serve handles packets until gdb kills or detaches, or the connection
+// closes. The connection is closed on return, which also stops receive()
+// so that it cannot take bytes meant for a later reader.
+func (s *GdbServer) Serve() error {
+	s.bytes = make(chan gdbByte, 4096)
+	s.done = make(chan struct{})
+	defer s.conn.Close()
+	defer close(s.done)
+	go s.receive()
+	for {
+		packet, err := s.read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		reply, err := s.handle(packet)
+		if err != nil && !errors.Is(err, errGdbDone) {
+			return err
+		}
+		if err != nil && packet == "k" {
+			return nil // kill has no reply
+		}
+		werr := s.write(reply)
+		if werr != nil || err != nil {
+			return werr
+		}
+	}
+}
+
+// receive reads the connection in the background, so that
+// an interrupt can be seen while execution continues.
+func (s *GdbServer) receive() {
+	defer close(s.bytes)
+	for {
+		b, err := s.in.ReadByte()
+		select {
+		case s.bytes <- gdbByte{b, err}:
+		case <-s.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// next returns the next byte from the connection.
+func (s *GdbServer) next() (byte, error) {
+	if len(s.pending) != 0 {
+		b := s.pending[0]
+		s.pending = s.pending[1:]
+		return b.b, b.err
+	}
+	b, ok := <-s.bytes
+	if !ok {
+		return 0, io.EOF
+	}
+	return b.b, b.err
+}
+
+// interrupted returns true if gdb sent an interrupt, without waiting.
+// Anything else that was sent is kept for read().
+func (s *GdbServer) interrupted() bool {
+	for {
+		select {
+		case b, ok := <-s.bytes:
+			if !ok {
+				s.pending = append(s.pending, gdbByte{err: io.EOF})
+				return false
+			}
+			if b.err == nil && b.b == 0x03 {
+				return true
+			}
+			s.pending = append(s.pending, b)
+		default:
+			return false
+		}
+	}
+}
+
+// read returns the data of the next packet, acknowledging it.
+// An interrupt outside of a packet is treated as "?".
+func (s *GdbServer) read() (string, error) {
+	for {
+		b, err := s.next()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case 0x03:
+			return "?", nil // execution already stopped
+		case '$':
+		default:
+			continue // acknowledgements
+		}
+		data := make([]byte, 0)
+		for {
+			b, err = s.next()
+			if err != nil {
+				return "", err
+			}
+			if b == '#' {
+				break
+			}
+			data = append(data, b)
+		}
+		sum := make([]byte, 2)
+		for i := range sum {
+			sum[i], err = s.next()
+			if err != nil {
+				return "", err
+			}
+		}
+		expect, err := strconv.ParseUint(string(sum), 16, 8)
+		if err != nil || uint8(expect) != checksum(string(data)) {
+			if !s.noAck {
+				_, err = io.WriteString(s.out, "-")
+				if err != nil {
+					return "", err
+				}
+			}
+			continue
+		}
+		if !s.noAck {
+			_, err = io.WriteString(s.out, "+")
+			if err != nil {
+				return "", err
+			}
+		}
+		return unescape(string(data)), nil
+	}
+}
+
+// write sends a packet. Acknowledgements from gdb are skipped by read().
+func (s *GdbServer) write(data string) error {
+	_, err := fmt.Fprintf(s.out, "$%s#%02x", escape(data), checksum(escape(data)))
+	return err
+}
+
+func checksum(data string) uint8 {
+	sum := uint8(0)
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+func escape(data string) string {
+	var b strings.Builder
+	for i := 0; i < len(data); i++ {
+		switch c := data[i]; c {
+		case '#', '$', '}', '*':
+			b.WriteByte('}')
+			b.WriteByte(c ^ 0x20)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func unescape(data string) string {
+	var b strings.Builder
+	for i := 0; i < len(data); i++ {
+		if data[i] == '}' && i+1 < len(data) {
+			i++
+			b.WriteByte(data[i] ^ 0x20)
+			continue
+		}
+		b.WriteByte(data[i])
+	}
+	return b.String()
+}
+
+// handle returns the reply to a packet. Unsupported packets
+// have an empty reply.
+func (s *GdbServer) handle(packet string) (string, error) {
+	d := s.Debugger
+	switch {
+	case packet == "?":
+		return fmt.Sprintf("S%02x", sigTrap), nil
+	case strings.HasPrefix(packet, "qSupported"):
+		return "PacketSize=4000;qXfer:features:read+;QStartNoAckMode+;swbreak+", nil
+	case packet == "QStartNoAckMode":
+		s.noAck = true
+		return "OK", nil
+	case strings.HasPrefix(packet, "qXfer:features:read:target.xml:"):
+		return s.xfer(strings.TrimPrefix(packet, "qXfer:features:read:target.xml:"))
+	case packet == "qAttached":
+		return "1", nil
+	case packet == "qC":
+		return "QC1", nil
+	case packet == "qfThreadInfo":
+		return "m1", nil
+	case packet == "qsThreadInfo":
+		return "l", nil
+	case strings.HasPrefix(packet, "H"):
+		return "OK", nil
+	case packet == "g":
+		return s.readRegisters(), nil
+	case strings.HasPrefix(packet, "G"):
+		return s.writeRegisters(packet[1:]), nil
+	case strings.HasPrefix(packet, "p"):
+		n, err := strconv.ParseUint(packet[1:], 16, 8)
+		if err != nil || int(n) >= len(gdbRegisters) {
+			return "E01", nil
+		}
+		return s.register(int(n)), nil
+	case strings.HasPrefix(packet, "P"):
+		n, v, ok := strings.Cut(packet[1:], "=")
+		reg, err := strconv.ParseUint(n, 16, 8)
+		if !ok || err != nil || int(reg) >= len(gdbRegisters) {
+			return "E01", nil
+		}
+		return s.setRegister(int(reg), v), nil
+	case strings.HasPrefix(packet, "m"):
+		return s.readMemory(packet[1:]), nil
+	case strings.HasPrefix(packet, "M"):
+		return s.writeMemory(packet[1:]), nil
+	case strings.HasPrefix(packet, "Z"), strings.HasPrefix(packet, "z"):
+		return s.point(packet[0] == 'Z', packet[1:]), nil
+	case strings.HasPrefix(packet, "s"):
+		if !s.resumeAt(packet[1:]) {
+			return "E01", nil
+		}
+		stop, err := d.Step()
+		return s.stopReply(stop, err), nil
+	case strings.HasPrefix(packet, "c"):
+		if !s.resumeAt(packet[1:]) {
+			return "E01", nil
+		}
+		stop, err := s.cont()
+		return s.stopReply(stop, err), nil
+	case packet == "k":
+		return "", errGdbDone
+	case strings.HasPrefix(packet, "D"):
+		return "OK", errGdbDone
+	default:
+		return "", nil
+	}
+}
+
+// cont continues until execution stops or MaxCycles elapse, checking
+// for an interrupt from gdb every gdbPollCycles.
+func (s *GdbServer) cont() (Stop, error) {
+	d := s.Debugger
+	maxCycles := d.maxCycles()
+	start := d.Emu.Elapsed()
+	for {
+		ran := d.Emu.Elapsed() - start
+		stop, err := d.ContinueFor(min(gdbPollCycles, maxCycles-ran))
+		if err != nil || stop.Reason != ReasonCycles {
+			return stop, err
+		}
+		if d.Emu.Elapsed()-start >= maxCycles {
+			return stop, nil
+		}
+		if s.interrupted() {
+			return Stop{Reason: ReasonInterrupt, IP: d.Emu.IP}, nil
+		}
+	}
+}
+
+// resumeAt sets the pc from the optional address of a step or continue.
+func (s *GdbServer) resumeAt(addr string) bool {
+	if addr == "" {
+		return true
+	}
+	a, err := strconv.ParseUint(addr, 16, 32)
+	if err != nil {
+		return false
+	}
+	s.setRegisterValue(4, uint32(a))
+	return true
+}
+
+// xfer returns part of the target description.
+func (s *GdbServer) xfer(args string) (string, error) {
+	offset, length, ok := parseRange(args)
+	if !ok {
+		return "E01", nil
+	}
+	if offset >= len(TargetXML) {
+		return "l", nil
+	}
+	end := min(offset+length, len(TargetXML))
+	if end == len(TargetXML) {
+		return "l" + TargetXML[offset:end], nil
+	}
+	return "m" + TargetXML[offset:end], nil
+}
+
+// parseRange reads "addr,length" in hex.
+func parseRange(args string) (int, int, bool) {
+	a, l, ok := strings.Cut(args, ",")
+	if !ok {
+		return 0, 0, false
+	}
+	addr, err := strconv.ParseUint(a, 16, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	length, err := strconv.ParseUint(l, 16, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	return int(addr), int(length), true
+}
+
+// registerValue returns register `n` of TargetXML.
+func (s *GdbServer) registerValue(n int) uint32 {
+	u := s.Debugger.Emu
+	switch n {
+	case 0, 1, 2, 3:
+		return uint32(u.R[n])
+	case 4:
+		return uint32(u.IP) * 4
+	case 5:
+		flags := uint32(0)
+		if u.Zero {
+			flags |= flagZero
+		}
+		if u.Overflow {
+			flags |= flagOverflow
+		}
+		return flags
+	default:
+		return uint32(u.SC)
+	}
+}
+
+func (s *GdbServer) setRegisterValue(n int, v uint32) {
+	u := s.Debugger.Emu
+	switch n {
+	case 0, 1, 2, 3:
+		u.R[n] = uint16(v)
+	case 4:
+		u.IP = uint16(v / 4)
+	case 5:
+		u.Zero = v&flagZero != 0
+		u.Overflow = v&flagOverflow != 0
+	default:
+		u.SC = uint8(v)
+	}
+}
+
+// register returns a register as little endian hex.
+func (s *GdbServer) register(n int) string {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, s.registerValue(n))
+	return hex.EncodeToString(b[:gdbRegisters[n]])
+}
+
+func (s *GdbServer) readRegisters() string {
+	out := ""
+	for n := range gdbRegisters {
+		out += s.register(n)
+	}
+	return out
+}
+
+// setRegister sets a register from little endian hex.
+func (s *GdbServer) setRegister(n int, value string) string {
+	b, err := hex.DecodeString(value)
+	if err != nil || len(b) != gdbRegisters[n] {
+		return "E01"
+	}
+	full := make([]byte, 4)
+	copy(full, b)
+	s.setRegisterValue(n, binary.LittleEndian.Uint32(full))
+	return "OK"
+}
+
+func (s *GdbServer) writeRegisters(values string) string {
+	for n, size := range gdbRegisters {
+		if len(values) < size*2 {
+			return "E01"
+		}
+		if reply := s.setRegister(n, values[:size*2]); reply != "OK" {
+			return reply
+		}
+		values = values[size*2:]
+	}
+	return "OK"
+}
+
+// readMemory reads bytes of the little endian words.
+func (s *GdbServer) readMemory(args string) string {
+	addr, length, ok := parseRange(args)
+	mem := s.Debugger.Emu.Memory[:s.Debugger.Emu.MemoryWords()]
+	if !ok || addr+length > len(mem)*4 {
+		return "E01"
+	}
+	b := make([]byte, length)
+	for i := range b {
+		a := addr + i
+		b[i] = uint8(mem[a/4] >> (8 * (a % 4)))
+	}
+	return hex.EncodeToString(b)
+}
+
+func (s *GdbServer) writeMemory(args string) string {
+	r, data, ok := strings.Cut(args, ":")
+	addr, length, okRange := parseRange(r)
+	b, err := hex.DecodeString(data)
+	mem := s.Debugger.Emu.Memory[:s.Debugger.Emu.MemoryWords()]
+	if !ok || !okRange || err != nil || len(b) != length || addr+length > len(mem)*4 {
+		return "E01"
+	}
+	for i, v := range b {
+		a := addr + i
+		shift := 8 * (a % 4)
+		mem[a/4] = (mem[a/4] &^ (0xFF << shift)) | uint32(v)<<shift
+	}
+	s.Debugger.syncWatchpoints()
+	return "OK"
+}
+
+// point inserts or removes a breakpoint (type 0 or 1)
+// or a write watchpoint (type 2) on every word in range.
+func (s *GdbServer) point(insert bool, args string) string {
+	kind, r, ok := strings.Cut(args, ",")
+	if !ok {
+		return "E01"
+	}
+	addr, length, ok := parseRange(r)
+	if !ok {
+		return "E01"
+	}
+	d := s.Debugger
+	switch kind {
+	case "0", "1":
+		if !insert {
+			d.ClearBreakpoint(addr / 4)
+			return "OK"
+		}
+		if d.SetBreakpoint(addr/4) != nil {
+			return "E01"
+		}
+	case "2":
+		for w := addr / 4; w <= (addr+max(length, 1)-1)/4; w++ {
+			if !insert {
+				d.ClearWatchpoint(w)
+			} else if d.SetWatchpoint(w) != nil {
+				return "E01"
+			}
+		}
+	default:
+		return "" // read and access watchpoints are not supported
+	}
+	return "OK"
+}
+
+func (s *GdbServer) stopReply(stop Stop, err error) string {
+	if err != nil {
+		if s.Log != nil {
+			fmt.Fprintln(s.Log, err)
+		}
+		return fmt.Sprintf("S%02x", sigSegv)
+	}
+	switch stop.Reason {
+	case ReasonBreakpoint:
+		return fmt.Sprintf("T%02xswbreak:;", sigTrap)
+	case ReasonWatchpoint:
+		return fmt.Sprintf("T%02xwatch:%x;", sigTrap, stop.Addr*4)
+	case ReasonCycles, ReasonInterrupt:
+		return fmt.Sprintf("S%02x", sigInt)
+	default:
+		return fmt.Sprintf("S%02x", sigTrap)
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package debug
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// gdbClient is a scripted gdb.
+type gdbClient struct {
+	t    *testing.T
+	conn net.Conn
+	in   *bufio.Reader
+}
+
+// send writes a packet and returns the reply, checking the acknowledgement.
+func (c *gdbClient) send(packet string) string {
+	c.t.Helper()
+	_, err := fmt.Fprintf(c.conn, "$%s#%02x", packet, checksum(packet))
+	if err != nil {
+		c.t.Fatalf("Failed to send %s: %s", packet, err)
+	}
+	ack, err := c.in.ReadByte()
+	if err != nil || ack != '+' {
+		c.t.Fatalf("Expected an acknowledgement of %s, got %q %v", packet, ack, err)
+	}
+	return c.reply()
+}
+
+func (c *gdbClient) reply() string {
+	c.t.Helper()
+	start, err := c.in.ReadByte()
+	if err != nil || start != '$' {
+		c.t.Fatalf("Expected a packet, got %q %v", start, err)
+	}
+	data, err := c.in.ReadString('#')
+	if err != nil {
+		c.t.Fatalf("Failed to read: %s", err)
+	}
+	data = data[:len(data)-1]
+	sum := make([]byte, 2)
+	_, err = io.ReadFull(c.in, sum)
+	if err != nil || string(sum) != fmt.Sprintf("%02x", checksum(data)) {
+		c.t.Fatalf("Bad checksum %s for %s", sum, data)
+	}
+	io.WriteString(c.conn, "+") // the server may have closed after detaching
+	return unescape(data)
+}
+
+func TestGdbServer(t *testing.T) {
+	d := build(t, program)
+	server, conn := net.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- NewGdbServer(d, server).Serve()
+	}()
+	c := &gdbClient{t: t, conn: conn, in: bufio.NewReader(conn)}
+
+	count, _ := d.Resolve("count")
+	tests := []struct {
+		name   string
+		packet string
+		expect string
+	}{
+		{"supported", "qSupported:multiprocess+;swbreak+", "PacketSize=4000;qXfer:features:read+;QStartNoAckMode+;swbreak+"},
+		{"stop reason", "?", "S05"},
+		{"target start", "qXfer:features:read:target.xml:0,10", "m" + TargetXML[:16]},
+		{"target end", fmt.Sprintf("qXfer:features:read:target.xml:%x,1000", len(TargetXML)-5), "l" + TargetXML[len(TargetXML)-5:]},
+		{"registers", "g", "0000000000000000000000000000000000000000"},
+		{"step", "s", "S05"},
+		{"r2 after move", "p2", "0000"},
+		{"pc after step", "p4", "04000000"},
+		{"breakpoint", "Z0,10,4", "OK"}, // loop+2, the st
+		{"continue to breakpoint", "c", "T05swbreak:;"},
+		{"r0 before store", "p0", "0100"},
+		{"remove breakpoint", "z0,10,4", "OK"},
+		{"watchpoint", fmt.Sprintf("Z2,%x,4", count*4), "OK"},
+		{"continue to watchpoint", "c", fmt.Sprintf("T05watch:%x;", count*4)},
+		{"read count", fmt.Sprintf("m%x,2", count*4), "0100"},
+		{"remove watchpoint", fmt.Sprintf("z2,%x,4", count*4), "OK"},
+		{"write memory", fmt.Sprintf("M%x,2:3412", count*4), "OK"},
+		{"read memory", fmt.Sprintf("m%x,2", count*4), "3412"},
+		{"write register", "P3=2a00", "OK"},
+		{"read register", "p3", "2a00"},
+		{"write flags", "P5=03000000", "OK"},
+		{"read flags", "p5", "03000000"},
+		{"unsupported watchpoint", "Z3,0,4", ""},
+		{"bad register", "p9", "E01"},
+		{"memory out of range", "m100000,4", "E01"},
+		{"continue to halt", "c", "S05"},
+		{"unsupported", "vMustReplyEmpty", ""},
+		{"detach", "D", "OK"},
+	}
+	for _, tt := range tests {
+		got := c.send(tt.packet)
+		if got != tt.expect {
+			t.Errorf("%s: %s expected %q got %q", tt.name, tt.packet, tt.expect, got)
+		}
+	}
+	err := <-done
+	if err != nil {
+		t.Errorf("Server failed: %s", err)
+	}
+	if _, err := c.in.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the server to close the connection, got %v", err)
+	}
+	if d.Emu.R[3] != 42 {
+		t.Errorf("Expected the registers written by gdb, got %+v", d.Emu)
+	}
+	if !d.Emu.Halted {
+		t.Errorf("Expected the program to halt")
+	}
+	conn.Close()
+}
+
+func TestGdbInterrupt(t *testing.T) {
+	d := build(t, "loop:\n\tjump loop\n")
+	d.MaxCycles = 1 << 62 // only an interrupt can stop it
+	server, conn := net.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- NewGdbServer(d, server).Serve()
+	}()
+	in := bufio.NewReader(conn)
+	c := &gdbClient{t: t, conn: conn, in: in}
+
+	fmt.Fprintf(conn, "$c#%02x", checksum("c"))
+	ack, err := in.ReadByte()
+	if err != nil || ack != '+' {
+		t.Fatalf("Expected an acknowledgement, got %q %v", ack, err)
+	}
+	_, err = conn.Write([]byte{0x03})
+	if err != nil {
+		t.Fatalf("Failed to interrupt: %s", err)
+	}
+	if got := c.reply(); got != "S02" {
+		t.Errorf("Expected the continue to be interrupted, got %q", got)
+	}
+	if got := c.send("p4"); got != "00000000" {
+		t.Errorf("Expected to stop in the loop, got pc %q", got)
+	}
+	if got := c.send("D"); got != "OK" {
+		t.Errorf("Expected OK got %q", got)
+	}
+	if err = <-done; err != nil {
+		t.Errorf("Server failed: %s", err)
+	}
+	conn.Close()
+}
+
+func TestGdbPackets(t *testing.T) {
+	escaped := escape("a#b$c}d*")
+	if strings.ContainsAny(escaped, "#$*") || unescape(escaped) != "a#b$c}d*" {
+		t.Errorf("Failed to escape, got %q", escaped)
+	}
+
+	// a bad checksum is not acknowledged, the client sends again
+	d := build(t, program)
+	server, conn := net.Pipe()
+	go NewGdbServer(d, server).Serve()
+	defer conn.Close()
+	in := bufio.NewReader(conn)
+	go fmt.Fprintf(conn, "$g#00")
+	nack, err := in.ReadByte()
+	if err != nil || nack != '-' {
+		t.Fatalf("Expected a negative acknowledgement, got %q %v", nack, err)
+	}
+	c := &gdbClient{t: t, conn: conn, in: in}
+	if got := c.send("QStartNoAckMode"); got != "OK" {
+		t.Fatalf("Expected OK got %q", got)
+	}
+	// no acknowledgements after that
+	fmt.Fprintf(conn, "$p0#%02x", checksum("p0"))
+	if got := c.reply(); got != "0000" {
+		t.Errorf("Expected r0 got %q", got)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package emu
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DefaultAdcCycles is the cost of a single adc conversion with the
+// default SENS settings: 23 + SAR_AMP_WAIT1 + SAR_AMP_WAIT2 +
+// SAR_AMP_WAIT3 + SAR1_SAMPLE_CYCLE + SAR1_SAMPLE_BIT.
+const DefaultAdcCycles = 23 + 10 + 10 + 10 + 9 + 3
+
+// AdcMax is the largest reading of the 12 bit ADC.
+const AdcMax = 4095
+
+// Signal is the input of an ADC channel over time.
+type Signal interface {
+	Sample(cycle uint64) uint16 // the reading at Elapsed() cycle
+}
+
+// AdcChannel is a pad of one of the two SAR ADCs.
+type AdcChannel struct {
+	Sar     int // 0 for SAR ADC1, 1 for SAR ADC2
+	Channel int // the pad, one less than the mux of the instruction
+}
+
+// Adc connects signals to the adc instruction.
+type Adc struct {
+	Signals map[AdcChannel]Signal
+	Cycles  uint64 // cost of each conversion, DefaultAdcCycles if 0
+}
+
+// NewAdc creates an ADC without any signals.
+func NewAdc() *Adc {
+	return &Adc{Signals: make(map[AdcChannel]Signal)}
+}
+
+// Set connects a signal to a channel of SAR ADC1 (`sar` 0) or ADC2 (`sar` 1).
+func (a *Adc) Set(sar int, channel int, s Signal) {
+	a.Signals[AdcChannel{sar, channel}] = s
+}
+
+// adc executes the adc instruction, returning the cycles taken.
+func (u *UlpEmu) adc(instr uint32) (uint64, error) {
+	if u.Adc == nil {
+		u.Adc = NewAdc()
+	}
+	rdst := bitRead(instr, 0, 2)
+	mux := int(bitRead(instr, 2, 4))
+	sar := int(bitRead(instr, 6, 1))
+	if mux == 0 {
+		return 0, fmt.Errorf("adc mux 0 does not select a pad")
+	}
+	s, ok := u.Adc.Signals[AdcChannel{sar, mux - 1}]
+	if !ok {
+		return 0, fmt.Errorf("no signal on SAR ADC%d channel %d", sar+1, mux-1)
+	}
+	u.R[rdst] = min(s.Sample(u.elapsed), AdcMax)
+	if u.Adc.Cycles != 0 {
+		return u.Adc.Cycles, nil
+	}
+	return DefaultAdcCycles, nil
+}
+
+// AdcReading returns the reading of a voltage in millivolts, where
+// `fullScale` is the voltage of AdcMax with the chosen attenuation.
+func AdcReading(millivolts int, fullScale int) uint16 {
+	r := millivolts * AdcMax / fullScale
+	return uint16(max(0, min(r, AdcMax)))
+}
+
+// ConstantSignal always has the same reading.
+type ConstantSignal uint16
+
+func (s ConstantSignal) Sample(cycle uint64) uint16 {
+	return uint16(s)
+}
+
+// SequenceSignal returns each value in order for successive
+// conversions, then repeats the last.
+type SequenceSignal struct {
+	Values []uint16
+	next   int
+}
+
+func (s *SequenceSignal) Sample(cycle uint64) uint16 {
+	if len(s.Values) == 0 {
+		return 0
+	}
+	v := s.Values[min(s.next, len(s.Values)-1)]
+	s.next++
+	return v
+}
+
+// SignalFunc is a reading as a function of the cycle.
+type SignalFunc func(cycle uint64) uint16
+
+func (f SignalFunc) Sample(cycle uint64) uint16 {
+	return f(cycle)
+}
+
+// WaveformPoint is a reading at a cycle.
+type WaveformPoint struct {
+	Cycle uint64
+	Value uint16
+}
+
+// Waveform is a signal described by points sorted by cycle. Before the
+// first point it has the first value and after the last the last value.
+type Waveform struct {
+	Points []WaveformPoint
+	Linear bool // interpolate between points rather than holding the value
+}
+
+func (w *Waveform) Sample(cycle uint64) uint16 {
+	if len(w.Points) == 0 {
+		return 0
+	}
+	i := 0
+	for i < len(w.Points) && w.Points[i].Cycle <= cycle {
+		i++
+	}
+	if i == 0 {
+		return w.Points[0].Value
+	}
+	prev := w.Points[i-1]
+	if i == len(w.Points) || !w.Linear {
+		return prev.Value
+	}
+	next := w.Points[i]
+	span := float64(next.Cycle - prev.Cycle)
+	t := float64(cycle-prev.Cycle) / span
+	return uint16(float64(prev.Value) + t*(float64(next.Value)-float64(prev.Value)) + 0.5)
+}
+
+// ParseWaveform reads a waveform from CSV with a cycle and value on
+// each line. The first line can be a header, such as "cycle,value".
+func ParseWaveform(r io.Reader) (*Waveform, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	w := &Waveform{Points: make([]WaveformPoint, 0, len(records))}
+	errs := error(nil)
+	for i, rec := range records {
+		cycle, errCycle := strconv.ParseUint(strings.TrimSpace(rec[0]), 0, 64)
+		value, errValue := strconv.ParseUint(strings.TrimSpace(rec[1]), 0, 16)
+		if i == 0 && errCycle != nil && errValue != nil {
+			continue // header
+		}
+		if errCycle != nil || errValue != nil {
+			errs = errors.Join(errs, fmt.Errorf("line %d: expected a cycle and a value but got \"%s\"", i+1, strings.Join(rec, ",")))
+			continue
+		}
+		if n := len(w.Points); n != 0 && cycle < w.Points[n-1].Cycle {
+			errs = errors.Join(errs, fmt.Errorf("line %d: cycle %d is before the previous point", i+1, cycle))
+			continue
+		}
+		w.Points = append(w.Points, WaveformPoint{cycle, uint16(value)})
+	}
+	if errs != nil {
+		return nil, errs
+	}
+	return w, nil
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package emu_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+// batteryMonitor samples SAR ADC1 channel 3 and wakes the esp32 below 2000.
+const batteryMonitor = `
+	adc r0, 0, 4
+	move r1, last
+	st r0, r1, 0
+	jumpr done, 2000, ge
+	wake
+done:
+	halt
+	.data
+last: .int 0
+`
+
+func TestAdcSweep(t *testing.T) {
+	// 3.9 V full scale with 11 dB attenuation
+	tests := []struct {
+		millivolts int
+		wake       bool
+	}{
+		{3300, false},
+		{2000, false},
+		{1905, false},
+		{1904, true},
+		{1000, true},
+		{0, true},
+	}
+	for _, tt := range tests {
+		u, symbols := build(t, batteryMonitor)
+		u.Adc = emu.NewAdc()
+		reading := emu.AdcReading(tt.millivolts, 3900)
+		u.Adc.Set(0, 3, emu.ConstantSignal(reading))
+		err := u.RunUntilHalt(1000)
+		if err != nil {
+			t.Fatalf("Failed to run: %s", err)
+		}
+		if u.Wake != tt.wake {
+			t.Errorf("%d mV (reading %d) expected wake %v", tt.millivolts, reading, tt.wake)
+		}
+		if got := u.Memory[symbols["last"]] & 0xFFFF; got != uint32(reading) {
+			t.Errorf("Expected to store %d got %d", reading, got)
+		}
+	}
+}
+
+func TestAdcWaveform(t *testing.T) {
+	// the battery discharges from 3000 to 1500 over 10000 cycles
+	w, err := emu.ParseWaveform(strings.NewReader("cycle,value\n0,3000\n10000,1500\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	w.Linear = true
+	u, symbols := build(t, batteryMonitor)
+	u.Adc = emu.NewAdc()
+	u.Adc.Set(0, 3, w)
+	u.SleepCycles[0] = 1000
+	woke := -1
+	err = u.RunWakeCycles(10, 1000, func(run int) error {
+		if u.Wake && woke < 0 {
+			woke = run
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to run: %s", err)
+	}
+	// below 2000 after 6667 cycles, each run is the sleep period plus the program
+	start := u.Elapsed() / 10
+	if woke < 0 || uint64(woke)*start < 6000 || uint64(woke-1)*start > 6667 {
+		t.Errorf("Expected to wake after 6667 cycles, woke on run %d of about %d cycles", woke, start)
+	}
+	if got := u.Memory[symbols["last"]] & 0xFFFF; got >= 2000 {
+		t.Errorf("Expected the last reading to be below 2000 got %d", got)
+	}
+}
+
+func TestAdcSignals(t *testing.T) {
+	seq := &emu.SequenceSignal{Values: []uint16{1, 2, 3}}
+	for i, e := range []uint16{1, 2, 3, 3} {
+		if got := seq.Sample(0); got != e {
+			t.Errorf("Sample %d expected %d got %d", i, e, got)
+		}
+	}
+	f := emu.SignalFunc(func(cycle uint64) uint16 { return uint16(cycle / 2) })
+	if got := f.Sample(10); got != 5 {
+		t.Errorf("Expected 5 got %d", got)
+	}
+	w := &emu.Waveform{Points: []emu.WaveformPoint{{10, 100}, {20, 200}}}
+	for _, tt := range []struct {
+		cycle  uint64
+		linear bool
+		value  uint16
+	}{
+		{0, false, 100},
+		{15, false, 100},
+		{15, true, 150},
+		{20, true, 200},
+		{30, true, 200},
+	} {
+		w.Linear = tt.linear
+		if got := w.Sample(tt.cycle); got != tt.value {
+			t.Errorf("Cycle %d linear %v expected %d got %d", tt.cycle, tt.linear, tt.value, got)
+		}
+	}
+
+	// conversions take Adc.Cycles
+	u, _ := build(t, "adc r1, 1, 1\nhalt")
+	u.Adc = emu.NewAdc()
+	u.Adc.Cycles = 500
+	u.Adc.Set(1, 0, emu.ConstantSignal(5000))
+	err := u.RunUntilHalt(1000)
+	if err != nil || u.R[1] != emu.AdcMax || u.Elapsed() != 502 {
+		t.Errorf("Expected %d after 502 cycles, got %d after %d: %v", emu.AdcMax, u.R[1], u.Elapsed(), err)
+	}
+}
+
+func TestAdcErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		csv  string
+		err  string
+	}{
+		{
+			name: "no signal",
+			src:  "adc r0, 1, 2\nhalt",
+			err:  "no signal on SAR ADC2 channel 1",
+		},
+		{
+			name: "no pad",
+			src:  "adc r0, 0, 0\nhalt",
+			err:  "adc mux 0 does not select a pad",
+		},
+		{
+			name: "csv value",
+			csv:  "0,1\n5,x\n",
+			err:  "line 2: expected a cycle and a value but got \"5,x\"",
+		},
+		{
+			name: "csv order",
+			csv:  "5,1\n0,1\n",
+			err:  "line 2: cycle 0 is before the previous point",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if tt.csv != "" {
+				_, err = emu.ParseWaveform(strings.NewReader(tt.csv))
+			} else {
+				u, _ := build(t, tt.src)
+				err = u.RunUntilHalt(1000)
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Expected error containing %q got %v", tt.err, err)
+			}
+		})
+	}
+}
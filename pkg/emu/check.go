@@ -0,0 +1,161 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package emu
+
+import "fmt"
+
+// Region is a range of word addresses.
+type Region struct {
+	Start int
+	End   int // the first word after the region
+}
+
+// Contains returns true if a word address is in the region.
+func (r Region) Contains(addr int) bool {
+	return addr >= r.Start && addr < r.End
+}
+
+// ViolationKind is the kind of memory safety problem found by a Checker.
+type ViolationKind int
+
+const (
+	ViolationUninitialized ViolationKind = iota // a load of a word that was never written
+	ViolationTextWrite                          // a store into the code, self-modifying code
+	ViolationStack                              // r3 moved outside of the stack
+	ViolationJump                               // a jump or falling through outside of the code
+)
+
+func (k ViolationKind) String() string {
+	switch k {
+	case ViolationUninitialized:
+		return "uninitialized read"
+	case ViolationTextWrite:
+		return "text write"
+	case ViolationStack:
+		return "stack bounds"
+	case ViolationJump:
+		return "jump outside text"
+	default:
+		return "unknown"
+	}
+}
+
+// Violation is a memory safety problem found while running.
+type Violation struct {
+	Kind  ViolationKind
+	Cycle uint64 // Elapsed() when the instruction started
+	IP    uint16 // the instruction
+	Addr  int    // the word loaded or stored, the value of r3 or the next instruction
+	msg   string
+}
+
+func (v Violation) Error() string {
+	return fmt.Sprintf("0x%04x: %s", v.IP, v.msg)
+}
+
+// Checker tracks the state of each word of memory to find loads of words
+// that were never written, stores into the code, the stack pointer r3
+// moving out of the stack and jumps outside of the code.
+type Checker struct {
+	Text          Region   // the code
+	Uninitialized []Region // words that must be written before they are read, such as .bss and the stack
+	Stack         Region   // __stack_start to __stack_end, r3 can also be __stack_end
+	Strict        bool     // stop at the first violation with it as the error
+	Violations    []Violation
+	written       map[int]bool
+}
+
+// NewChecker creates a checker for a program whose code is `text`.
+func NewChecker(text Region, stack Region, uninitialized ...Region) *Checker {
+	return &Checker{
+		Text:          text,
+		Uninitialized: uninitialized,
+		Stack:         stack,
+		Violations:    make([]Violation, 0),
+		written:       make(map[int]bool),
+	}
+}
+
+// initialized returns true if a word was written or does not need to be.
+func (c *Checker) initialized(addr int) bool {
+	if c.written[addr] {
+		return true
+	}
+	for _, r := range c.Uninitialized {
+		if r.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// mark records that a word was written.
+func (c *Checker) mark(addr int) {
+	if c.written == nil {
+		c.written = make(map[int]bool)
+	}
+	c.written[addr] = true
+}
+
+// report adds a violation, returning it as an error if Strict.
+func (u *UlpEmu) report(kind ViolationKind, addr int, format string, a ...any) error {
+	v := Violation{Kind: kind, Cycle: u.elapsed, IP: u.IP, Addr: addr, msg: fmt.Sprintf(format, a...)}
+	u.Checker.Violations = append(u.Checker.Violations, v)
+	if u.Checker.Strict {
+		return v
+	}
+	return nil
+}
+
+// checkLoad checks that a loaded word was initialized.
+func (u *UlpEmu) checkLoad(addr int) error {
+	if u.Checker == nil || u.Checker.initialized(addr) {
+		return nil
+	}
+	return u.report(ViolationUninitialized, addr, "load of uninitialized word 0x%04x", addr)
+}
+
+// checkStore marks a stored word as written and checks it is not code.
+func (u *UlpEmu) checkStore(addr int) error {
+	if u.Checker == nil {
+		return nil
+	}
+	u.Checker.mark(addr)
+	if u.Checker.Text.Contains(addr) {
+		return u.report(ViolationTextWrite, addr, "store into .text at 0x%04x", addr)
+	}
+	return nil
+}
+
+// checkExecuted checks the stack pointer and the next instruction after
+// an instruction at `ip`, where `r3` was the stack pointer before it.
+func (u *UlpEmu) checkExecuted(instr uint32, ip uint16, r3 uint16) error {
+	c := u.Checker
+	if c == nil {
+		return nil
+	}
+	next := u.IP
+	u.IP = ip // report the instruction
+	defer func() { u.IP = next }()
+	if u.R[3] != r3 {
+		sp := int(u.R[3])
+		if sp < c.Stack.Start {
+			return u.report(ViolationStack, sp, "r3 0x%04x is below __stack_start 0x%04x", sp, c.Stack.Start)
+		}
+		if sp > c.Stack.End {
+			return u.report(ViolationStack, sp, "r3 0x%04x is above __stack_end 0x%04x", sp, c.Stack.End)
+		}
+	}
+	if u.Halted || !c.Text.Contains(int(ip)) || c.Text.Contains(int(next)) {
+		return nil // only report leaving the code once
+	}
+	if bitRead(instr, 28, 4) == 8 {
+		return u.report(ViolationJump, int(next), "jump to 0x%04x outside of .text", next)
+	}
+	return u.report(ViolationJump, int(next), "execution reached 0x%04x outside of .text", next)
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package emu
+
+// BranchCount is how often a jump went to its target or fell through.
+type BranchCount struct {
+	Taken    uint64
+	NotTaken uint64
+}
+
+// Coverage counts the instructions executed by Tick().
+type Coverage struct {
+	Hits     map[int]uint64       // executions of each word address
+	Branches map[int]*BranchCount // of each jump by word address
+}
+
+// NewCoverage creates empty coverage.
+func NewCoverage() *Coverage {
+	return &Coverage{
+		Hits:     make(map[int]uint64),
+		Branches: make(map[int]*BranchCount),
+	}
+}
+
+// Merge adds the counts of another run of the same program.
+func (c *Coverage) Merge(other *Coverage) {
+	for addr, n := range other.Hits {
+		c.Hits[addr] += n
+	}
+	for addr, b := range other.Branches {
+		c.branch(addr).Taken += b.Taken
+		c.branch(addr).NotTaken += b.NotTaken
+	}
+}
+
+func (c *Coverage) branch(addr int) *BranchCount {
+	b, ok := c.Branches[addr]
+	if !ok {
+		b = &BranchCount{}
+		c.Branches[addr] = b
+	}
+	return b
+}
+
+// record counts the instruction at `ip`, where `next` is the IP after it.
+func (c *Coverage) record(instr uint32, ip uint16, next uint16) {
+	c.Hits[int(ip)]++
+	if bitRead(instr, 28, 4) != 8 { // jump
+		return
+	}
+	if next == ip+1 {
+		c.branch(int(ip)).NotTaken++
+	} else {
+		c.branch(int(ip)).Taken++
+	}
+}
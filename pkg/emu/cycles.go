@@ -0,0 +1,154 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package emu
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultClockHz is the nominal frequency of RTC_FAST_CLK, which runs the ULP.
+const DefaultClockHz = 8_000_000
+
+// Timing selects the cost model of the emulator.
+type Timing int
+
+const (
+	// TimingEstimate charges Cycles(), the model shared with the
+	// static timing analysis of the assembler.
+	TimingEstimate Timing = iota
+	// TimingAccurate charges AccurateCycles(), the execute and fetch
+	// cycles of each instruction from the ESP32 technical reference manual.
+	TimingAccurate
+)
+
+// Cycles returns the number of cycles charged for an instruction.
+// This is the default cost model of the emulator, it is shared with
+// the static timing analysis in the assembler. See AccurateCycles()
+// for the costs of the technical reference manual.
+func Cycles(instr uint32) (uint64, error) {
+	op := bitRead(instr, 28, 4)
+	switch op {
+	case 7: // operations
+		return 4, nil // 2 execute 4 fetch, but tested differently
+	case 6, 13: // store, load
+		return 8, nil // 4 execute + 4 fetch
+	case 8: // jump
+		return 4, nil // 2 execute + 2 fetch
+	case 9: // wake, sleep
+		return 85, nil // 2 execute 4 fetch, but tested differently
+	case 4: // wait
+		imm := bitRead(instr, 0, 16)
+		return 6 + uint64(imm), nil // 2 execute 4 fetch, plus the wait cycles
+	case 11: // halt
+		return 2, nil // 2 execute
+	case 1: // reg_wr
+		return 12, nil // 8 execute + 4 fetch
+	case 2: // reg_rd
+		return 8, nil // 4 execute + 4 fetch
+	case 3: // i2c_rd, i2c_wr
+		return DefaultI2cCycles, nil // depends on the bus, see I2cBus.Cycles
+	case 5: // adc
+		return DefaultAdcCycles, nil // depends on the SENS settings, see Adc.Cycles
+	default:
+		return 0, fmt.Errorf("unknown operation %v", op)
+	}
+}
+
+// AccurateCycles returns the execute and fetch cycles of an instruction
+// from the ULP instruction set in the ESP32 technical reference manual.
+// The conversion of adc and the transfer of i2c_rd and i2c_wr use the
+// defaults, see Adc.Cycles and I2cBus.Cycles.
+func AccurateCycles(instr uint32) (uint64, error) {
+	op := bitRead(instr, 28, 4)
+	switch op {
+	case 7: // operations, stage count
+		return 2 + 4, nil // 2 execute + 4 fetch
+	case 6, 13: // store, load
+		return 4 + 4, nil // 4 execute + 4 fetch
+	case 8: // jump
+		return 2 + 2, nil // 2 execute + 2 fetch
+	case 9: // wake, sleep
+		return 2 + 4, nil // 2 execute + 4 fetch
+	case 4: // wait
+		imm := bitRead(instr, 0, 16)
+		return 2 + uint64(imm) + 4, nil // 2 + cycles execute + 4 fetch
+	case 11: // halt
+		return 2, nil // 2 execute, nothing is fetched
+	case 1: // reg_wr
+		return 8 + 4, nil // 8 execute + 4 fetch
+	case 2: // reg_rd
+		return 4 + 4, nil // 4 execute + 4 fetch
+	case 3: // i2c_rd, i2c_wr
+		return DefaultI2cCycles + fetchCycles, nil
+	case 5: // adc
+		return DefaultAdcCycles + fetchCycles, nil
+	default:
+		return 0, fmt.Errorf("unknown operation %v", op)
+	}
+}
+
+// fetchCycles is the time to fetch the instruction after
+// one of the peripherals, on top of the peripheral itself.
+const fetchCycles = 4
+
+// cost returns the cycles of an instruction with the chosen timing.
+func (u *UlpEmu) cost(instr uint32) (uint64, error) {
+	if u.Timing == TimingAccurate {
+		return AccurateCycles(instr)
+	}
+	return Cycles(instr)
+}
+
+// peripheralCost returns the cycles of an adc or i2c instruction
+// that took `cycles` in the peripheral.
+func (u *UlpEmu) peripheralCost(cycles uint64) uint64 {
+	if u.Timing == TimingAccurate {
+		return cycles + fetchCycles
+	}
+	return cycles
+}
+
+func (u *UlpEmu) clockHz() uint64 {
+	if u.ClockHz == 0 {
+		return DefaultClockHz
+	}
+	return u.ClockHz
+}
+
+// Duration converts cycles to wall time with the RTC_FAST_CLK frequency.
+func (u *UlpEmu) Duration(cycles uint64) time.Duration {
+	hz := u.clockHz()
+	secs, rem := cycles/hz, cycles%hz
+	return time.Duration(secs)*time.Second + time.Duration(rem*uint64(time.Second)/hz)
+}
+
+// CyclesFor converts wall time to cycles, rounding down.
+func (u *UlpEmu) CyclesFor(d time.Duration) uint64 {
+	if d <= 0 {
+		return 0
+	}
+	hz := u.clockHz()
+	secs, rem := uint64(d/time.Second), uint64(d%time.Second)
+	return secs*hz + rem*hz/uint64(time.Second)
+}
+
+// Time returns the wall time of Elapsed().
+func (u *UlpEmu) Time() time.Duration {
+	return u.Duration(u.elapsed)
+}
+
+// SetWakeupPeriod sets one of the periods selected by sleep
+// in wall time, like ulp_set_wakeup_period().
+func (u *UlpEmu) SetWakeupPeriod(sel int, d time.Duration) error {
+	if sel < 0 || sel >= SleepRegisters {
+		return fmt.Errorf("sleep register %d must be less than %d", sel, SleepRegisters)
+	}
+	u.SleepCycles[sel] = u.CyclesFor(d)
+	return nil
+}
@@ -3,56 +3,160 @@ package emu
 import (
 	"encoding/binary"
 	"fmt"
-	"reflect"
 	"testing"
 )
 
+// DefaultMemorySize is the memory reserved for the ULP in bytes
+// unless set with NewUlpEmu(), see CONFIG_ULP_COPROC_RESERVE_MEM.
+const DefaultMemorySize = 8176
+
+// MaxMemorySize is the most memory that can be reserved for the ULP in bytes.
+const MaxMemorySize = DefaultMemorySize
+
+// SleepRegisters is the number of wake up periods `sleep` can select.
+const SleepRegisters = 5
+
+// UlpEmu emulates the ULP. Create one with NewUlpEmu() to choose the
+// memory reserved for the ULP, the zero value reserves DefaultMemorySize.
 type UlpEmu struct {
-	R          [4]uint16        // registers R0 through R3
-	Overflow   bool             // overflow flag
-	Zero       bool             // zero flag
-	SC         uint8            // stage count register
-	Memory     [8176 / 4]uint32 // memory visible to the ulp
-	IP         uint16           // instruction pointer
-	Wake       bool             // esp32 wake indicator
-	cycles     uint64           // number of cycles executed
-	dataOffset int
+	R           [4]uint16              // registers R0 through R3
+	Overflow    bool                   // overflow flag
+	Zero        bool                   // zero flag
+	SC          uint8                  // stage count register
+	Memory      [8176 / 4]uint32       // memory visible to the ulp
+	Size        int                    // bytes of Memory reserved for the ulp, all of it if 0, see NewUlpEmu()
+	IP          uint16                 // instruction pointer
+	Wake        bool                   // esp32 wake indicator
+	Halted      bool                   // halt was executed, the timer restarts the program
+	Timer       bool                   // if the timer restarts the program after halt, enabled when loading
+	SleepCycles [SleepRegisters]uint64 // the wake up periods in cycles, see ulp_set_wakeup_period()
+	SleepSel    int                    // the period selected by the last sleep instruction
+	Entry       uint16                 // where the timer restarts the program
+	Runs        int                    // number of times the program was started, including by the timer
+	Bus         RegisterBus            // the registers of reg_rd and reg_wr, RtcRegisters if nil
+	I2c         *I2cBus                // the devices of i2c_rd and i2c_wr, created if nil
+	Adc         *Adc                   // the signals of adc, created if nil
+	Trace       *Trace                 // records each instruction if not nil
+	Checker     *Checker               // checks memory safety if not nil
+	Coverage    *Coverage              // counts each instruction if not nil
+	Timing      Timing                 // the cost model of each instruction
+	ClockHz     uint64                 // the RTC_FAST_CLK frequency, DefaultClockHz if 0
+	cycles      uint64                 // number of cycles executed
+	elapsed     uint64                 // number of cycles including time spent halted
+	dataOffset  int
+}
+
+// NewUlpEmu creates an emulator with `size` bytes of memory reserved
+// for the ULP, which must be a multiple of 4.
+func NewUlpEmu(size int) (*UlpEmu, error) {
+	if size <= 0 || size%4 != 0 {
+		return nil, fmt.Errorf("memory size %d must be a positive multiple of 4", size)
+	}
+	if size > MaxMemorySize {
+		return nil, fmt.Errorf("memory size %d is larger than the %d bytes that can be reserved", size, MaxMemorySize)
+	}
+	return &UlpEmu{Size: size}, nil
+}
+
+// MemoryWords returns the number of words of Memory reserved for the ULP.
+func (u *UlpEmu) MemoryWords() int {
+	if u.Size <= 0 {
+		return len(u.Memory)
+	}
+	return min(u.Size/4, len(u.Memory))
 }
 
+// LoadBinary loads a binary at the start of memory, see LoadBinaryAt().
 func (u *UlpEmu) LoadBinary(bin []uint8) error {
+	return u.LoadBinaryAt(bin, 0)
+}
+
+// LoadBinaryAt loads a binary at word address `addr` and starts execution
+// there, like ulp_load_binary() followed by ulp_run(). The binary must
+// have been built for that address and fit in the rest of memory.
+// Memory below `addr` is kept, such as data shared with other programs.
+func (u *UlpEmu) LoadBinaryAt(bin []uint8, addr int) error {
+	if addr < 0 || addr >= u.MemoryWords() {
+		return fmt.Errorf("load address %d is outside of the %d words of memory", addr, u.MemoryWords())
+	}
 	// check header
-	header := []uint8{'u', 'l', 'p', 0}
-	if !reflect.DeepEqual(header, bin[0:4]) {
-		return fmt.Errorf("invalid header: %v", header)
+	h, err := ParseHeader(bin)
+	if err != nil {
+		return err
 	}
-	text_offset_binary := int(bin[4]) | (int(bin[5]) << 8)
-	text_size := int(bin[6]) | (int(bin[7]) << 8)
-	u.dataOffset = text_size / 4
+	err = h.Validate(len(bin), (u.MemoryWords()-addr)*4)
+	if err != nil {
+		return err
+	}
+	u.dataOffset = addr + h.TextSize/4
 	// clear memory
-	for i := 0; i < len(u.Memory); i++ {
+	for i := addr; i < u.MemoryWords(); i++ {
 		u.Memory[i] = 0
 	}
 	// load binary
-	code := bin[text_offset_binary:]
+	code := bin[h.TextOffset:]
 	for i := 0; i < len(code)/4; i++ {
 		j := i * 4
-		u.Memory[i] = binary.LittleEndian.Uint32(code[j : j+4])
+		u.Memory[addr+i] = binary.LittleEndian.Uint32(code[j : j+4])
 	}
-	u.IP = 0     // this is just a convention
+	u.IP = uint16(addr) // this is just a convention
+	u.Entry = u.IP
+	u.Wake = false
+	u.Halted = false
+	u.Timer = true // enabled by ulp_run()
+	u.SleepSel = 0
+	u.Runs = 1
 	u.cycles = 0 // reset the cycles
+	u.elapsed = 0
 	return nil
 }
 
+// Write copies little endian words into memory starting
+// at word address `addr`, as the host would.
+func (u *UlpEmu) Write(addr int, data []byte) error {
+	if len(data)%4 != 0 {
+		return fmt.Errorf("data is %d bytes, expected a multiple of 4", len(data))
+	}
+	if addr < 0 || addr+len(data)/4 > u.MemoryWords() {
+		return fmt.Errorf("writing %d bytes at word %d is outside of the %d words of memory", len(data), addr, u.MemoryWords())
+	}
+	for i := 0; i < len(data)/4; i++ {
+		u.Memory[addr+i] = binary.LittleEndian.Uint32(data[i*4:])
+		if u.Checker != nil {
+			u.Checker.mark(addr + i)
+		}
+	}
+	return nil
+}
+
+// Tick executes a single instruction. If the program is halted then
+// the timer restarts it at the entry point instead, after the period
+// selected by the last sleep instruction.
 func (u *UlpEmu) Tick() error {
+	if u.Halted {
+		return u.restart()
+	}
 	instr, err := u.Fetch()
 	if err != nil {
 		return err
 	}
-	return u.DecodeExecute(instr)
+	ip, r3 := u.IP, u.R[3]
+	if u.Trace != nil {
+		err = u.traceExecute(instr)
+	} else {
+		err = u.DecodeExecute(instr)
+	}
+	if err != nil {
+		return err
+	}
+	if u.Coverage != nil {
+		u.Coverage.record(instr, ip, u.IP)
+	}
+	return u.checkExecuted(instr, ip, r3)
 }
 
 func (u *UlpEmu) Fetch() (uint32, error) {
-	if int(u.IP) >= len(u.Memory) {
+	if int(u.IP) >= u.MemoryWords() {
 		return 0, fmt.Errorf("Fetch out of bounds: 0x%X", u.IP)
 	}
 	intsr := u.Memory[u.IP]
@@ -60,11 +164,14 @@ func (u *UlpEmu) Fetch() (uint32, error) {
 }
 
 func (u *UlpEmu) DecodeExecute(instr uint32) error {
+	cycles, err := u.cost(instr)
+	if err != nil {
+		return err
+	}
 	op := bitRead(instr, 28, 4)
 	subOp := bitRead(instr, 25, 3)
 	switch op {
 	case 7: // operations
-		u.cycles += 4 // 2 execute 4 fetch, but tested differently
 		u.IP++
 		rdst := bitRead(instr, 0, 2)
 		rsrc1 := bitRead(instr, 2, 2)
@@ -183,27 +290,33 @@ func (u *UlpEmu) DecodeExecute(instr uint32) error {
 		value := (upper << 16) | lower
 		address := u.R[rdst] + uint16(offset)
 		address = address & 0x7FF
-		if int(address) >= len(u.Memory) {
+		if int(address) >= u.MemoryWords() {
 			return fmt.Errorf("storing outside of bounds at address 0x%X", address)
 		}
+		err = u.checkStore(int(address))
+		if err != nil {
+			return err
+		}
+		u.traceWrite(int(address), u.Memory[address], value)
 		u.Memory[address] = value
 		u.IP++
-		u.cycles += 8
 	case 13: // load
 		rdst := bitRead(instr, 0, 2)
 		rsrc := bitRead(instr, 2, 2)
 		offset := bitRead(instr, 10, 11)
 		address := u.R[rsrc] + uint16(offset)
 		address = address & 0x7FF
-		if int(address) >= len(u.Memory) {
+		if int(address) >= u.MemoryWords() {
 			return fmt.Errorf("loading outside of bounds at address 0x%X", address)
 		}
+		err = u.checkLoad(int(address))
+		if err != nil {
+			return err
+		}
 		value := u.Memory[address]
 		u.R[rdst] = uint16(value)
 		u.IP++
-		u.cycles += 8 // 4 execute + 4 fetch
 	case 8: // jump
-		u.cycles += 4 // 2 execute + 2 fetch
 		switch subOp {
 		case 0: // jump
 			rdst := bitRead(instr, 0, 2)
@@ -275,18 +388,112 @@ func (u *UlpEmu) DecodeExecute(instr uint32) error {
 		default:
 			return fmt.Errorf("unknown jump subOp %v", subOp)
 		}
-	case 9: // wake
-		u.Wake = true
+	case 9: // wake, sleep
+		if subOp == 0 {
+			u.Wake = true
+		} else {
+			sel := int(bitRead(instr, 0, 16))
+			if sel >= SleepRegisters {
+				return fmt.Errorf("sleep register %d must be less than %d", sel, SleepRegisters)
+			}
+			u.SleepSel = sel
+		}
 		u.IP++
-		u.cycles += 85 // 2 execute 4 fetch, but tested differently
+	case 11: // halt
+		u.Halted = true
 	case 4: // wait
-		imm := bitRead(instr, 0, 16)
 		u.IP++
-		u.cycles += 6           // 2 execute 4 fetch
-		u.cycles += uint64(imm) // add on the wait cycles
+	case 1: // reg_wr
+		err := u.regWrite(instr)
+		if err != nil {
+			return err
+		}
+		u.IP++
+	case 2: // reg_rd
+		err := u.regRead(instr)
+		if err != nil {
+			return err
+		}
+		u.IP++
+	case 3: // i2c_rd, i2c_wr
+		cycles, err = u.i2c(instr)
+		if err != nil {
+			return err
+		}
+		cycles = u.peripheralCost(cycles)
+		u.IP++
+	case 5: // adc
+		cycles, err = u.adc(instr)
+		if err != nil {
+			return err
+		}
+		cycles = u.peripheralCost(cycles)
+		u.IP++
 	default:
 		return fmt.Errorf("unknown operation %v", op)
 	}
+	u.cycles += cycles
+	u.elapsed += cycles
+	return nil
+}
+
+// restart waits for the timer then starts the program at the entry
+// point. The registers keep their values.
+func (u *UlpEmu) restart() error {
+	if !u.Timer {
+		return fmt.Errorf("halted with the timer stopped")
+	}
+	u.elapsed += u.SleepCycles[u.SleepSel]
+	u.IP = u.Entry
+	u.Halted = false
+	u.Runs++
+	return nil
+}
+
+// Elapsed returns the number of cycles since loading,
+// including the time spent halted.
+func (u *UlpEmu) Elapsed() uint64 {
+	return u.elapsed
+}
+
+// RunUntilHalt runs until the program executes halt, failing after
+// `maxCycles`. A halted program is first restarted by the timer.
+func (u *UlpEmu) RunUntilHalt(maxCycles uint64) error {
+	if u.Halted {
+		err := u.restart()
+		if err != nil {
+			return err
+		}
+	}
+	start := u.cycles
+	for !u.Halted {
+		if u.cycles-start >= maxCycles {
+			return fmt.Errorf("exceeded %d cycles without halting", maxCycles)
+		}
+		err := u.Tick()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunWakeCycles runs the program `n` times, each until it halts and is
+// restarted by the timer, calling `check` after each run if not nil.
+// Each run fails after `maxCycles`.
+func (u *UlpEmu) RunWakeCycles(n int, maxCycles uint64, check func(run int) error) error {
+	for i := 0; i < n; i++ {
+		err := u.RunUntilHalt(maxCycles)
+		if err != nil {
+			return fmt.Errorf("run %d: %w", i, err)
+		}
+		if check != nil {
+			err = check(i)
+			if err != nil {
+				return fmt.Errorf("run %d: %w", i, err)
+			}
+		}
+	}
 	return nil
 }
 
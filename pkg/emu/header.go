@@ -0,0 +1,82 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package emu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// HeaderSize is the size of the header at the start of a ULP binary.
+const HeaderSize = 12
+
+var headerMagic = []byte{'u', 'l', 'p', 0}
+
+// Header is the header at the start of a ULP binary, as read by ulp_load_binary().
+type Header struct {
+	TextOffset int `json:"text_offset"` // offset of the .text section within the binary
+	TextSize   int `json:"text_size"`   // size of the .text section in bytes
+	DataSize   int `json:"data_size"`   // size of the .data section in bytes
+	BssSize    int `json:"bss_size"`    // size of the .bss section in bytes, includes the stack
+}
+
+// IsBinary returns true if `bin` starts with the ULP binary magic number.
+func IsBinary(bin []byte) bool {
+	return bytes.HasPrefix(bin, headerMagic)
+}
+
+// ParseHeader reads the header at the start of a ULP binary.
+func ParseHeader(bin []byte) (Header, error) {
+	if len(bin) < HeaderSize {
+		return Header{}, fmt.Errorf("binary is %d bytes but the header needs %d", len(bin), HeaderSize)
+	}
+	if !IsBinary(bin) {
+		return Header{}, fmt.Errorf("invalid magic number %v, expected %v", bin[0:4], headerMagic)
+	}
+	h := Header{
+		TextOffset: int(binary.LittleEndian.Uint16(bin[4:6])),
+		TextSize:   int(binary.LittleEndian.Uint16(bin[6:8])),
+		DataSize:   int(binary.LittleEndian.Uint16(bin[8:10])),
+		BssSize:    int(binary.LittleEndian.Uint16(bin[10:12])),
+	}
+	return h, nil
+}
+
+// Validate checks that the header is consistent with a binary
+// of `length` bytes that must fit within `reserved` bytes of memory.
+func (h Header) Validate(length int, reserved int) error {
+	errs := error(nil)
+	if h.TextOffset < HeaderSize {
+		errs = errors.Join(errs, fmt.Errorf("text offset %d overlaps the %d byte header", h.TextOffset, HeaderSize))
+	}
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{"text offset", h.TextOffset},
+		{".text size", h.TextSize},
+		{".data size", h.DataSize},
+		{".bss size", h.BssSize},
+	}
+	for _, s := range sizes {
+		if s.size%4 != 0 {
+			errs = errors.Join(errs, fmt.Errorf("%s %d is not a multiple of 4", s.name, s.size))
+		}
+	}
+	expect := h.TextOffset + h.TextSize + h.DataSize
+	if expect != length {
+		errs = errors.Join(errs, fmt.Errorf("binary is %d bytes but the header expects %d", length, expect))
+	}
+	total := h.TextSize + h.DataSize + h.BssSize
+	if total > reserved {
+		errs = errors.Join(errs, fmt.Errorf("sections use %d bytes but only %d are reserved", total, reserved))
+	}
+	return errs
+}
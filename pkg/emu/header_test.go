@@ -0,0 +1,155 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package emu_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+func header(textOffset, text, data, bss int) []byte {
+	b := []byte{'u', 'l', 'p', 0}
+	for _, v := range []int{textOffset, text, data, bss} {
+		b = append(b, byte(v), byte(v>>8))
+	}
+	return b
+}
+
+func TestHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		bin      []byte
+		reserved int
+		err      string // part of the error, if expected
+	}{
+		{
+			name:     "valid",
+			bin:      append(header(12, 4, 4, 8), make([]byte, 8)...),
+			reserved: 16,
+		},
+		{
+			name:     "short",
+			bin:      []byte{'u', 'l', 'p'},
+			reserved: 16,
+			err:      "header needs 12",
+		},
+		{
+			name:     "magic",
+			bin:      append([]byte("elf"), make([]byte, 9)...),
+			reserved: 16,
+			err:      "invalid magic number",
+		},
+		{
+			name:     "truncated",
+			bin:      append(header(12, 4, 4, 8), make([]byte, 4)...),
+			reserved: 16,
+			err:      "binary is 16 bytes but the header expects 20",
+		},
+		{
+			name:     "unaligned",
+			bin:      append(header(12, 2, 2, 0), make([]byte, 4)...),
+			reserved: 16,
+			err:      ".text size 2 is not a multiple of 4",
+		},
+		{
+			name:     "overlapping",
+			bin:      append(header(8, 8, 0, 0), make([]byte, 0)...),
+			reserved: 16,
+			err:      "overlaps",
+		},
+		{
+			name:     "too large",
+			bin:      append(header(12, 4, 4, 16), make([]byte, 8)...),
+			reserved: 16,
+			err:      "sections use 24 bytes but only 16 are reserved",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := emu.ParseHeader(tt.bin)
+			if err == nil {
+				err = h.Validate(len(tt.bin), tt.reserved)
+			}
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing \"%s\" got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestLoadBinaryShort(t *testing.T) {
+	u := emu.UlpEmu{}
+	err := u.LoadBinary([]byte{'u', 'l'})
+	if err == nil {
+		t.Errorf("expected an error from a short binary")
+	}
+}
+
+func TestLoadBinaryAt(t *testing.T) {
+	// 8 bytes of .text and 4 of .data, with 16 bytes of .bss
+	bin := []byte{'u', 'l', 'p', 0, 12, 0, 8, 0, 4, 0, 16, 0}
+	bin = append(bin, 1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0)
+	tests := []struct {
+		name string
+		size int
+		addr int
+		err  string
+	}{
+		{name: "start", size: 28, addr: 0},
+		{name: "offset", size: 64, addr: 4},
+		{name: "exact fit", size: 44, addr: 4},
+		{name: "too small", size: 40, addr: 4, err: "only 24 are reserved"},
+		{name: "outside", size: 64, addr: 16, err: "outside of the 16 words"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := emu.NewUlpEmu(tt.size)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			err = u.LoadBinaryAt(bin, tt.addr)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expected error containing \"%s\" got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if int(u.IP) != tt.addr {
+				t.Errorf("expected to start at %d got %d", tt.addr, u.IP)
+			}
+			for i, v := range []uint32{1, 2, 3} {
+				if u.Memory[tt.addr+i] != v {
+					t.Errorf("expected %d at word %d got %d", v, tt.addr+i, u.Memory[tt.addr+i])
+				}
+			}
+		})
+	}
+
+	for _, size := range []int{0, 6, 8180} {
+		_, err := emu.NewUlpEmu(size)
+		if err == nil {
+			t.Errorf("expected an error for %d bytes of memory", size)
+		}
+	}
+	u := emu.UlpEmu{}
+	err := u.LoadBinary(bin)
+	if err != nil || u.MemoryWords()*4 != emu.DefaultMemorySize {
+		t.Errorf("expected the default memory size got %d bytes, %v", u.MemoryWords()*4, err)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package emu
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultI2cCycles is the cost of a single i2c_rd or i2c_wr, about a
+// register access at 100 kHz. It is also used by static timing analysis.
+const DefaultI2cCycles = 3040
+
+// RegSensSlaveAddr1 is the word address of SENS_SAR_SLAVE_ADDR1_REG. It and
+// the next 3 registers hold the 8 slave addresses i2c_rd and i2c_wr select.
+const RegSensSlaveAddr1 = 0x20F
+
+// ErrI2cNack is returned by a device to not acknowledge a transaction.
+var ErrI2cNack = errors.New("nack")
+
+// I2cDevice is a simulated I2C slave. Returning an error is a NACK.
+type I2cDevice interface {
+	ReadI2c(reg uint8) (uint8, error)
+	WriteI2c(reg uint8, value uint8) error
+}
+
+// I2cTransaction is a single i2c_rd or i2c_wr.
+type I2cTransaction struct {
+	Cycle uint64 // Elapsed() when it started
+	Addr  uint16 // slave address
+	Reg   uint8  // register of the slave
+	Value uint8  // the byte read or written
+	Write bool
+	Nack  bool // if it was not acknowledged, such as no device at Addr
+}
+
+// I2cBus connects simulated devices to the RTC I2C controller.
+type I2cBus struct {
+	Devices      map[uint16]I2cDevice // by slave address
+	Cycles       uint64               // cost of each transaction, DefaultI2cCycles if 0
+	StrictNack   bool                 // if a NACK stops the emulator with an error
+	Transactions []I2cTransaction     // every transaction in order
+}
+
+// NewI2cBus creates a bus without devices.
+func NewI2cBus() *I2cBus {
+	return &I2cBus{
+		Devices:      make(map[uint16]I2cDevice),
+		Transactions: make([]I2cTransaction, 0),
+	}
+}
+
+// SetI2cSlave sets one of the 8 slave addresses selected by i2c_rd
+// and i2c_wr, as SENS_I2C_SLAVE_ADDRn would.
+func (u *UlpEmu) SetI2cSlave(sel int, addr uint16) error {
+	if sel < 0 || sel >= 8 {
+		return fmt.Errorf("slave select %d must be less than 8", sel)
+	}
+	reg, shift := i2cSlaveField(uint32(sel))
+	u.bus().WriteRegister(reg, uint32(addr)<<shift, 0x7FF<<shift)
+	return nil
+}
+
+// i2cSlaveField returns the register and bit of a slave address,
+// SENS_I2C_SLAVE_ADDR0 is in the upper field of the first register.
+func i2cSlaveField(sel uint32) (uint16, uint32) {
+	reg := uint16(RegSensSlaveAddr1 + sel/2)
+	if sel%2 == 0 {
+		return reg, 11
+	}
+	return reg, 0
+}
+
+// i2c executes i2c_rd and i2c_wr, returning the cycles taken.
+func (u *UlpEmu) i2c(instr uint32) (uint64, error) {
+	if u.I2c == nil {
+		u.I2c = NewI2cBus()
+	}
+	b := u.I2c
+	reg := uint8(bitRead(instr, 0, 8))
+	data := bitRead(instr, 8, 8)
+	low := bitRead(instr, 16, 3)
+	high := bitRead(instr, 19, 3)
+	sel := bitRead(instr, 22, 4)
+	write := bitRead(instr, 27, 1) == 1
+	if high < low {
+		return 0, fmt.Errorf("i2c high bit %d is below low bit %d", high, low)
+	}
+	if sel >= 8 {
+		return 0, fmt.Errorf("slave select %d must be less than 8", sel)
+	}
+	field, shift := i2cSlaveField(sel)
+	addr := uint16((u.bus().ReadRegister(field) >> shift) & 0x7FF)
+
+	t := I2cTransaction{Cycle: u.elapsed, Addr: addr, Reg: reg, Write: write}
+	mask := bitRange(high-low+1) << low
+	err := ErrI2cNack
+	dev, ok := b.Devices[addr]
+	if write {
+		t.Value = uint8((data << low) & mask) // bits outside the range are 0
+		if ok {
+			err = dev.WriteI2c(reg, t.Value)
+		}
+	} else {
+		if ok {
+			t.Value, err = dev.ReadI2c(reg)
+		}
+		if err == nil {
+			u.R[0] = uint16((uint32(t.Value) & mask) >> low)
+		} else {
+			u.R[0] = 0
+		}
+	}
+	t.Nack = err != nil
+	b.Transactions = append(b.Transactions, t)
+	if t.Nack && b.StrictNack {
+		return 0, fmt.Errorf("i2c nack from 0x%02X register 0x%02X: %s", addr, reg, err)
+	}
+	if b.Cycles != 0 {
+		return b.Cycles, nil
+	}
+	return DefaultI2cCycles, nil
+}
+
+// I2cRegisterFile is a device with 256 byte registers, like most sensors.
+// Reads of a register return its scripted values in order, then the last
+// value written or scripted.
+type I2cRegisterFile struct {
+	Registers [256]uint8
+	ReadOnly  [256]bool // writes to these registers are not acknowledged
+	script    map[uint8][]uint8
+}
+
+// NewI2cRegisterFile creates a device with every register 0.
+func NewI2cRegisterFile() *I2cRegisterFile {
+	return &I2cRegisterFile{script: make(map[uint8][]uint8)}
+}
+
+// Script queues values returned by the next reads of a register,
+// such as a sensor taking several measurements.
+func (d *I2cRegisterFile) Script(reg uint8, values ...uint8) {
+	d.script[reg] = append(d.script[reg], values...)
+}
+
+func (d *I2cRegisterFile) ReadI2c(reg uint8) (uint8, error) {
+	if values := d.script[reg]; len(values) != 0 {
+		d.Registers[reg] = values[0]
+		d.script[reg] = values[1:]
+	}
+	return d.Registers[reg], nil
+}
+
+func (d *I2cRegisterFile) WriteI2c(reg uint8, value uint8) error {
+	if d.ReadOnly[reg] {
+		return ErrI2cNack
+	}
+	d.Registers[reg] = value
+	return nil
+}
+
+// I2cFuncs is a device implemented by functions. A nil function
+// does not acknowledge.
+type I2cFuncs struct {
+	Read  func(reg uint8) (uint8, error)
+	Write func(reg uint8, value uint8) error
+}
+
+func (d I2cFuncs) ReadI2c(reg uint8) (uint8, error) {
+	if d.Read == nil {
+		return 0, ErrI2cNack
+	}
+	return d.Read(reg)
+}
+
+func (d I2cFuncs) WriteI2c(reg uint8, value uint8) error {
+	if d.Write == nil {
+		return ErrI2cNack
+	}
+	return d.Write(reg, value)
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package emu_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+func TestI2cSensor(t *testing.T) {
+	// configure the sensor, wait until it is ready, then
+	// wake the esp32 if the measurement is at least 50
+	u, symbols := build(t, `
+		i2c_wr 0x10, 3, 7, 0, 0
+	poll:
+		i2c_rd 0x00, 0, 0, 0
+		and r0, r0, 1
+		jump poll, eq
+		i2c_rd 0x01, 7, 0, 0
+		move r1, result
+		st r0, r1, 0
+		jumpr done, 50, lt
+		wake
+	done:
+		halt
+		.data
+	result: .int 0
+	`)
+	sensor := emu.NewI2cRegisterFile()
+	sensor.Script(0x00, 0, 0, 1)
+	sensor.Script(0x01, 42, 77)
+	u.I2c = emu.NewI2cBus()
+	u.I2c.Devices[0x48] = sensor
+	err := u.SetI2cSlave(0, 0x48)
+	if err != nil {
+		t.Fatalf("Failed to select the sensor: %s", err)
+	}
+
+	expected := []struct {
+		result uint32
+		wake   bool
+	}{
+		{42, false},
+		{77, true},
+	}
+	result := symbols["result"]
+	for i, e := range expected {
+		err = u.RunUntilHalt(100000)
+		if err != nil {
+			t.Fatalf("Failed to run: %s", err)
+		}
+		if got := u.Memory[result] & 0xFFFF; got != e.result || u.Wake != e.wake {
+			t.Errorf("Run %d expected %d and wake %v, got %d and %v", i, e.result, e.wake, got, u.Wake)
+		}
+	}
+	if sensor.Registers[0x10] != 3 {
+		t.Errorf("Expected the sensor to be configured")
+	}
+	// 1 write and 4 reads in the first run, 1 write and 2 reads in the second
+	if n := len(u.I2c.Transactions); n != 8 {
+		t.Errorf("Expected 8 transactions got %d", n)
+	}
+	first := u.I2c.Transactions[0]
+	if !first.Write || first.Addr != 0x48 || first.Reg != 0x10 || first.Value != 3 || first.Nack {
+		t.Errorf("Unexpected first transaction %+v", first)
+	}
+	if u.Elapsed() < 8*emu.DefaultI2cCycles {
+		t.Errorf("Expected each transaction to take %d cycles, elapsed %d", emu.DefaultI2cCycles, u.Elapsed())
+	}
+}
+
+func TestI2cBus(t *testing.T) {
+	u, symbols := build(t, `
+		move r1, result
+		i2c_rd 0x05, 7, 0, 1
+		st r0, r1, 0
+		i2c_wr 0x20, 0x3, 5, 4, 2
+		i2c_wr 0x21, 0xFF, 7, 0, 2
+		i2c_rd 0x22, 6, 3, 2
+		st r0, r1, 1
+		halt
+		.data
+	result: .int 0xFFFF, 0
+	`)
+	written := make(map[uint8]uint8)
+	u.I2c = emu.NewI2cBus()
+	u.I2c.Cycles = 100
+	u.I2c.Devices[0x20] = emu.I2cFuncs{
+		Read: func(reg uint8) (uint8, error) {
+			return 0b1011_0110, nil
+		},
+		Write: func(reg uint8, value uint8) error {
+			if reg == 0x21 {
+				return emu.ErrI2cNack
+			}
+			written[reg] = value
+			return nil
+		},
+	}
+	u.SetI2cSlave(2, 0x20)
+	err := u.RunUntilHalt(10000)
+	if err != nil {
+		t.Fatalf("Failed to run: %s", err)
+	}
+	result := symbols["result"]
+	if got := u.Memory[result] & 0xFFFF; got != 0 {
+		t.Errorf("Expected 0 without a device got %d", got)
+	}
+	if got := u.Memory[result+1] & 0xFFFF; got != 0b0110 {
+		t.Errorf("Expected bits 3 to 6 got %b", got)
+	}
+	if written[0x20] != 0x30 {
+		t.Errorf("Expected bits 4 and 5 to be written got 0x%X", written[0x20])
+	}
+	nacks := 0
+	for _, tr := range u.I2c.Transactions {
+		if tr.Nack {
+			nacks++
+		}
+	}
+	if nacks != 2 {
+		t.Errorf("Expected 2 nacks got %+v", u.I2c.Transactions)
+	}
+
+	// stop at the first nack
+	u, _ = build(t, "i2c_rd 0x05, 7, 0, 1\nhalt")
+	u.I2c = emu.NewI2cBus()
+	u.I2c.StrictNack = true
+	u.SetI2cSlave(1, 0x3C)
+	err = u.RunUntilHalt(10000)
+	if err == nil || !strings.Contains(err.Error(), "i2c nack from 0x3C register 0x05") {
+		t.Errorf("Expected a nack error got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package emu
+
+import "fmt"
+
+// RegisterBus is the peripheral registers read by reg_rd and written by
+// reg_wr. Addresses are in words from DR_REG_RTCCNTL_BASE (0x3FF48000),
+// as encoded in the instructions.
+type RegisterBus interface {
+	ReadRegister(addr uint16) uint32
+	WriteRegister(addr uint16, value uint32, mask uint32) // only the bits in mask are written
+}
+
+// Word addresses of the registers modelled by RtcRegisters.
+const (
+	RegRtcCntlState0     = 0x006 // RTC_CNTL_STATE0_REG
+	RegRtcCntlLowPowerSt = 0x030 // RTC_CNTL_LOW_POWER_ST_REG
+	RegRtcGpioOut        = 0x100 // RTC_GPIO_OUT_REG
+	RegRtcGpioOutW1ts    = 0x101 // RTC_GPIO_OUT_W1TS_REG
+	RegRtcGpioOutW1tc    = 0x102 // RTC_GPIO_OUT_W1TC_REG
+	RegRtcGpioEnable     = 0x103 // RTC_GPIO_ENABLE_REG
+	RegRtcGpioEnableW1ts = 0x104 // RTC_GPIO_ENABLE_W1TS_REG
+	RegRtcGpioEnableW1tc = 0x105 // RTC_GPIO_ENABLE_W1TC_REG
+	RegRtcGpioIn         = 0x109 // RTC_GPIO_IN_REG
+)
+
+const (
+	// RtcGpioPins is the number of RTC GPIO pins.
+	RtcGpioPins = 18
+	// rtcGpioShift is the bit of RTC GPIO 0 in the RTC_IO registers.
+	rtcGpioShift = 14
+	// timerEnable is RTC_CNTL_ULP_CP_SLP_TIMER_EN in RTC_CNTL_STATE0_REG.
+	timerEnable = 1 << 24
+	// readyForWakeup is RTC_CNTL_RDY_FOR_WAKEUP in RTC_CNTL_LOW_POWER_ST_REG.
+	readyForWakeup = 1 << 19
+)
+
+// PinEvent is a change of the level driven on an RTC GPIO pin.
+type PinEvent struct {
+	Cycle uint64 // Elapsed() when it changed
+	Pin   int    // the RTC GPIO number
+	High  bool   // if the pin is enabled and driven high
+}
+
+// RtcRegisters is a model of the ESP32 RTC_CNTL, RTC_IO and SENS
+// registers. Registers that are not modelled keep the value written.
+type RtcRegisters struct {
+	Events []PinEvent // every change of an output pin
+	emu    *UlpEmu
+	values map[uint16]uint32
+	input  uint32 // the level of each input pin, bit 0 is RTC GPIO 0
+}
+
+// NewRtcRegisters creates the registers of an emulator. The timer enable
+// bit of RTC_CNTL_STATE0_REG is UlpEmu.Timer.
+func NewRtcRegisters(u *UlpEmu) *RtcRegisters {
+	return &RtcRegisters{
+		Events: make([]PinEvent, 0),
+		emu:    u,
+		values: make(map[uint16]uint32),
+	}
+}
+
+// SetInput sets the level read from an RTC GPIO pin.
+func (r *RtcRegisters) SetInput(pin int, high bool) error {
+	if pin < 0 || pin >= RtcGpioPins {
+		return fmt.Errorf("RTC GPIO %d must be less than %d", pin, RtcGpioPins)
+	}
+	if high {
+		r.input |= 1 << pin
+	} else {
+		r.input &^= 1 << pin
+	}
+	return nil
+}
+
+// Output returns true if an RTC GPIO pin is enabled and driven high.
+func (r *RtcRegisters) Output(pin int) bool {
+	return r.driven()&(1<<(pin+rtcGpioShift)) != 0
+}
+
+// Enabled returns true if an RTC GPIO pin is an output.
+func (r *RtcRegisters) Enabled(pin int) bool {
+	return r.values[RegRtcGpioEnable]&(1<<(pin+rtcGpioShift)) != 0
+}
+
+func (r *RtcRegisters) driven() uint32 {
+	return r.values[RegRtcGpioOut] & r.values[RegRtcGpioEnable]
+}
+
+func (r *RtcRegisters) ReadRegister(addr uint16) uint32 {
+	switch addr {
+	case RegRtcCntlState0:
+		v := r.values[addr] &^ timerEnable
+		if r.emu != nil && r.emu.Timer {
+			v |= timerEnable
+		}
+		return v
+	case RegRtcCntlLowPowerSt:
+		return readyForWakeup // the ULP can always wake the esp32
+	case RegRtcGpioIn:
+		return r.input << rtcGpioShift
+	case RegRtcGpioOutW1ts, RegRtcGpioOutW1tc, RegRtcGpioEnableW1ts, RegRtcGpioEnableW1tc:
+		return 0 // write only
+	default:
+		return r.values[addr]
+	}
+}
+
+func (r *RtcRegisters) WriteRegister(addr uint16, value uint32, mask uint32) {
+	before := r.driven()
+	set := value & mask
+	switch addr {
+	case RegRtcCntlLowPowerSt, RegRtcGpioIn:
+		return // read only
+	case RegRtcCntlState0:
+		r.values[addr] = (r.values[addr] &^ mask) | set
+		if r.emu != nil && mask&timerEnable != 0 {
+			r.emu.Timer = set&timerEnable != 0
+		}
+	case RegRtcGpioOutW1ts:
+		r.values[RegRtcGpioOut] |= set
+	case RegRtcGpioOutW1tc:
+		r.values[RegRtcGpioOut] &^= set
+	case RegRtcGpioEnableW1ts:
+		r.values[RegRtcGpioEnable] |= set
+	case RegRtcGpioEnableW1tc:
+		r.values[RegRtcGpioEnable] &^= set
+	default:
+		r.values[addr] = (r.values[addr] &^ mask) | set
+	}
+	r.recordPins(before)
+}
+
+// recordPins adds an event for each output pin that changed.
+func (r *RtcRegisters) recordPins(before uint32) {
+	after := r.driven()
+	changed := (before ^ after) >> rtcGpioShift
+	for pin := 0; pin < RtcGpioPins; pin++ {
+		if changed&(1<<pin) == 0 {
+			continue
+		}
+		e := PinEvent{Pin: pin, High: r.Output(pin)}
+		if r.emu != nil {
+			e.Cycle = r.emu.Elapsed()
+		}
+		r.Events = append(r.Events, e)
+	}
+}
+
+// regRead reads bits `low` to `high` of a register into R0.
+func (u *UlpEmu) regRead(instr uint32) error {
+	addr, high, low := uint16(bitRead(instr, 0, 10)), bitRead(instr, 23, 5), bitRead(instr, 18, 5)
+	if high < low {
+		return fmt.Errorf("reg_rd high bit %d is below low bit %d", high, low)
+	}
+	value := u.bus().ReadRegister(addr) >> low
+	u.R[0] = uint16(value & bitRange(high-low+1))
+	return nil
+}
+
+// regWrite writes up to 8 bits of data to bits `low` to `high` of a
+// register, leaving the other bits unchanged.
+func (u *UlpEmu) regWrite(instr uint32) error {
+	addr, high, low := uint16(bitRead(instr, 0, 10)), bitRead(instr, 23, 5), bitRead(instr, 18, 5)
+	data := bitRead(instr, 10, 8)
+	if high < low {
+		return fmt.Errorf("reg_wr high bit %d is below low bit %d", high, low)
+	}
+	mask := bitRange(high-low+1) << low
+	u.bus().WriteRegister(addr, data<<low, mask)
+	return nil
+}
+
+// bus returns the register bus, creating RtcRegisters if there is none.
+func (u *UlpEmu) bus() RegisterBus {
+	if u.Bus == nil {
+		u.Bus = NewRtcRegisters(u)
+	}
+	return u.Bus
+}
+
+// bitRange returns a mask of the lowest `n` bits.
+func bitRange(n uint32) uint32 {
+	if n >= 32 {
+		return 0xFFFFFFFF
+	}
+	return (1 << n) - 1
+}
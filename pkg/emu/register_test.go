@@ -0,0 +1,127 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package emu_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+func TestRegisterBlink(t *testing.T) {
+	// blink RTC GPIO 10 three times
+	u, _ := build(t, `
+		reg_wr 0x104, 24, 24, 1
+	loop:
+		reg_wr 0x101, 24, 24, 1
+		wait 100
+		reg_wr 0x102, 24, 24, 1
+		wait 100
+		stage_inc 1
+		jumps loop, 3, lt
+		halt
+	`)
+	err := u.RunUntilHalt(10000)
+	if err != nil {
+		t.Fatalf("Failed to run: %s", err)
+	}
+	regs := u.Bus.(*emu.RtcRegisters)
+	if len(regs.Events) != 6 {
+		t.Fatalf("Expected 6 pin changes got %+v", regs.Events)
+	}
+	for i, e := range regs.Events {
+		if e.Pin != 10 || e.High != (i%2 == 0) {
+			t.Errorf("Unexpected event %d: %+v", i, e)
+		}
+		if i%2 == 1 && e.Cycle-regs.Events[i-1].Cycle != 118 {
+			t.Errorf("Expected to be high for 118 cycles, got %d", e.Cycle-regs.Events[i-1].Cycle)
+		}
+	}
+	if !regs.Enabled(10) || regs.Output(10) {
+		t.Errorf("Expected pin 10 to be an output driven low")
+	}
+}
+
+func TestRegisterButton(t *testing.T) {
+	// wake the esp32 when RTC GPIO 11 is high
+	u, _ := build(t, `
+	poll:
+		reg_rd 0x109, 25, 25
+		and r0, r0, 1
+		jump poll, eq
+		wake
+		halt
+	`)
+	for i := 0; i < 50; i++ {
+		if err := u.Tick(); err != nil {
+			t.Fatalf("Failed to run: %s", err)
+		}
+	}
+	if u.Wake || u.Halted {
+		t.Fatalf("Expected to keep polling")
+	}
+	err := u.Bus.(*emu.RtcRegisters).SetInput(11, true)
+	if err != nil {
+		t.Fatalf("Failed to set input: %s", err)
+	}
+	err = u.RunUntilHalt(1000)
+	if err != nil || !u.Wake {
+		t.Errorf("Expected to wake after the button press: %v", err)
+	}
+}
+
+func TestRegisterFields(t *testing.T) {
+	u, symbols := build(t, `
+		reg_wr 0x200, 7, 4, 0x5
+		reg_rd 0x200, 11, 4
+		move r1, result
+		st r0, r1, 0
+		reg_wr 0x200, 15, 4, 0xFF
+		reg_rd 0x200, 15, 0
+		st r0, r1, 1
+		reg_wr 0x109, 31, 24, 0xFF
+		reg_rd 0x109, 31, 14
+		st r0, r1, 2
+		reg_rd 0x030, 19, 19
+		st r0, r1, 3
+		halt
+		.data
+	result: .int 0, 0, 0, 0
+	`)
+	u.Bus = emu.NewRtcRegisters(u)
+	u.Bus.WriteRegister(0x200, 0xFFFF, 0xFFFF)
+	err := u.RunUntilHalt(1000)
+	if err != nil {
+		t.Fatalf("Failed to run: %s", err)
+	}
+	result := symbols["result"]
+	expected := []uint32{
+		0xF5,   // only bits 4 to 7 are written
+		0x0FFF, // data is 8 bits, so bits 12 to 15 are cleared
+		0,      // inputs are read only
+		1,      // always ready for wakeup
+	}
+	for i, e := range expected {
+		if got := u.Memory[result+i] & 0xFFFF; got != e {
+			t.Errorf("Expected result %d to be 0x%X got 0x%X", i, e, got)
+		}
+	}
+}
+
+func TestRegisterTimer(t *testing.T) {
+	// stop the timer, as ulp_timer_stop() would
+	u, _ := build(t, `
+		reg_wr 0x006, 24, 24, 0
+		halt
+	`)
+	err := u.RunWakeCycles(2, 100, nil)
+	if err == nil || !strings.Contains(err.Error(), "halted with the timer stopped") {
+		t.Errorf("Expected the timer to be stopped, got %v", err)
+	}
+}
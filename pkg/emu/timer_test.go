@@ -0,0 +1,125 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package emu_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Molorius/ulp-c/pkg/asm"
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+// build assembles a program and loads it into a new emulator.
+func build(t *testing.T, src string) (*emu.UlpEmu, map[string]int) {
+	t.Helper()
+	sources := []asm.Source{{Name: "test.S", Content: []byte(src)}}
+	res, err := asm.Build(context.Background(), sources, asm.Options{ReservedBytes: 1024})
+	if err != nil {
+		t.Fatalf("Failed to build: %s", err)
+	}
+	u, err := emu.NewUlpEmu(1024)
+	if err != nil {
+		t.Fatalf("Failed to create emulator: %s", err)
+	}
+	err = u.LoadBinary(res.Binary)
+	if err != nil {
+		t.Fatalf("Failed to load: %s", err)
+	}
+	symbols := make(map[string]int)
+	for _, s := range res.Symbols {
+		symbols[s.Name] = s.Address
+	}
+	return u, symbols
+}
+
+func TestTimer(t *testing.T) {
+	// count each run, wake the esp32 on the third
+	u, symbols := build(t, `
+		sleep 1
+		move r1, count
+		ld r0, r1, 0
+		add r0, r0, 1
+		st r0, r1, 0
+		jumpr done, 3, lt
+		wake
+	done:
+		halt
+		.data
+	count: .int 0
+	`)
+	u.SleepCycles[1] = 1000
+	count := symbols["count"]
+	err := u.RunWakeCycles(4, 1000, func(run int) error {
+		if got := int(u.Memory[count] & 0xFFFF); got != run+1 {
+			return fmt.Errorf("expected count %d got %d", run+1, got)
+		}
+		if u.Wake != (run >= 2) {
+			return fmt.Errorf("unexpected wake %v", u.Wake)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to run: %s", err)
+	}
+	if u.Runs != 4 || u.SleepSel != 1 {
+		t.Errorf("Expected 4 runs with sleep register 1, got %d and %d", u.Runs, u.SleepSel)
+	}
+	if u.Elapsed() < 3*1000 || u.Elapsed() > 4*1000 {
+		t.Errorf("Expected 3 sleep periods to elapse, got %d cycles", u.Elapsed())
+	}
+
+	// a tick while halted restarts at the entry point
+	if !u.Halted {
+		t.Fatalf("Expected to be halted")
+	}
+	err = u.Tick()
+	if err != nil || u.Halted || u.IP != u.Entry || u.Runs != 5 {
+		t.Errorf("Expected to restart at %d, got %d: %v", u.Entry, u.IP, err)
+	}
+}
+
+func TestTimerErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		timer bool
+		err   string
+	}{
+		{
+			name:  "stopped",
+			src:   "halt",
+			timer: false,
+			err:   "run 1: halted with the timer stopped",
+		},
+		{
+			name:  "sleep register",
+			src:   "sleep 5\nhalt",
+			timer: true,
+			err:   "run 0: sleep register 5 must be less than 5",
+		},
+		{
+			name:  "never halts",
+			src:   "loop:\njump loop",
+			timer: true,
+			err:   "run 0: exceeded 100 cycles without halting",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, _ := build(t, tt.src)
+			u.Timer = tt.timer
+			err := u.RunWakeCycles(2, 100, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Expected error containing %q got %v", tt.err, err)
+			}
+		})
+	}
+}
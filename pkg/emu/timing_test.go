@@ -0,0 +1,257 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package emu_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Molorius/ulp-c/pkg/asm"
+	"github.com/Molorius/ulp-c/pkg/emu"
+	"github.com/Molorius/ulp-c/pkg/usb"
+)
+
+// trmCycles is the cycles of each instruction class with TimingAccurate,
+// as given by the ESP32 technical reference manual. Every program ends in
+// halt, which takes 2 cycles. This only checks the model against the
+// manual, TestHardwareCycles compares it with a device.
+var trmCycles = []struct {
+	name   string
+	src    string
+	cycles uint64
+	source string // where in the manual the cycles come from
+}{
+	{"halt", "halt", 2, "TRM"},
+	{"alu register", "add r0, r1, r2\nhalt", 6 + 2, "TRM"},
+	{"alu immediate", "move r0, 5\nhalt", 6 + 2, "TRM"},
+	{"stage count", "stage_inc 1\nhalt", 6 + 2, "TRM"},
+	{"store", "move r1, 100\nst r0, r1, 0\nhalt", 6 + 8 + 2, "TRM"},
+	{"load", "move r1, 100\nld r0, r1, 0\nhalt", 6 + 8 + 2, "TRM"},
+	{"jump", "jump a\na: halt", 4 + 2, "TRM"},
+	{"jumpr", "jumpr a, 1, lt\na: halt", 4 + 2, "TRM"},
+	{"jumps", "jumps a, 1, lt\na: halt", 4 + 2, "TRM"},
+	{"wait", "wait 100\nhalt", 106 + 2, "TRM"},
+	{"wake", "wake\nhalt", 6 + 2, "TRM"},
+	{"sleep", "sleep 0\nhalt", 6 + 2, "TRM"},
+	{"reg_rd", "reg_rd 0x109, 31, 14\nhalt", 8 + 2, "TRM"},
+	{"reg_wr", "reg_wr 0x100, 14, 14, 1\nhalt", 12 + 2, "TRM"},
+	{"adc", "adc r0, 0, 1\nhalt", emu.DefaultAdcCycles + 4 + 2, "TRM with the default SENS settings"},
+	{"i2c", "i2c_rd 0x00, 7, 0, 0\nhalt", emu.DefaultI2cCycles + 4 + 2, "TRM with the default bus cycles"},
+}
+
+func TestTrmCycles(t *testing.T) {
+	for _, c := range trmCycles {
+		t.Run(c.name, func(t *testing.T) {
+			u, _ := build(t, c.src)
+			u.Timing = emu.TimingAccurate
+			u.Adc = emu.NewAdc()
+			u.Adc.Set(0, 0, emu.ConstantSignal(0))
+			err := u.RunUntilHalt(1_000_000)
+			if err != nil {
+				t.Fatalf("Failed to run: %s", err)
+			}
+			if u.Elapsed() != c.cycles {
+				t.Errorf("Expected %d cycles (%s) got %d", c.cycles, c.source, u.Elapsed())
+			}
+		})
+	}
+}
+
+func TestTiming(t *testing.T) {
+	src := "move r0, 1\nwake\nhalt"
+	u, _ := build(t, src)
+	err := u.RunUntilHalt(1000)
+	if err != nil {
+		t.Fatalf("Failed to run: %s", err)
+	}
+	if u.Elapsed() != 4+85+2 {
+		t.Errorf("Expected the estimate to be %d cycles, got %d", 4+85+2, u.Elapsed())
+	}
+
+	// peripheral cycles are still used, plus the fetch
+	u, _ = build(t, "adc r0, 0, 1\nhalt")
+	u.Timing = emu.TimingAccurate
+	u.Adc = emu.NewAdc()
+	u.Adc.Set(0, 0, emu.ConstantSignal(0))
+	u.Adc.Cycles = 100
+	err = u.RunUntilHalt(1000)
+	if err != nil {
+		t.Fatalf("Failed to run: %s", err)
+	}
+	if u.Elapsed() != 100+4+2 {
+		t.Errorf("Expected %d cycles got %d", 100+4+2, u.Elapsed())
+	}
+
+	// wall time
+	u, _ = build(t, "wait 7992\nhalt")
+	u.Timing = emu.TimingAccurate
+	err = u.RunUntilHalt(10_000)
+	if err != nil {
+		t.Fatalf("Failed to run: %s", err)
+	}
+	if u.Time() != time.Millisecond {
+		t.Errorf("Expected 8000 cycles to take 1ms at 8 MHz, got %s", u.Time())
+	}
+	u.ClockHz = 4_000_000
+	if u.Time() != 2*time.Millisecond {
+		t.Errorf("Expected 8000 cycles to take 2ms at 4 MHz, got %s", u.Time())
+	}
+	if got := u.Duration(3 * 4_000_000); got != 3*time.Second {
+		t.Errorf("Expected 3s got %s", got)
+	}
+	if got := u.CyclesFor(1500 * time.Microsecond); got != 6000 {
+		t.Errorf("Expected 6000 cycles got %d", got)
+	}
+
+	err = u.SetWakeupPeriod(2, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to set the period: %s", err)
+	}
+	if u.SleepCycles[2] != 40_000 {
+		t.Errorf("Expected 40000 cycles got %d", u.SleepCycles[2])
+	}
+	err = u.SetWakeupPeriod(5, time.Millisecond)
+	if err == nil {
+		t.Errorf("Expected an error for sleep register 5")
+	}
+}
+
+// hardwareCycles is the instructions timed on a device by
+// TestHardwareCycles. They only use r0 and r1, with r1 set to a scratch
+// word, as the stage count and r3 are used to loop and print. {n} is
+// replaced by a number that is unique to each copy.
+var hardwareCycles = []struct {
+	name string
+	body string
+}{
+	{"alu register", "add r0, r0, r1"},
+	{"alu immediate", "move r0, 5"},
+	{"store", "st r0, r1, 0"},
+	{"load", "ld r0, r1, 0"},
+	{"jump", "jump j{n}\nj{n}:"},
+	{"jumpr", "jumpr j{n}, 1, lt\nj{n}:"},
+	{"wait", "wait 10"},
+	{"reg_rd", "reg_rd 6, 15, 0"},
+}
+
+const (
+	hardwareCopies = 10  // copies of the instruction in each loop
+	hardwareLoops  = 200 // loops counted with the stage count
+)
+
+// copyOf returns copy `i` of a body in hardwareCycles.
+func copyOf(body string, i int) string {
+	return strings.ReplaceAll(body, "{n}", strconv.Itoa(i))
+}
+
+// measureProgram builds a program that runs `body`
+// hardwareCopies*hardwareLoops times and prints the RTC_SLOW_CLK ticks it
+// took, read from RTC_CNTL_TIME0_REG after setting RTC_CNTL_TIME_UPDATE.
+// The loop and the reads of the timer are the same for every body, so they
+// cancel when two measurements are subtracted.
+func measureProgram(t *testing.T, body string) []byte {
+	t.Helper()
+	timestamp := `
+	reg_wr 3, 31, 31, 1 // RTC_CNTL_TIME_UPDATE
+%[1]s:
+	reg_rd 3, 30, 30 // RTC_CNTL_TIME_VALID
+	jumpr %[1]s, 0, eq
+	reg_rd 4, 15, 0 // RTC_CNTL_TIME0_REG
+`
+	var b strings.Builder
+	b.WriteString(".data\nstart: .int 0\nscratch: .int 0\n.text\n")
+	b.WriteString(fmt.Sprintf(timestamp, "before"))
+	b.WriteString("move r1, start\nst r0, r1, 0\nmove r1, scratch\nstage_rst\nloop:\n")
+	for i := 0; i < hardwareCopies; i++ {
+		b.WriteString(copyOf(body, i) + "\n")
+	}
+	b.WriteString(fmt.Sprintf("stage_inc 1\njumps loop, %d, lt\n", hardwareLoops))
+	b.WriteString(fmt.Sprintf(timestamp, "after"))
+	b.WriteString("move r1, start\nld r1, r1, 0\nsub r0, r0, r1\nst r0, r3, 0\ncall print_u16\n")
+
+	assembler := asm.Assembler{}
+	bin, err := assembler.BuildFile(asm.TEST_PRELUDE+b.String()+asm.TEST_POSTLUDE, "measure.S", asm.DefaultReservedBytes, false)
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	return bin
+}
+
+// measureTicks runs a program from measureProgram() on the device.
+func measureTicks(t *testing.T, h *usb.Hardware, bin []byte) int {
+	t.Helper()
+	out, err := h.Execute(bin, t)
+	if err != nil {
+		t.Fatalf("Execution failed: %s", err)
+	}
+	ticks, err := strconv.Atoi(strings.TrimSpace(out))
+	if err != nil {
+		t.Fatalf("Unexpected output %q: %s", out, err)
+	}
+	return ticks
+}
+
+// TestHardwareCycles times each of hardwareCycles on the device in ESP_PORT
+// and compares it with TimingAccurate. RTC_SLOW_CLK is not calibrated, so
+// the ticks of one cycle are found from `wait 100` and `wait 200`, which
+// differ by exactly 100 cycles. The measured cycles are logged, run with
+// -v to see them. Without ESP_PORT only the programs are built.
+func TestHardwareCycles(t *testing.T) {
+	empty := measureProgram(t, "")
+	wait100 := measureProgram(t, "wait 100")
+	wait200 := measureProgram(t, "wait 200")
+	programs := make([][]byte, len(hardwareCycles))
+	expect := make([]uint64, len(hardwareCycles))
+	for i, c := range hardwareCycles {
+		programs[i] = measureProgram(t, c.body)
+		res, err := asm.Build(context.Background(), []asm.Source{{Name: "body.S", Content: []byte(copyOf(c.body, 0))}}, asm.Options{})
+		if err != nil {
+			t.Fatalf("Failed to build %s: %s", c.name, err)
+		}
+		expect[i], err = emu.AccurateCycles(binary.LittleEndian.Uint32(res.Binary[12:]))
+		if err != nil {
+			t.Fatalf("Failed to find the cycles of %s: %s", c.name, err)
+		}
+	}
+
+	h := usb.Hardware{}
+	err := h.OpenPortFromEnv(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.PortSet() {
+		t.Skipf("Port not set, skipping")
+	}
+	defer h.Close()
+
+	emptyTicks := measureTicks(t, &h, empty)
+	wait100Ticks := measureTicks(t, &h, wait100)
+	wait200Ticks := measureTicks(t, &h, wait200)
+	if wait200Ticks <= wait100Ticks {
+		t.Fatalf("Expected wait 200 to take longer than wait 100, got %d and %d ticks", wait200Ticks, wait100Ticks)
+	}
+	ticksPerCycle := float64(wait200Ticks-wait100Ticks) / (100 * hardwareCopies * hardwareLoops)
+	t.Logf("%.4f RTC_SLOW_CLK ticks per cycle", ticksPerCycle)
+
+	for i, c := range hardwareCycles {
+		t.Run(c.name, func(t *testing.T) {
+			ticks := measureTicks(t, &h, programs[i]) - emptyTicks
+			cycles := float64(ticks) / ticksPerCycle / (hardwareCopies * hardwareLoops)
+			t.Logf("measured %.2f cycles, expected %d", cycles, expect[i])
+			if uint64(math.Round(cycles)) != expect[i] {
+				t.Errorf("Expected %d cycles got %.2f", expect[i], cycles)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package emu
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// TraceRegisters are the names of the registers and flags a trace follows.
+var TraceRegisters = []string{"r0", "r1", "r2", "r3", "zero", "overflow", "stage", "wake"}
+
+// traceWidths is the number of bits of each of TraceRegisters.
+var traceWidths = []int{16, 16, 16, 16, 1, 1, 8, 1}
+
+// RegisterChange is a register or flag changed by an instruction.
+type RegisterChange struct {
+	Name string `json:"name"` // one of TraceRegisters
+	Old  uint32 `json:"old"`
+	New  uint32 `json:"new"`
+}
+
+// MemoryWrite is a word written by an instruction.
+type MemoryWrite struct {
+	Addr int    `json:"addr"` // word address
+	Old  uint32 `json:"old"`
+	New  uint32 `json:"new"`
+}
+
+// TraceEvent is a single executed instruction.
+type TraceEvent struct {
+	Cycle     uint64           `json:"cycle"` // Elapsed() when it started
+	Cycles    uint64           `json:"cycles"`
+	IP        uint16           `json:"ip"`
+	Instr     uint32           `json:"instr"`
+	Text      string           `json:"text,omitempty"` // from Trace.Disassemble
+	Registers []RegisterChange `json:"registers,omitempty"`
+	Writes    []MemoryWrite    `json:"writes,omitempty"`
+	Halt      bool             `json:"halt,omitempty"` // the program halted
+}
+
+// Trace records every instruction executed by Tick().
+type Trace struct {
+	Events      []TraceEvent
+	Disassemble func(addr int, instr uint32) string // sets TraceEvent.Text if not nil
+	initial     []uint32                            // the registers before the first event
+	writes      []MemoryWrite                       // of the current instruction
+}
+
+// NewTrace creates an empty trace.
+func NewTrace() *Trace {
+	return &Trace{Events: make([]TraceEvent, 0)}
+}
+
+// traceState returns the value of each of TraceRegisters.
+func (u *UlpEmu) traceState() []uint32 {
+	b := func(v bool) uint32 {
+		if v {
+			return 1
+		}
+		return 0
+	}
+	return []uint32{
+		uint32(u.R[0]), uint32(u.R[1]), uint32(u.R[2]), uint32(u.R[3]),
+		b(u.Zero), b(u.Overflow), uint32(u.SC), b(u.Wake),
+	}
+}
+
+// traceExecute executes an instruction, adding it to the trace.
+func (u *UlpEmu) traceExecute(instr uint32) error {
+	t := u.Trace
+	before := u.traceState()
+	if t.initial == nil {
+		t.initial = before
+	}
+	e := TraceEvent{Cycle: u.elapsed, IP: u.IP, Instr: instr}
+	if t.Disassemble != nil {
+		e.Text = t.Disassemble(int(u.IP), instr)
+	}
+	t.writes = nil
+	err := u.DecodeExecute(instr)
+	if err != nil {
+		return err
+	}
+	e.Cycles = u.elapsed - e.Cycle
+	e.Writes = t.writes
+	e.Halt = u.Halted
+	for i, v := range u.traceState() {
+		if v != before[i] {
+			e.Registers = append(e.Registers, RegisterChange{TraceRegisters[i], before[i], v})
+		}
+	}
+	t.Events = append(t.Events, e)
+	return nil
+}
+
+// traceWrite records a store if tracing.
+func (u *UlpEmu) traceWrite(addr int, old uint32, value uint32) {
+	if u.Trace != nil {
+		u.Trace.writes = append(u.Trace.writes, MemoryWrite{addr, old, value})
+	}
+}
+
+// WriteJSON writes one JSON object per event, known as JSON lines.
+func (t *Trace) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, e := range t.Events {
+		err := enc.Encode(e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vcdChange is a value of a VCD variable at a time in cycles.
+type vcdChange struct {
+	cycle uint64
+	id    string
+	width int
+	value uint32
+}
+
+// WriteVCD writes the trace as a value change dump for waveform viewers such
+// as GTKWave, with the pc, registers, flags and halt of the program and each
+// RTC GPIO pin that changed. Time is in nanoseconds from ClockHz.
+func (u *UlpEmu) WriteVCD(w io.Writer) error {
+	t := u.Trace
+	if t == nil || len(t.Events) == 0 {
+		return fmt.Errorf("nothing was traced")
+	}
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "$timescale 1 ns $end")
+	fmt.Fprintln(out, "$scope module ulp $end")
+	ids := make(map[string]string)
+	declare := func(name string, width int) {
+		id := vcdId(len(ids))
+		ids[name] = id
+		fmt.Fprintf(out, "$var wire %d %s %s $end\n", width, id, name)
+	}
+	declare("pc", 16)
+	declare("halted", 1)
+	for i, name := range TraceRegisters {
+		declare(name, traceWidths[i])
+	}
+	pins := make([]PinEvent, 0)
+	if r, ok := u.Bus.(*RtcRegisters); ok {
+		pins = r.Events
+	}
+	pinDeclared := make(map[int]bool)
+	for _, p := range pins {
+		if !pinDeclared[p.Pin] {
+			pinDeclared[p.Pin] = true
+			declare(fmt.Sprintf("rtc_gpio%d", p.Pin), 1)
+		}
+	}
+	fmt.Fprintln(out, "$upscope $end")
+	fmt.Fprintln(out, "$enddefinitions $end")
+
+	changes := make([]vcdChange, 0)
+	add := func(cycle uint64, name string, width int, value uint32) {
+		changes = append(changes, vcdChange{cycle, ids[name], width, value})
+	}
+	start := t.Events[0].Cycle
+	add(start, "halted", 1, 0)
+	for i, name := range TraceRegisters {
+		add(start, name, traceWidths[i], t.initial[i])
+	}
+	for pin := range pinDeclared {
+		add(start, fmt.Sprintf("rtc_gpio%d", pin), 1, 0)
+	}
+	halted := false
+	for _, e := range t.Events {
+		if halted {
+			add(e.Cycle, "halted", 1, 0)
+			halted = false
+		}
+		add(e.Cycle, "pc", 16, uint32(e.IP))
+		end := e.Cycle + e.Cycles
+		for _, r := range e.Registers {
+			for i, name := range TraceRegisters {
+				if name == r.Name {
+					add(end, name, traceWidths[i], r.New)
+				}
+			}
+		}
+		if e.Halt {
+			add(end, "halted", 1, 1)
+			halted = true
+		}
+	}
+	for _, p := range pins {
+		v := uint32(0)
+		if p.High {
+			v = 1
+		}
+		add(p.Cycle, fmt.Sprintf("rtc_gpio%d", p.Pin), 1, v)
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].cycle < changes[j].cycle
+	})
+
+	now := uint64(0)
+	for i, c := range changes {
+		if i == 0 || c.cycle != now {
+			now = c.cycle
+			fmt.Fprintf(out, "#%d\n", u.Duration(now).Nanoseconds())
+		}
+		if c.width == 1 {
+			fmt.Fprintf(out, "%d%s\n", c.value, c.id)
+		} else {
+			fmt.Fprintf(out, "b%b %s\n", c.value, c.id)
+		}
+	}
+	return out.Flush()
+}
+
+// vcdId returns the short identifier of the nth VCD variable.
+func vcdId(n int) string {
+	const first, count = '!', '~' - '!' + 1
+	id := ""
+	for {
+		id += string(rune(first + n%count))
+		n /= count
+		if n == 0 {
+			return id
+		}
+		n--
+	}
+}
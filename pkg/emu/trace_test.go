@@ -0,0 +1,112 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package emu_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Molorius/ulp-c/pkg/emu"
+)
+
+func TestTrace(t *testing.T) {
+	// pulse RTC GPIO 2 and count the pulses
+	u, symbols := build(t, `
+		reg_wr 0x104, 16, 16, 1
+		reg_wr 0x101, 16, 16, 1
+		move r1, count
+		move r0, 1
+		st r0, r1, 0
+		reg_wr 0x102, 16, 16, 1
+		halt
+		.data
+	count: .int 0
+	`)
+	u.Trace = emu.NewTrace()
+	u.Trace.Disassemble = func(addr int, instr uint32) string {
+		return fmt.Sprintf("%d:%08x", addr, instr)
+	}
+	err := u.RunUntilHalt(1000)
+	if err != nil {
+		t.Fatalf("Failed to run: %s", err)
+	}
+	events := u.Trace.Events
+	if len(events) != 7 {
+		t.Fatalf("Expected 7 events got %d", len(events))
+	}
+	move := events[3]
+	if move.IP != 3 || move.Cycle != 12+12+4 || move.Cycles != 4 || move.Text != fmt.Sprintf("3:%08x", move.Instr) {
+		t.Errorf("Unexpected event %+v", move)
+	}
+	if len(move.Registers) != 1 || move.Registers[0] != (emu.RegisterChange{Name: "r0", Old: 0, New: 1}) {
+		t.Errorf("Expected r0 to change, got %+v", move.Registers)
+	}
+	store := events[4]
+	if len(store.Writes) != 1 || store.Writes[0].Addr != symbols["count"] || store.Writes[0].New&0xFFFF != 1 {
+		t.Errorf("Expected a write to count, got %+v", store.Writes)
+	}
+	if !events[6].Halt || events[5].Halt {
+		t.Errorf("Expected only the last event to halt")
+	}
+
+	buf := &bytes.Buffer{}
+	err = u.Trace.WriteJSON(buf)
+	if err != nil {
+		t.Fatalf("Failed to write json: %s", err)
+	}
+	lines := 0
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		e := emu.TraceEvent{}
+		err = json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			t.Fatalf("Failed to parse line %d: %s", lines+1, err)
+		}
+		if e.IP != events[lines].IP || e.Cycle != events[lines].Cycle {
+			t.Errorf("Line %d does not match the event", lines+1)
+		}
+		lines++
+	}
+	if lines != len(events) {
+		t.Errorf("Expected %d lines got %d", len(events), lines)
+	}
+
+	buf.Reset()
+	err = u.WriteVCD(buf)
+	if err != nil {
+		t.Fatalf("Failed to write vcd: %s", err)
+	}
+	vcd := buf.String()
+	expect := []string{
+		"$timescale 1 ns $end",
+		"$var wire 16 ! pc $end",
+		"$var wire 1 \" halted $end",
+		"$var wire 16 # r0 $end",
+		"$var wire 1 + rtc_gpio2 $end",
+		"$enddefinitions $end",
+		"#0\n0\"\nb0 #\n",
+		"#1500\nb1 !\n1+\n",     // the pin goes high as the second reg_wr starts, 12 cycles at 8 MHz
+		"#4000\nb1 #\nb100 !\n", // the move of r0 ends as the store starts
+		"#5000\nb101 !\n0+\n",   // the pin goes low
+		"#6750\n1\"\n",          // the halt ends after 54 cycles
+	}
+	for _, e := range expect {
+		if !strings.Contains(vcd, e) {
+			t.Errorf("Expected vcd to contain %q, got:\n%s", e, vcd)
+		}
+	}
+
+	u, _ = build(t, "halt")
+	if u.WriteVCD(buf) == nil {
+		t.Errorf("Expected an error without a trace")
+	}
+}
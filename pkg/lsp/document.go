@@ -0,0 +1,213 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Molorius/ulp-c/pkg/asm"
+	"github.com/Molorius/ulp-c/pkg/asm/token"
+)
+
+// document is an open file along with the result of building it.
+type document struct {
+	uri    string
+	name   string // the file name used in diagnostics
+	text   string
+	lines  []string
+	file   *asm.File   // the parsed file, may be partial
+	result *asm.Result // nil unless the build succeeded
+}
+
+// occurrence is a label used or defined in a document.
+type occurrence struct {
+	tok asm.Token
+	def bool // if this is where the label is defined
+}
+
+// uriName returns the file name of a uri.
+func uriName(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return u.Path
+}
+
+// update parses and builds the new text of the document,
+// returning the diagnostics found.
+func (s *Server) update(uri string, text string) []Diagnostic {
+	d := &document{
+		uri:   uri,
+		name:  uriName(uri),
+		text:  text,
+		lines: strings.Split(text, "\n"),
+	}
+	s.docs[uri] = d
+	d.file, _ = asm.Parse(text, d.name)
+	src := []asm.Source{{Name: d.name, Content: []byte(text)}}
+	res, err := asm.Build(context.Background(), src, asm.Options{ReservedBytes: s.Reserved})
+	if err == nil {
+		d.result = res
+	}
+
+	diags := make([]Diagnostic, 0)
+	for _, diag := range res.Diagnostics {
+		if diag.Ref.Filename != "" && diag.Ref.Filename != d.name {
+			continue
+		}
+		r := Range{}
+		if diag.Ref.Line > 0 {
+			start := refPosition(diag.Ref)
+			r = Range{Start: start, End: Position{Line: start.Line, Character: len(d.line(start.Line))}}
+		}
+		severity := 1
+		if diag.Severity == asm.SeverityWarning {
+			severity = 2
+		}
+		diags = append(diags, Diagnostic{
+			Range:    r,
+			Severity: severity,
+			Source:   "ulp-c",
+			Message:  diag.Message,
+		})
+	}
+	return diags
+}
+
+func (d *document) line(n int) string {
+	if n < 0 || n >= len(d.lines) {
+		return ""
+	}
+	return strings.TrimSuffix(d.lines[n], "\r")
+}
+
+// refPosition converts a one based reference to a zero based position.
+func refPosition(ref asm.FileRef) Position {
+	return Position{Line: max(ref.Line-1, 0), Character: max(ref.Index-1, 0)}
+}
+
+// tokenRange returns the range covered by a token.
+func tokenRange(t asm.Token) Range {
+	start := refPosition(t.Ref)
+	end := start
+	end.Character += len(t.Lexeme)
+	return Range{Start: start, End: end}
+}
+
+// contains returns true if the position is within or at the end of a token.
+func contains(t asm.Token, p Position) bool {
+	r := tokenRange(t)
+	return r.Start.Line == p.Line && r.Start.Character <= p.Character && p.Character <= r.End.Character
+}
+
+// occurrences returns every use and definition of a label in the document.
+func (d *document) occurrences() []occurrence {
+	out := make([]occurrence, 0)
+	for _, stmnt := range d.file.Stmnts {
+		asm.Inspect(stmnt, func(n asm.Node) bool {
+			switch n := n.(type) {
+			case asm.StmntLabel:
+				out = append(out, occurrence{tok: n.Label, def: true})
+			case asm.StmntGlobal:
+				out = append(out, occurrence{tok: n.Label})
+			case asm.ExprLiteral:
+				if n.Operator.TokenType == token.Identifier {
+					out = append(out, occurrence{tok: n.Operator})
+				}
+			}
+			return true
+		})
+	}
+	return out
+}
+
+// labelAt returns the name of the label at a position.
+func (d *document) labelAt(p Position) (asm.Token, bool) {
+	for _, o := range d.occurrences() {
+		if contains(o.tok, p) {
+			return o.tok, true
+		}
+	}
+	return asm.Token{}, false
+}
+
+// instrAt returns the instruction whose mnemonic is at a position.
+func (d *document) instrAt(p Position) (asm.StmntInstr, bool) {
+	for _, stmnt := range d.file.Stmnts {
+		if instr, ok := stmnt.(asm.StmntInstr); ok && contains(instr.Instruction, p) {
+			return instr, true
+		}
+	}
+	return asm.StmntInstr{}, false
+}
+
+// location returns the location of a token in the document.
+func (d *document) location(t asm.Token) Location {
+	return Location{URI: d.uri, Range: tokenRange(t)}
+}
+
+func (s *Server) didOpen(params json.RawMessage) error {
+	p := didOpenParams{}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return err
+	}
+	s.publish(p.TextDocument.URI, s.update(p.TextDocument.URI, p.TextDocument.Text))
+	return nil
+}
+
+func (s *Server) didChange(params json.RawMessage) error {
+	p := didChangeParams{}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return err
+	}
+	if len(p.ContentChanges) == 0 {
+		return nil
+	}
+	// full sync, so the last change is the whole document
+	text := p.ContentChanges[len(p.ContentChanges)-1].Text
+	s.publish(p.TextDocument.URI, s.update(p.TextDocument.URI, text))
+	return nil
+}
+
+func (s *Server) didClose(params json.RawMessage) error {
+	p := didCloseParams{}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return err
+	}
+	delete(s.docs, p.TextDocument.URI)
+	s.publish(p.TextDocument.URI, []Diagnostic{})
+	return nil
+}
+
+func (s *Server) publish(uri string, diags []Diagnostic) {
+	s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: uri, Diagnostics: diags})
+}
+
+// positionParams decodes the parameters of a request and finds the document.
+func (s *Server) positionParams(params json.RawMessage, p any) (*document, error) {
+	if err := json.Unmarshal(params, p); err != nil {
+		return nil, err
+	}
+	var uri string
+	switch p := p.(type) {
+	case *textDocumentPositionParams:
+		uri = p.TextDocument.URI
+	case *referenceParams:
+		uri = p.TextDocument.URI
+	}
+	d, ok := s.docs[uri]
+	if !ok {
+		return nil, fmt.Errorf("document %s is not open", uri)
+	}
+	return d, nil
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package lsp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Molorius/ulp-c/pkg/asm"
+	"github.com/Molorius/ulp-c/pkg/asm/token"
+)
+
+func (s *Server) definition(params json.RawMessage) (any, error) {
+	p := textDocumentPositionParams{}
+	d, err := s.positionParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	tok, ok := d.labelAt(p.Position)
+	if !ok {
+		return nil, nil
+	}
+	for _, o := range d.occurrences() {
+		if o.def && o.tok.Lexeme == tok.Lexeme {
+			return d.location(o.tok), nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *Server) references(params json.RawMessage) (any, error) {
+	p := referenceParams{}
+	d, err := s.positionParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	tok, ok := d.labelAt(p.Position)
+	if !ok {
+		return nil, nil
+	}
+	locs := make([]Location, 0)
+	for _, o := range d.occurrences() {
+		if o.tok.Lexeme != tok.Lexeme || (o.def && !p.Context.IncludeDeclaration) {
+			continue
+		}
+		locs = append(locs, d.location(o.tok))
+	}
+	return locs, nil
+}
+
+func (s *Server) hover(params json.RawMessage) (any, error) {
+	p := textDocumentPositionParams{}
+	d, err := s.positionParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if tok, ok := d.labelAt(p.Position); ok {
+		return d.hoverLabel(tok), nil
+	}
+	if instr, ok := d.instrAt(p.Position); ok {
+		return d.hoverInstr(instr), nil
+	}
+	return nil, nil
+}
+
+// hoverLabel shows the address of a label.
+func (d *document) hoverLabel(tok asm.Token) any {
+	if d.result == nil {
+		return nil
+	}
+	for _, sym := range d.result.Symbols {
+		if sym.Name != tok.Lexeme {
+			continue
+		}
+		text := fmt.Sprintf("**%s**: address 0x%04x (byte 0x%04x)", sym.Name, sym.Address, sym.Address*4)
+		if sym.Section != "" {
+			text += " in " + sym.Section
+		}
+		if sym.Global {
+			text += ", global"
+		}
+		r := tokenRange(tok)
+		return hover{Contents: markupContent{Kind: "markdown", Value: text}, Range: &r}
+	}
+	return nil
+}
+
+// hoverInstr shows the address, encoding and parameter form of an instruction.
+func (d *document) hoverInstr(instr asm.StmntInstr) any {
+	lines := []string{"```asm", strings.TrimPrefix(asm.StmntString(instr), "\t"), "```"}
+	if d.result != nil {
+		addr, bin, ok := d.result.Compiler.StatementAt(instr.Pos())
+		if ok {
+			words := make([]string, 0, len(bin)/4)
+			for i := 0; i+4 <= len(bin); i += 4 {
+				words = append(words, fmt.Sprintf("0x%08x", binary.LittleEndian.Uint32(bin[i:])))
+			}
+			lines = append(lines, fmt.Sprintf("address 0x%04x (byte 0x%04x), encoded %s", addr/4, addr, strings.Join(words, " ")))
+		}
+	}
+	if sig, ok := signature(instr.Instruction.TokenType); ok {
+		lines = append(lines, "", sig.Documentation+": `"+sig.Label+"`")
+	}
+	r := tokenRange(instr.Instruction)
+	return hover{Contents: markupContent{Kind: "markdown", Value: strings.Join(lines, "\n")}, Range: &r}
+}
+
+// signature returns the parameter form of an instruction.
+func signature(t token.Type) (signatureInformation, bool) {
+	form, names, ok := asm.InstructionParams(t)
+	if !ok {
+		return signatureInformation{}, false
+	}
+	params := make([]parameterInformation, len(names))
+	for i, n := range names {
+		params[i] = parameterInformation{Label: n}
+	}
+	label := t.String()
+	if len(names) > 0 {
+		label += " " + strings.Join(names, ", ")
+	}
+	return signatureInformation{Label: label, Documentation: form, Parameters: params}, true
+}
+
+// lineContext splits the text of a line before the cursor into
+// the mnemonic and the text after it. The mnemonic is empty
+// if the cursor is still on the first word of the statement.
+func (d *document) lineContext(p Position) (string, string) {
+	line := d.line(p.Line)
+	line = line[:min(p.Character, len(line))]
+	if i := strings.LastIndex(line, ":"); i >= 0 {
+		line = line[i+1:] // after a label
+	}
+	line = strings.TrimLeft(line, " \t")
+	i := strings.IndexAny(line, " \t")
+	if i < 0 {
+		return "", line
+	}
+	return line[:i], line[i:]
+}
+
+func (s *Server) completion(params json.RawMessage) (any, error) {
+	p := textDocumentPositionParams{}
+	d, err := s.positionParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	mnemonic, _ := d.lineContext(p.Position)
+	items := make([]completionItem, 0)
+	if mnemonic == "" {
+		// the start of a statement
+		for _, t := range token.Types() {
+			if t.IsInstruction() {
+				detail := ""
+				if sig, ok := signature(t); ok {
+					detail = sig.Label
+				}
+				items = append(items, completionItem{Label: t.String(), Kind: kindKeyword, Detail: detail})
+			} else if t.IsDirective() {
+				items = append(items, completionItem{Label: t.String(), Kind: kindKeyword, Detail: "directive"})
+			}
+		}
+		return items, nil
+	}
+
+	// the arguments of a statement
+	instr := token.ToType(mnemonic)
+	for _, t := range token.Types() {
+		if t.IsRegister() {
+			items = append(items, completionItem{Label: t.String(), Kind: kindVariable, Detail: "register"})
+		} else if t.IsJump() && (instr == token.Jump || instr == token.Jumpr || instr == token.Jumps) {
+			items = append(items, completionItem{Label: t.String(), Kind: kindConstant, Detail: "jump condition"})
+		}
+	}
+	seen := make(map[string]bool)
+	labels := make([]string, 0)
+	for _, o := range d.occurrences() {
+		if o.def && !seen[o.tok.Lexeme] {
+			seen[o.tok.Lexeme] = true
+			labels = append(labels, o.tok.Lexeme)
+		}
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		items = append(items, completionItem{Label: l, Kind: kindFunction, Detail: "label"})
+	}
+	return items, nil
+}
+
+func (s *Server) signatureHelp(params json.RawMessage) (any, error) {
+	p := textDocumentPositionParams{}
+	d, err := s.positionParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	mnemonic, args := d.lineContext(p.Position)
+	sig, ok := signature(token.ToType(mnemonic))
+	if !ok || len(sig.Parameters) == 0 {
+		return nil, nil
+	}
+	active := min(strings.Count(args, ","), len(sig.Parameters)-1)
+	return signatureHelp{Signatures: []signatureInformation{sig}, ActiveParameter: active}, nil
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+
+	"github.com/Molorius/ulp-c/pkg/asm"
+)
+
+// Server is a language server for ULP assembly.
+type Server struct {
+	in       *bufio.Reader
+	out      io.Writer
+	docs     map[string]*document // open documents by uri
+	shutdown bool                 // if a shutdown request was received
+	Reserved int                  // bytes reserved for the ULP when building
+}
+
+// NewServer creates a server that reads requests from `in`
+// and writes responses to `out`, such as stdin and stdout.
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{
+		in:       bufio.NewReader(in),
+		out:      out,
+		docs:     make(map[string]*document),
+		Reserved: asm.DefaultReservedBytes,
+	}
+}
+
+// Serve handles messages until the client exits or the input closes.
+func (s *Server) Serve() error {
+	for {
+		body, err := s.read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		msg := message{}
+		err = json.Unmarshal(body, &msg)
+		if err != nil {
+			s.respondError(nil, codeParseError, err.Error())
+			continue
+		}
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return fmt.Errorf("exit without shutdown")
+			}
+			return nil
+		}
+		s.handle(msg)
+	}
+}
+
+// read reads the body of the next message.
+func (s *Server) read() ([]byte, error) {
+	header, err := textproto.NewReader(s.in).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Content-Length: %w", err)
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(s.in, body)
+	return body, err
+}
+
+func (s *Server) write(msg message) {
+	msg.Jsonrpc = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (s *Server) respond(id *json.RawMessage, result any) {
+	if result == nil {
+		// a null result must still be sent
+		result = json.RawMessage("null")
+	}
+	s.write(message{ID: id, Result: result})
+}
+
+func (s *Server) respondError(id *json.RawMessage, code int, text string) {
+	if id == nil {
+		null := json.RawMessage("null")
+		id = &null
+	}
+	s.write(message{ID: id, Error: &responseError{Code: code, Message: text}})
+}
+
+func (s *Server) notify(method string, params any) {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return
+	}
+	s.write(message{Method: method, Params: b})
+}
+
+// handle dispatches a request or notification.
+func (s *Server) handle(msg message) {
+	var result any
+	var err error
+	switch msg.Method {
+	case "initialize":
+		result = s.initialize()
+	case "initialized", "$/cancelRequest", "$/setTrace", "workspace/didChangeConfiguration":
+		return
+	case "shutdown":
+		s.shutdown = true
+	case "textDocument/didOpen":
+		err = s.didOpen(msg.Params)
+	case "textDocument/didChange":
+		err = s.didChange(msg.Params)
+	case "textDocument/didClose":
+		err = s.didClose(msg.Params)
+	case "textDocument/definition":
+		result, err = s.definition(msg.Params)
+	case "textDocument/references":
+		result, err = s.references(msg.Params)
+	case "textDocument/hover":
+		result, err = s.hover(msg.Params)
+	case "textDocument/completion":
+		result, err = s.completion(msg.Params)
+	case "textDocument/signatureHelp":
+		result, err = s.signatureHelp(msg.Params)
+	default:
+		if msg.ID != nil {
+			s.respondError(msg.ID, codeMethodNotFound, fmt.Sprintf("unknown method %s", msg.Method))
+		}
+		return
+	}
+	if msg.ID == nil {
+		return // notifications have no response
+	}
+	if err != nil {
+		s.respondError(msg.ID, codeInvalidParams, err.Error())
+		return
+	}
+	s.respond(msg.ID, result)
+}
+
+func (s *Server) initialize() any {
+	return map[string]any{
+		"capabilities": map[string]any{
+			"textDocumentSync":   1, // full
+			"definitionProvider": true,
+			"referencesProvider": true,
+			"hoverProvider":      true,
+			"completionProvider": map[string]any{},
+			"signatureHelpProvider": map[string]any{
+				"triggerCharacters": []string{" ", ","},
+			},
+		},
+		"serverInfo": map[string]any{
+			"name": "ulp-c",
+		},
+	}
+}
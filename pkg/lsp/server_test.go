@@ -0,0 +1,208 @@
+/*
+Copyright 2024 Blake Felt blake.w.felt@gmail.com
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// session writes every request for the server then collects the output.
+type session struct {
+	in     bytes.Buffer
+	nextID int
+}
+
+func (s *session) send(method string, params any) int {
+	s.nextID++
+	s.write(map[string]any{"jsonrpc": "2.0", "id": s.nextID, "method": method, "params": params})
+	return s.nextID
+}
+
+func (s *session) notify(method string, params any) {
+	s.write(map[string]any{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+func (s *session) write(msg any) {
+	b, _ := json.Marshal(msg)
+	fmt.Fprintf(&s.in, "Content-Length: %d\r\n\r\n%s", len(b), b)
+}
+
+// run serves the requests, returning the responses by id
+// and the published diagnostics in order.
+func (s *session) run(t *testing.T) (map[int]json.RawMessage, []publishDiagnosticsParams) {
+	out := bytes.Buffer{}
+	err := NewServer(&s.in, &out).Serve()
+	if err != nil {
+		t.Fatalf("Server failed: %s", err)
+	}
+	responses := make(map[int]json.RawMessage)
+	published := make([]publishDiagnosticsParams, 0)
+	r := &Server{in: bufio.NewReader(&out)}
+	for {
+		body, err := r.read()
+		if err != nil {
+			break
+		}
+		msg := struct {
+			ID     *int            `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+			Result json.RawMessage `json:"result"`
+			Error  *responseError  `json:"error"`
+		}{}
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Fatalf("Invalid response %s: %s", body, err)
+		}
+		if msg.Error != nil {
+			t.Errorf("Request %d failed: %s", *msg.ID, msg.Error.Message)
+		}
+		if msg.Method == "textDocument/publishDiagnostics" {
+			p := publishDiagnosticsParams{}
+			json.Unmarshal(msg.Params, &p)
+			published = append(published, p)
+		} else if msg.ID != nil {
+			responses[*msg.ID] = msg.Result
+		}
+	}
+	return responses, published
+}
+
+func TestServer(t *testing.T) {
+	const uri = "file:///test.S"
+	text := strings.Join([]string{
+		"\t.boot",
+		"entry:",
+		"\tmove r0, 1",
+		"\tjump entry",
+		"\thalt",
+	}, "\n")
+	doc := map[string]any{"uri": uri}
+	at := func(line, char int) map[string]any {
+		return map[string]any{"textDocument": doc, "position": Position{line, char}}
+	}
+
+	s := session{}
+	initialize := s.send("initialize", map[string]any{})
+	s.notify("initialized", map[string]any{})
+	s.notify("textDocument/didOpen", map[string]any{
+		"textDocument": map[string]any{"uri": uri, "version": 1, "text": text},
+	})
+	definition := s.send("textDocument/definition", at(3, 7))
+	refs := at(3, 7)
+	refs["context"] = map[string]any{"includeDeclaration": true}
+	references := s.send("textDocument/references", refs)
+	hoverInstr := s.send("textDocument/hover", at(2, 2))
+	hoverLabel := s.send("textDocument/hover", at(3, 6))
+	completeInstr := s.send("textDocument/completion", at(4, 1))
+	completeArg := s.send("textDocument/completion", at(3, 6))
+	signature := s.send("textDocument/signatureHelp", at(2, 9))
+	s.notify("textDocument/didChange", map[string]any{
+		"textDocument":   map[string]any{"uri": uri, "version": 2},
+		"contentChanges": []map[string]any{{"text": "\tmove r0, missing\n"}},
+	})
+	shutdown := s.send("shutdown", nil)
+	s.notify("exit", nil)
+	responses, published := s.run(t)
+
+	t.Run("initialize", func(t *testing.T) {
+		if !strings.Contains(string(responses[initialize]), `"hoverProvider":true`) {
+			t.Errorf("Missing capabilities: %s", responses[initialize])
+		}
+	})
+	t.Run("diagnostics", func(t *testing.T) {
+		if len(published) != 2 {
+			t.Fatalf("Expected 2 publishes, got %d", len(published))
+		}
+		if len(published[0].Diagnostics) != 0 {
+			t.Errorf("Expected no diagnostics, got %v", published[0].Diagnostics)
+		}
+		if len(published[1].Diagnostics) == 0 {
+			t.Fatalf("Expected a diagnostic for the unknown label")
+		}
+		d := published[1].Diagnostics[0]
+		if d.Range.Start.Line != 0 || !strings.Contains(d.Message, "missing") {
+			t.Errorf("Unexpected diagnostic %+v", d)
+		}
+	})
+	t.Run("definition", func(t *testing.T) {
+		loc := Location{}
+		json.Unmarshal(responses[definition], &loc)
+		expect := Range{Position{1, 0}, Position{1, 5}}
+		if loc.URI != uri || loc.Range != expect {
+			t.Errorf("Expected %v, got %+v", expect, loc)
+		}
+	})
+	t.Run("references", func(t *testing.T) {
+		locs := []Location{}
+		json.Unmarshal(responses[references], &locs)
+		if len(locs) != 2 {
+			t.Fatalf("Expected 2 references, got %+v", locs)
+		}
+		if locs[1].Range.Start != (Position{3, 6}) {
+			t.Errorf("Unexpected reference %+v", locs[1])
+		}
+	})
+	t.Run("hover", func(t *testing.T) {
+		expect := map[int][]string{
+			hoverInstr: {"move r0, 1", "address 0x0000", "encoded 0x", "param1"},
+			hoverLabel: {"**entry**", "address 0x0000", ".boot"},
+		}
+		for id, parts := range expect {
+			h := hover{}
+			json.Unmarshal(responses[id], &h)
+			for _, p := range parts {
+				if !strings.Contains(h.Contents.Value, p) {
+					t.Errorf("Expected hover to contain %q, got %q", p, h.Contents.Value)
+				}
+			}
+		}
+	})
+	t.Run("completion", func(t *testing.T) {
+		labels := func(id int) string {
+			items := []completionItem{}
+			json.Unmarshal(responses[id], &items)
+			names := make([]string, len(items))
+			for i, item := range items {
+				names[i] = item.Label
+			}
+			return " " + strings.Join(names, " ") + " "
+		}
+		instr := labels(completeInstr)
+		for _, want := range []string{" halt ", " jumpr ", " .boot "} {
+			if !strings.Contains(instr, want) {
+				t.Errorf("Expected %q in %q", want, instr)
+			}
+		}
+		if strings.Contains(instr, " r0 ") {
+			t.Errorf("Unexpected register in %q", instr)
+		}
+		arg := labels(completeArg)
+		for _, want := range []string{" r0 ", " eq ", " entry "} {
+			if !strings.Contains(arg, want) {
+				t.Errorf("Expected %q in %q", want, arg)
+			}
+		}
+	})
+	t.Run("signature", func(t *testing.T) {
+		help := signatureHelp{}
+		json.Unmarshal(responses[signature], &help)
+		if len(help.Signatures) != 1 || help.Signatures[0].Label != "move rdst, rsrc | imm" || help.ActiveParameter != 1 {
+			t.Errorf("Unexpected signature help %+v", help)
+		}
+	})
+	t.Run("shutdown", func(t *testing.T) {
+		if string(responses[shutdown]) != "null" {
+			t.Errorf("Expected a null result, got %s", responses[shutdown])
+		}
+	})
+}